@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jming514/chirpy/internals/database"
+	"github.com/jming514/chirpy/internals/jwt"
+)
+
+// Token scopes. Access tokens are issued with the scopes of the user's
+// role; routes check for the scope of the action rather than the role.
+const (
+	scopeChirpsWrite    = "chirps:write"
+	scopeChirpsModerate = "chirps:moderate"
+	scopeUsersWrite     = "users:write"
+	scopeFollowsWrite   = "follows:write"
+	scopeAdmin          = "admin"
+)
+
+// scopesForRole returns the scopes an access token for role is issued with
+func scopesForRole(role string) []string {
+	scopes := []string{scopeChirpsWrite, scopeUsersWrite, scopeFollowsWrite}
+	if database.RoleRank(role) >= database.RoleRank(database.RoleModerator) {
+		scopes = append(scopes, scopeChirpsModerate)
+	}
+	if database.RoleRank(role) >= database.RoleRank(database.RoleAdmin) {
+		scopes = append(scopes, scopeAdmin)
+	}
+	return scopes
+}
+
+// narrowScopes returns the scopes that role allows
+func narrowScopes(scopes []string, role string) []string {
+	allowed := scopesForRole(role)
+	narrowed := []string{}
+	for _, scope := range scopes {
+		if containsString(allowed, scope) {
+			narrowed = append(narrowed, scope)
+		}
+	}
+	return narrowed
+}
+
+// principal is the authenticated caller of a request
+type principal struct {
+	UserId        int
+	SessionId     int // zero for tokens from before sessions
+	TokenId       int // the personal access token used, if any
+	Email         string
+	Role          string
+	Scopes        []string
+	ChirpyRed     bool
+	EmailVerified bool
+}
+
+func (p principal) hasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// principalFrom returns the principal stored by authenticate
+func principalFrom(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// authenticate requires a valid chirpy-access Bearer token or personal
+// access token of a user who isn't suspended and puts its principal into
+// the request context
+func (cfg *apiConfig) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		var p principal
+		var ok bool
+		if strings.HasPrefix(token, personalTokenPrefix) {
+			p, ok = cfg.personalTokenPrincipal(w, token)
+		} else {
+			p, ok = cfg.accessTokenPrincipal(w, token)
+		}
+		if !ok {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalKey{}, p)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// accessTokenPrincipal validates a chirpy-access JWT. If it is not ok, the
+// error response has been written.
+func (cfg *apiConfig) accessTokenPrincipal(w http.ResponseWriter, token string) (principal, bool) {
+	validToken, err := jwt.ValidateToken(token, "chirpy-access")
+	if err != nil {
+		log.Printf("Error validating token: %s\n", err)
+		respondWithError(w, 401, "invalid token")
+		return principal{}, false
+	}
+	userId, err := jwt.GetUserIdFromToken(validToken)
+	if err != nil {
+		log.Printf("Error getting user ID: %s\n", err)
+		respondWithError(w, 401, "cannot read user ID")
+		return principal{}, false
+	}
+	claims, err := jwt.GetClaims(validToken)
+	if err != nil {
+		log.Printf("Error reading token claims: %s\n", err)
+		respondWithError(w, 401, "invalid token")
+		return principal{}, false
+	}
+
+	user, ok := cfg.activeUser(w, userId)
+	if !ok {
+		return principal{}, false
+	}
+	// the session is checked on every request too, so logging it out takes
+	// effect at once
+	if claims.SessionId != 0 {
+		ok, err := cfg.checkSession(userId, claims.SessionId)
+		if err != nil {
+			log.Printf("Error checking session: %s\n", err)
+			respondWithError(w, 500, "Cannot check session")
+			return principal{}, false
+		}
+		if !ok {
+			respondWithError(w, 401, "session revoked")
+			return principal{}, false
+		}
+	}
+
+	// tokens from before roles existed act as plain users
+	scopes := claims.Scopes()
+	if claims.Role == "" {
+		scopes = scopesForRole(database.RoleUser)
+	}
+	// the role is the user's current one, so a demotion takes effect at
+	// once too
+	return principal{
+		UserId:        userId,
+		SessionId:     claims.SessionId,
+		Email:         user.Email,
+		Role:          user.Role,
+		Scopes:        narrowScopes(scopes, user.Role),
+		ChirpyRed:     user.Is_Chirpy_Red,
+		EmailVerified: user.EmailVerified,
+	}, true
+}
+
+// activeUser loads the user a token was issued to. It is checked on every
+// request so a suspension takes effect at once, not when the token
+// expires. If it is not ok, the error response has been written.
+func (cfg *apiConfig) activeUser(w http.ResponseWriter, userId int) (database.User, bool) {
+	user, err := cfg.DB.GetUser(strconv.Itoa(userId))
+	if err != nil {
+		respondWithError(w, 401, "invalid token")
+		return database.User{}, false
+	}
+	if user.Suspension.Active(time.Now()) {
+		respondWithError(w, 403, "account suspended")
+		return database.User{}, false
+	}
+	return user, true
+}
+
+// requireScope rejects requests whose token doesn't grant scope. It must
+// run after authenticate.
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := principalFrom(r.Context())
+			if !ok || !p.hasScope(scope) {
+				respondWithError(w, 403, "insufficient scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireSession rejects requests made with a personal access token, so a
+// leaked one can't be used to mint more tokens or take over the account's
+// logins. It must run after authenticate.
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := principalFrom(r.Context())
+		if !ok || p.TokenId != 0 {
+			respondWithError(w, 403, "log in to manage sessions and tokens")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireRole rejects requests from principals below role. It must run
+// after authenticate.
+func requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := principalFrom(r.Context())
+			if !ok || database.RoleRank(p.Role) < database.RoleRank(role) {
+				respondWithError(w, 403, "forbidden")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
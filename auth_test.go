@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// createPersonalToken mints a personal access token with scopes for the
+// user logged in with token
+func (s *testServer) createPersonalToken(t *testing.T, token string, scopes ...string) personalTokenResponse {
+	t.Helper()
+
+	var pat personalTokenResponse
+	params := map[string]any{"name": "test", "scopes": scopes}
+	expect(t, s.do(t, "POST", "/api/tokens", token, params), 201, &pat)
+	if pat.Token == "" {
+		t.Fatalf("created token %+v has no secret", pat)
+	}
+	return pat
+}
+
+func TestAuthenticate(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+	moderator := s.signUpAs(t, "moderator@example.com", database.RoleModerator)
+
+	expect(t, s.do(t, "GET", "/api/timeline", "", nil), 401, nil)
+	expect(t, s.do(t, "GET", "/api/timeline", "garbage", nil), 401, nil)
+	expect(t, s.do(t, "GET", "/api/timeline", user.Refresh_Token, nil), 401, nil)
+	expect(t, s.do(t, "GET", "/api/timeline", personalTokenPrefix+"unknown", nil), 401, nil)
+	expect(t, s.do(t, "GET", "/api/timeline", user.Token, nil), 200, nil)
+
+	// a suspension takes effect at once, not when the token expires
+	pat := s.createPersonalToken(t, user.Token)
+	_, err := s.cfg.DB.SuspendUser(user.Id, moderator.Id, "spam", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, s.do(t, "GET", "/api/timeline", user.Token, nil), 403, nil)
+	expect(t, s.do(t, "GET", "/api/timeline", pat.Token, nil), 403, nil)
+	_, err = s.cfg.DB.ReinstateUser(user.Id, moderator.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, s.do(t, "GET", "/api/timeline", pat.Token, nil), 200, nil)
+}
+
+func TestRequireRole(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+	moderator := s.signUpAs(t, "moderator@example.com", database.RoleModerator)
+	admin := s.signUpAs(t, "admin@example.com", database.RoleAdmin)
+	rolePath := "/admin/users/" + strconv.Itoa(user.Id) + "/role"
+	promote := map[string]string{"role": database.RoleModerator}
+
+	expect(t, s.do(t, "GET", "/admin/reports", user.Token, nil), 403, nil)
+	expect(t, s.do(t, "GET", "/admin/reports", moderator.Token, nil), 200, nil)
+	expect(t, s.do(t, "GET", "/admin/reports", admin.Token, nil), 200, nil)
+	expect(t, s.do(t, "PUT", rolePath, moderator.Token, promote), 403, nil)
+	expect(t, s.do(t, "PUT", rolePath, admin.Token, promote), 200, nil)
+
+	// a demotion takes effect at once, not when the token expires
+	other := s.signUpAs(t, "admin2@example.com", database.RoleAdmin)
+	_, err := s.cfg.DB.SetUserRole(other.Id, database.RoleUser, admin.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, s.do(t, "PUT", rolePath, other.Token, promote), 403, nil)
+	expect(t, s.do(t, "GET", "/admin/reports", other.Token, nil), 403, nil)
+
+	// a personal access token acts with the owner's current role
+	pat := s.createPersonalToken(t, moderator.Token, scopeChirpsModerate)
+	expect(t, s.do(t, "GET", "/admin/reports", pat.Token, nil), 200, nil)
+	_, err = s.cfg.DB.SetUserRole(moderator.Id, database.RoleUser, admin.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, s.do(t, "GET", "/admin/reports", pat.Token, nil), 403, nil)
+}
+
+func TestPersonalTokens(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+
+	expect(t, s.do(t, "POST", "/api/tokens", user.Token, map[string]any{"name": "ci", "scopes": []string{scopeAdmin}}), 400, nil)
+	pat := s.createPersonalToken(t, user.Token, scopeChirpsWrite)
+	readOnly := s.createPersonalToken(t, user.Token)
+
+	// a token can only do what its scopes allow
+	chirp := map[string]string{"body": "posted by a bot"}
+	expect(t, s.do(t, "POST", "/api/chirps", pat.Token, chirp), 201, nil)
+	expect(t, s.do(t, "POST", "/api/chirps", readOnly.Token, chirp), 403, nil)
+	expect(t, s.do(t, "PUT", "/api/users", pat.Token, userParams{Email: "bot@example.com", Password: "x"}), 403, nil)
+	expect(t, s.do(t, "GET", "/api/timeline", readOnly.Token, nil), 200, nil)
+
+	// and it can't manage credentials, so a leaked one can't mint more
+	expect(t, s.do(t, "GET", "/api/sessions", pat.Token, nil), 403, nil)
+	expect(t, s.do(t, "GET", "/api/tokens", pat.Token, nil), 403, nil)
+	expect(t, s.do(t, "POST", "/api/tokens", pat.Token, map[string]string{"name": "more"}), 403, nil)
+	expect(t, s.do(t, "POST", "/api/users/mfa/totp", pat.Token, nil), 403, nil)
+
+	var tokens []personalTokenResponse
+	expect(t, s.do(t, "GET", "/api/tokens", user.Token, nil), 200, &tokens)
+	if len(tokens) != 2 || tokens[0].Token != "" || tokens[1].Token != "" {
+		t.Fatalf("tokens are %+v", tokens)
+	}
+	expect(t, s.do(t, "DELETE", "/api/tokens/"+strconv.Itoa(pat.Id), user.Token, nil), 200, nil)
+	expect(t, s.do(t, "GET", "/api/timeline", pat.Token, nil), 401, nil)
+
+	// logging out everywhere leaves personal access tokens working
+	expect(t, s.do(t, "DELETE", "/api/sessions", user.Token, nil), 200, nil)
+	expect(t, s.do(t, "GET", "/api/timeline", readOnly.Token, nil), 200, nil)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+
+	"github.com/jming514/chirpy/internals/database"
+	"github.com/jming514/chirpy/internals/jwt"
+	"github.com/jming514/chirpy/internals/mailer"
+)
+
+const (
+	verifyTokenSeconds = 60 * 60 * 48
+	resetTokenSeconds  = 60 * 60
+)
+
+// mailerFromEnv builds the mailer selected by MAILER: "file" (the
+// default) appends messages to MAIL_FILE, "smtp" sends them through
+// SMTP_HOST
+func mailerFromEnv() (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "chirpy@localhost"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "", "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "./mail.txt"
+		}
+		return &mailer.File{Path: path, From: from}, nil
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, errors.New("SMTP_HOST is required with MAILER=smtp")
+		}
+		port := 587
+		if v := os.Getenv("SMTP_PORT"); v != "" {
+			var err error
+			port, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SMTP_PORT: %w", err)
+			}
+		}
+		return mailer.SMTP{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", os.Getenv("MAILER"))
+	}
+}
+
+// validEmail reports whether email is a bare address such as
+// "user@example.com"
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// sendMail sends msg in the background, so a slow mail server neither
+// holds up the response nor shows in its timing
+func (cfg *apiConfig) sendMail(msg mailer.Message) {
+	go func() {
+		err := cfg.Mailer.Send(msg)
+		if err != nil {
+			log.Printf("Error sending mail to %s: %s\n", msg.To, err)
+		}
+	}()
+}
+
+// sendVerification mails userId a token proving they own email
+func (cfg *apiConfig) sendVerification(userId int, email string) {
+	token, err := jwt.CreateEmailToken(verifyTokenSeconds, userId, "chirpy-verify", email)
+	if err != nil {
+		log.Printf("Error creating token: %s\n", err)
+		return
+	}
+	cfg.sendMail(mailer.Message{
+		To:      email,
+		Subject: "Verify your Chirpy email address",
+		Body: "Confirm this address by sending the token below to /api/users/verify.\n\n" +
+			token + "\n\nIt expires in 48 hours. If you didn't sign up for Chirpy, ignore this email.\n",
+	})
+}
+
+// mailedToken validates a single-use token of type issuer and spends it.
+// It returns the user the token was mailed to and its claims, which hold
+// the address it was mailed to.
+func (cfg *apiConfig) mailedToken(w http.ResponseWriter, token string, issuer string) (int, *jwt.Claims, bool) {
+	validToken, err := jwt.ValidateToken(token, issuer)
+	if err != nil {
+		respondWithError(w, 400, "invalid or expired token")
+		return 0, nil, false
+	}
+	userId, err := jwt.GetUserIdFromToken(validToken)
+	if err != nil {
+		respondWithError(w, 400, "invalid or expired token")
+		return 0, nil, false
+	}
+	claims, err := jwt.GetClaims(validToken)
+	if err != nil || claims.Email == "" || claims.ExpiresAt == nil {
+		respondWithError(w, 400, "invalid or expired token")
+		return 0, nil, false
+	}
+
+	err = cfg.DB.ConsumeToken(token, claims.ExpiresAt.Time)
+	if errors.Is(err, database.ErrTokenUsed) {
+		respondWithError(w, 409, "token already used")
+		return 0, nil, false
+	}
+	if err != nil {
+		log.Printf("Error spending token: %s\n", err)
+		respondWithError(w, 500, "Cannot use token")
+		return 0, nil, false
+	}
+	return userId, claims, true
+}
+
+// verifyEmail marks the address a verification token was mailed to as
+// verified
+func (cfg *apiConfig) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 500, "Error decoding parameters...")
+		return
+	}
+
+	userId, claims, ok := cfg.mailedToken(w, params.Token, "chirpy-verify")
+	if !ok {
+		return
+	}
+	user, err := cfg.DB.VerifyEmail(userId, claims.Email)
+	if errors.Is(err, database.ErrEmailChanged) {
+		respondWithError(w, 400, "the email address has changed since the token was sent")
+		return
+	}
+	if err != nil {
+		log.Printf("Error verifying email: %s\n", err)
+		respondWithError(w, 404, "user not found")
+		return
+	}
+	respondWithJSON(w, 200, user)
+}
+
+// resendVerification mails the caller a new verification token
+func (cfg *apiConfig) resendVerification(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	user, err := cfg.DB.GetUser(strconv.Itoa(p.UserId))
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+	if user.EmailVerified {
+		respondWithError(w, 409, "email address already verified")
+		return
+	}
+
+	cfg.sendVerification(user.Id, user.Email)
+	respondWithJSON(w, 200, "ok")
+}
+
+// requestPasswordReset mails a reset token to the address if an account
+// has it. The response is the same either way.
+func (cfg *apiConfig) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 500, "Error decoding parameters...")
+		return
+	}
+	if !validEmail(params.Email) {
+		respondWithError(w, 400, "invalid email address")
+		return
+	}
+
+	user, err := cfg.DB.GetUserByEmail(params.Email)
+	if err == nil {
+		// a token is only good until the password changes
+		stamp, err := cfg.DB.PasswordStamp(user.Id)
+		if err != nil {
+			log.Printf("Error getting password stamp: %s\n", err)
+			respondWithJSON(w, 200, "ok")
+			return
+		}
+		token, err := jwt.CreateResetToken(resetTokenSeconds, user.Id, user.Email, stamp)
+		if err != nil {
+			log.Printf("Error creating token: %s\n", err)
+		} else {
+			cfg.sendMail(mailer.Message{
+				To:      user.Email,
+				Subject: "Reset your Chirpy password",
+				Body: "Choose a new password by sending the token below with it to /api/password-reset/confirm.\n\n" +
+					token + "\n\nIt expires in an hour. If you didn't ask to reset your password, ignore this email.\n",
+			})
+		}
+	}
+	respondWithJSON(w, 200, "ok")
+}
+
+// resetPassword sets a new password with a reset token. Every session
+// and personal access token of the user is revoked, since whoever made
+// them may have known the old password.
+func (cfg *apiConfig) resetPassword(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 500, "Error decoding parameters...")
+		return
+	}
+	if params.Password == "" {
+		respondWithError(w, 400, "password is required")
+		return
+	}
+
+	userId, claims, ok := cfg.mailedToken(w, params.Token, "chirpy-reset")
+	if !ok {
+		return
+	}
+	err = cfg.DB.ResetPassword(userId, claims.Email, claims.PasswordStamp, params.Password)
+	if errors.Is(err, database.ErrEmailChanged) {
+		respondWithError(w, 400, "the email address has changed since the token was sent")
+		return
+	}
+	if errors.Is(err, database.ErrPasswordChanged) {
+		respondWithError(w, 400, "the password has changed since the token was sent")
+		return
+	}
+	if err != nil {
+		log.Printf("Error resetting password: %s\n", err)
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	// whoever holds the mailbox is the owner, so earlier guesses stop counting
+	err = cfg.DB.ClearLoginThrottle(database.AccountThrottleKey(claims.Email))
+	if err != nil {
+		log.Printf("Error clearing failed logins: %s\n", err)
+	}
+	respondWithJSON(w, 200, "ok")
+}
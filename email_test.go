@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// mailedToken waits for the mail s sends to to with subject and returns
+// the token in it
+func (s *testServer) mailedToken(t *testing.T, to, subject string) string {
+	t.Helper()
+
+	// mail is sent in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		msg, ok := s.mail.Last(to)
+		if ok && msg.Subject == subject {
+			// the token is the second paragraph
+			paragraphs := strings.Split(msg.Body, "\n\n")
+			if len(paragraphs) < 2 {
+				t.Fatalf("mail to %s has no token: %q", to, msg.Body)
+			}
+			return paragraphs[1]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no mail %q to %s", subject, to)
+	return ""
+}
+
+func TestVerifyEmail(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+	if user.EmailVerified {
+		t.Fatal("new user is verified")
+	}
+
+	token := s.mailedToken(t, user.Email, "Verify your Chirpy email address")
+	expect(t, s.do(t, "POST", "/api/users/verify", "", map[string]string{"token": "nope"}), 400, nil)
+	var verified database.UserReturn
+	expect(t, s.do(t, "POST", "/api/users/verify", "", map[string]string{"token": token}), 200, &verified)
+	if !verified.EmailVerified || verified.Id != user.Id {
+		t.Fatalf("verifying got %+v", verified)
+	}
+	expect(t, s.do(t, "POST", "/api/users/verify", "", map[string]string{"token": token}), 409, nil)
+	expect(t, s.do(t, "POST", "/api/users/verify/send", user.Token, nil), 409, nil)
+}
+
+func TestPasswordReset(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+	var pat struct {
+		Token string `json:"token"`
+	}
+	expect(t, s.do(t, "POST", "/api/tokens", user.Token, map[string]string{"name": "ci"}), 201, &pat)
+
+	// the response doesn't tell whether an account has the address
+	expect(t, s.do(t, "POST", "/api/password-reset", "", map[string]string{"email": "nobody@example.com"}), 200, nil)
+	expect(t, s.do(t, "POST", "/api/password-reset", "", map[string]string{"email": user.Email}), 200, nil)
+	token := s.mailedToken(t, user.Email, "Reset your Chirpy password")
+	if _, ok := s.mail.Last("nobody@example.com"); ok {
+		t.Fatal("reset mailed to an address without an account")
+	}
+
+	reset := map[string]string{"token": token, "password": "new password"}
+	expect(t, s.do(t, "POST", "/api/password-reset/confirm", "", reset), 200, nil)
+	expect(t, s.do(t, "POST", "/api/password-reset/confirm", "", reset), 409, nil)
+
+	// everything made with the old password stops working
+	expect(t, s.do(t, "GET", "/api/timeline", user.Token, nil), 401, nil)
+	expect(t, s.do(t, "POST", "/api/refresh", user.Refresh_Token, nil), 401, nil)
+	expect(t, s.do(t, "GET", "/api/timeline", pat.Token, nil), 401, nil)
+	expect(t, s.do(t, "POST", "/api/login", "", userParams{Email: user.Email, Password: "password"}), 401, nil)
+	login := s.login(t, user.Email, "new password")
+	if !login.EmailVerified {
+		t.Fatal("resetting the password through the mailed link didn't verify the address")
+	}
+}
+
+func TestPasswordResetAfterPasswordChange(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+
+	expect(t, s.do(t, "POST", "/api/password-reset", "", map[string]string{"email": user.Email}), 200, nil)
+	token := s.mailedToken(t, user.Email, "Reset your Chirpy password")
+
+	// a token mailed before the password changed no longer resets it
+	expect(t, s.do(t, "PUT", "/api/users", user.Token, userParams{Email: user.Email, Password: "changed"}), 200, nil)
+	var body errorBody
+	reset := map[string]string{"token": token, "password": "new password"}
+	expect(t, s.do(t, "POST", "/api/password-reset/confirm", "", reset), 400, &body)
+	if body.Error != "the password has changed since the token was sent" {
+		t.Fatalf("stale reset token got %q", body.Error)
+	}
+	s.login(t, user.Email, "changed")
+}
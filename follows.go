@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// followTarget reads the {userID} of a follow route and checks the user
+// exists, responding with an error if not
+func (cfg *apiConfig) followTarget(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id := chi.URLParam(r, "userID")
+	userId, err := strconv.Atoi(id)
+	if err != nil {
+		respondWithError(w, 400, "Invalid user ID")
+		return 0, false
+	}
+	_, err = cfg.DB.GetUser(id)
+	if err != nil {
+		respondWithError(w, 404, "User doesn't exist")
+		return 0, false
+	}
+
+	return userId, true
+}
+
+func (cfg *apiConfig) follow(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	followeeId, ok := cfg.followTarget(w, r)
+	if !ok {
+		return
+	}
+	if followeeId == p.UserId {
+		respondWithError(w, 400, "You can't follow yourself")
+		return
+	}
+
+	err := cfg.DB.Follow(p.UserId, followeeId)
+	if err != nil {
+		log.Printf("Error following user: %s\n", err)
+		respondWithError(w, 500, "error following user")
+		return
+	}
+	respondWithJSON(w, 200, "ok")
+}
+
+func (cfg *apiConfig) unfollow(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	followeeId, ok := cfg.followTarget(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.DB.Unfollow(p.UserId, followeeId)
+	if err != nil {
+		log.Printf("Error unfollowing user: %s\n", err)
+		respondWithError(w, 500, "error unfollowing user")
+		return
+	}
+	respondWithJSON(w, 200, "ok")
+}
+
+func (cfg *apiConfig) followers(w http.ResponseWriter, r *http.Request) {
+	id, ok := cfg.followTarget(w, r)
+	if !ok {
+		return
+	}
+	page, err := pageFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	users, err := cfg.DB.GetFollowers(id, page)
+	if err != nil {
+		log.Printf("Error getting followers: %s\n", err)
+		respondWithError(w, 500, "Cannot get followers")
+		return
+	}
+	respondWithPage(w, r, publicUsers(users), idOfUser, page)
+}
+
+func (cfg *apiConfig) following(w http.ResponseWriter, r *http.Request) {
+	id, ok := cfg.followTarget(w, r)
+	if !ok {
+		return
+	}
+	page, err := pageFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	users, err := cfg.DB.GetFollowing(id, page)
+	if err != nil {
+		log.Printf("Error getting followed users: %s\n", err)
+		respondWithError(w, 500, "Cannot get followed users")
+		return
+	}
+	respondWithPage(w, r, publicUsers(users), idOfUser, page)
+}
+
+// timeline returns the chirps of everyone the caller follows, newest
+// first unless sort=asc
+func (cfg *apiConfig) timeline(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	page, err := pageFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	following, err := cfg.DB.GetFollowing(p.UserId, database.Page{})
+	if err != nil {
+		log.Printf("Error getting followed users: %s\n", err)
+		respondWithError(w, 500, "Cannot get timeline")
+		return
+	}
+
+	options := database.Options{
+		AuthorIds: []int{},
+		Sorting:   "desc",
+		Page:      page,
+	}
+	for _, user := range following {
+		options.AuthorIds = append(options.AuthorIds, user.Id)
+	}
+	if r.URL.Query().Get("sort") == "asc" {
+		options.Sorting = "asc"
+	}
+
+	chirps, err := cfg.DB.GetChirps(options)
+	if err != nil {
+		log.Printf("Error getting chirps: %s\n", err)
+		respondWithError(w, 500, "Cannot get timeline")
+		return
+	}
+	respondWithPage(w, r, chirps, idOfChirp, page)
+}
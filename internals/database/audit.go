@@ -0,0 +1,59 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Audit targets
+const (
+	TargetReport = "report"
+	TargetChirp  = "chirp"
+	TargetUser   = "user"
+)
+
+// AuditEntry records an action a moderator took. Action names what was
+// done, e.g. "report.claim" or "user.suspend", to the TargetType record
+// TargetId.
+type AuditEntry struct {
+	Id         int       `json:"id"`
+	ActorId    int       `json:"actor_id"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"target_type"`
+	TargetId   int       `json:"target_id"`
+	Detail     string    `json:"detail,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// chirpDeleteEntry audits a moderator deleting authorId's chirp chirpId
+func chirpDeleteEntry(chirpId int, authorId int, moderatorId int) AuditEntry {
+	return AuditEntry{
+		ActorId: moderatorId, Action: "chirp.delete", TargetType: TargetChirp, TargetId: chirpId,
+		Detail: fmt.Sprintf("written by user %d", authorId),
+	}
+}
+
+// audit adds entry to the audit log as part of tx
+func audit(dbStructure DBStructure, tx *tx, entry AuditEntry) {
+	entry.Id = tx.nextId(dbStructure, "audit_log")
+	entry.CreatedAt = time.Now().UTC()
+	tx.put("audit_log", entry.Id, entry)
+}
+
+// GetAuditLog returns the audit log, newest first
+func (db *DB) GetAuditLog(page Page) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := db.view(func(dbStructure DBStructure) error {
+		for _, e := range dbStructure.AuditLog {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Id > entries[j].Id })
+
+	return pageOf(entries, func(e AuditEntry) int { return e.Id }, true, page), nil
+}
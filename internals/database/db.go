@@ -4,23 +4,65 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/jming514/chirpy/internals/entities"
+	"github.com/jming514/chirpy/internals/moderation"
+	"github.com/jming514/chirpy/internals/password"
 )
 
+// DB keeps the whole database in memory. Every change is appended to a
+// write-ahead log before it is applied; the JSON file is a snapshot that is
+// rewritten every flushInterval, or after every change if that is zero.
 type DB struct {
-	mux  *sync.RWMutex
-	path string
+	mux           *sync.RWMutex
+	path          string
+	wal           *wal
+	seq           uint64
+	data          DBStructure
+	dirty         bool
+	flushInterval time.Duration
+	hasher        *password.Hasher
+	stop          chan struct{}
+	stopOnce      sync.Once
+	done          chan struct{}
+	closed        bool
 }
 
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[int]User  `json:"users"`
-	Tokens map[int]Token `json:"tokens"`
+	SchemaVersion int            `json:"schema_version"`
+	WalSeq        uint64         `json:"wal_seq"`
+	Sequences     map[string]int `json:"sequences"`
+	Chirps        map[int]Chirp  `json:"chirps"`
+	Users         map[int]User   `json:"users"`
+	Tokens        map[int]Token  `json:"tokens"`
+
+	Sessions      map[int]Session      `json:"sessions"`
+	RefreshTokens map[int]RefreshToken `json:"refresh_tokens"`
+
+	Follows map[int]Follow `json:"follows"`
+
+	Likes    map[int]Engagement `json:"likes"`
+	Rechirps map[int]Engagement `json:"rechirps"`
+
+	Reports  map[int]Report     `json:"reports"`
+	AuditLog map[int]AuditEntry `json:"audit_log"`
+
+	LoginThrottles map[string]LoginThrottle `json:"login_throttles"`
+	Notifications  map[int]Notification     `json:"notifications"`
+
+	TOTP map[int]TOTP `json:"totp"`
+
+	UsedTokens map[string]UsedToken `json:"used_tokens"`
+
+	PersonalTokens map[int]PersonalToken `json:"personal_tokens"`
 }
 
 type Token struct {
@@ -29,25 +71,56 @@ type Token struct {
 }
 
 type User struct {
-	Email         string `json:"email"`
-	Password      string `json:"password,omitempty"`
-	Is_Chirpy_Red bool   `json:"is_chirpy_red"`
-	Id            int    `json:"id"`
+	Email         string      `json:"email"`
+	Password      string      `json:"password,omitempty"`
+	Is_Chirpy_Red bool        `json:"is_chirpy_red"`
+	Role          string      `json:"role"`
+	EmailVerified bool        `json:"email_verified"`
+	Suspension    *Suspension `json:"suspension,omitempty"`
+	Id            int         `json:"id"`
+}
+
+// NormalizeEmail is the form an address is stored and looked up in, so
+// that one address can't name two accounts
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
 
 type UserReturn struct {
-	Email         string `json:"email"`
-	Password      string `json:"-"`
-	Is_Chirpy_Red bool   `json:"is_chirpy_red"`
-	Token         string `json:"token,omitempty"`
-	Refresh_Token string `json:"refresh_token,omitempty"`
-	Id            int    `json:"id"`
+	Email         string      `json:"email"`
+	Password      string      `json:"-"`
+	Is_Chirpy_Red bool        `json:"is_chirpy_red"`
+	Role          string      `json:"role"`
+	EmailVerified bool        `json:"email_verified"`
+	Suspension    *Suspension `json:"suspension,omitempty"`
+	Token         string      `json:"token,omitempty"`
+	Refresh_Token string      `json:"refresh_token,omitempty"`
+	Session_Id    int         `json:"session_id,omitempty"`
+	Id            int         `json:"id"`
 }
 
+// Chirp is a post, or a reply to the chirp Parent_Id. Reply_Count counts
+// its replies that haven't been deleted. A deleted chirp that still has
+// replies is kept as a tombstone: Deleted is set and Body and Entities
+// emptied, so the thread below it stays intact. Chirps from before
+// Created_At was recorded have the zero time. Like_Count and
+// Rechirp_Count count the users who liked or rechirped it. Moderation
+// holds what the content filters found in Body when it was posted. A
+// chirp hidden by a moderator is left out of lists and shown in threads
+// without its body.
 type Chirp struct {
-	Author_Id int    `json:"author_id"`
-	Body      string `json:"body"`
-	Id        int    `json:"id"`
+	Author_Id     int                  `json:"author_id"`
+	Body          string               `json:"body"`
+	Id            int                  `json:"id"`
+	Parent_Id     int                  `json:"parent_id,omitempty"`
+	Reply_Count   int                  `json:"reply_count"`
+	Like_Count    int                  `json:"like_count"`
+	Rechirp_Count int                  `json:"rechirp_count"`
+	Deleted       bool                 `json:"deleted,omitempty"`
+	Hidden        bool                 `json:"hidden,omitempty"`
+	Entities      []entities.Entity    `json:"entities,omitempty"`
+	Moderation    []moderation.Finding `json:"moderation,omitempty"`
+	Created_At    time.Time            `json:"created_at"`
 }
 
 type DataStruct struct {
@@ -60,67 +133,222 @@ type UpgradeUserStruct struct {
 }
 
 // NewDB Create a new database connection
-// and creates the database file if it doesn't exist
-func NewDB(path string) (*DB, error) {
+// and creates the database file if it doesn't exist.
+// Mutations left in the write-ahead log by a crash are replayed, and an
+// older schema is migrated after backing the file up.
+// A positive flushInterval starts a background snapshot loop.
+func NewDB(path string, flushInterval time.Duration) (*DB, error) {
+	return openDB(path, flushInterval, MigrateOptions{Backup: true})
+}
+
+func openDB(path string, flushInterval time.Duration, opts MigrateOptions) (*DB, error) {
 	mux := &sync.RWMutex{}
 	database := DB{
-		path: path,
-		mux:  mux,
+		path:          path,
+		mux:           mux,
+		flushInterval: flushInterval,
+		hasher:        password.Default(),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
 	}
 
 	// creates the database file if it doesn't exist
-	err := database.ensureDB()
+	history, err := database.ensureDB(opts)
 	if err != nil {
 		return nil, err
 	}
 
+	if database.data.needsIdRepair() {
+		_, err = database.repairIds(history)
+		if err != nil {
+			database.wal.close()
+			return nil, err
+		}
+	}
+
+	if flushInterval > 0 {
+		go database.flushLoop()
+	} else {
+		close(database.done)
+	}
+
 	return &database, nil
 }
 
-// Login checks if user exists with password, and if so, returns the user
+// Close stops the snapshot loop, writes a final snapshot and closes the
+// write-ahead log. If the snapshot can't be written the log is left open
+// and the error returned: it still holds every change, so Close can be
+// retried and the next open replays it. Closing twice is not an error.
+func (db *DB) Close() error {
+	db.stopOnce.Do(func() { close(db.stop) })
+	<-db.done
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	err := db.flush()
+	if err != nil {
+		return err
+	}
+	db.closed = true
+
+	return db.wal.close()
+}
+
+// flushLoop snapshots the database every flushInterval until Close
+func (db *DB) flushLoop() {
+	defer close(db.done)
+
+	ticker := time.NewTicker(db.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			db.mux.Lock()
+			err := db.flush()
+			db.mux.Unlock()
+			if err != nil {
+				log.Printf("Error writing database snapshot: %s\n", err)
+			}
+		}
+	}
+}
+
+// flush writes the in-memory state to the JSON file if it changed since
+// the last snapshot. The caller must hold db.mux.
+func (db *DB) flush() error {
+	if !db.dirty {
+		return nil
+	}
+
+	err := db.writeDB(db.data)
+	if err != nil {
+		return err
+	}
+	db.dirty = false
+
+	if db.wal.size > walCompactSize {
+		err = db.wal.truncate(0)
+		if err != nil {
+			log.Printf("Error compacting write-ahead log: %s\n", err)
+		}
+	}
+
+	return nil
+}
+
+// view runs fn against the in-memory state under the read lock.
+// fn must not modify dbStructure or keep references to its maps.
+func (db *DB) view(fn func(dbStructure DBStructure) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return fn(db.data)
+}
+
+// Login checks if user exists with password, and if so, returns the user.
+// A password stored in plaintext or with weaker hash settings than the
+// current ones is rehashed.
 func (db *DB) Login(email, password string) (UserReturn, error) {
-	dbStructure, err := db.loadDB()
+	email = NormalizeEmail(email)
+	var user User
+	found := false
+	err := db.view(func(dbStructure DBStructure) error {
+		for _, value := range dbStructure.Users {
+			if value.Email == email {
+				user = value
+				found = true
+				return nil
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return UserReturn{}, err
 	}
+	if !found {
+		db.hasher.VerifyMissing(password)
+		return UserReturn{}, errors.New("user not found")
+	}
 
-	for _, value := range dbStructure.Users {
-		if value.Email == email && value.Password == password {
-			return UserReturn{
-				Id:            value.Id,
-				Email:         value.Email,
-				Is_Chirpy_Red: value.Is_Chirpy_Red,
-			}, nil
+	ok, needsRehash, err := db.hasher.Verify(password, user.Password)
+	if err != nil {
+		return UserReturn{}, err
+	}
+	if !ok {
+		return UserReturn{}, errors.New("user not found")
+	}
+	if user.Suspension.Active(time.Now()) {
+		return UserReturn{}, ErrUserSuspended
+	}
+	if needsRehash {
+		err = db.rehashPassword(user, password)
+		if err != nil {
+			log.Printf("Error rehashing password for user %d: %s\n", user.Id, err)
 		}
 	}
 
-	return UserReturn{}, errors.New("user not found")
+	return UserReturn{
+		Id:            user.Id,
+		Email:         user.Email,
+		Is_Chirpy_Red: user.Is_Chirpy_Red,
+		Role:          user.Role,
+		EmailVerified: user.EmailVerified,
+		Suspension:    user.Suspension,
+	}, nil
+}
+
+// rehashPassword replaces the stored hash of a user who just logged in,
+// unless the password was changed in the meantime
+func (db *DB) rehashPassword(user User, password string) error {
+	hash, err := db.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		current, ok := dbStructure.Users[user.Id]
+		if !ok || current.Password != user.Password {
+			return nil
+		}
+		current.Password = hash
+		tx.put("users", user.Id, current)
+		return nil
+	})
 }
 
 // CreateUser creates a new user and saves it to disk
 func (db *DB) CreateUser(email string, password string) (UserReturn, error) {
-	dbStructure, err := db.loadDB()
+	email = NormalizeEmail(email)
+	hash, err := db.hasher.Hash(password)
 	if err != nil {
 		return UserReturn{}, err
 	}
 
-	for _, value := range dbStructure.Users {
-		if value.Email == email {
-			err := errors.New("user already exists")
-			return UserReturn{}, err
+	var newUser User
+	err = db.update(func(dbStructure DBStructure, tx *tx) error {
+		for _, value := range dbStructure.Users {
+			if value.Email == email {
+				return errors.New("user already exists")
+			}
 		}
-	}
-
-	size := len(dbStructure.Users)
-	newUser := User{
-		Id:            size + 1,
-		Email:         email,
-		Password:      password,
-		Is_Chirpy_Red: false,
-	}
-	dbStructure.Users[newUser.Id] = newUser
 
-	err = db.writeDB(dbStructure)
+		newUser = User{
+			Id:            tx.nextId(dbStructure, "users"),
+			Email:         email,
+			Password:      hash,
+			Is_Chirpy_Red: false,
+			Role:          RoleUser,
+		}
+		tx.put("users", newUser.Id, newUser)
+		return nil
+	})
 	if err != nil {
 		return UserReturn{}, err
 	}
@@ -128,114 +356,142 @@ func (db *DB) CreateUser(email string, password string) (UserReturn, error) {
 	return UserReturn{
 		Id:    newUser.Id,
 		Email: newUser.Email,
+		Role:  newUser.Role,
 	}, nil
 }
 
+// UpdateUser sets the email and password of user u.Id.
+// u.Password is the new plaintext password.
 func (db *DB) UpdateUser(u User) (User, error) {
-	dbStructure, err := db.loadDB()
+	u.Email = NormalizeEmail(u.Email)
+	hash, err := db.hasher.Hash(u.Password)
 	if err != nil {
 		return User{}, err
 	}
 
-	for key, value := range dbStructure.Users {
-		if value.Id == u.Id {
-			// update user
-			updatedUser := User{
-				Id:            value.Id,
-				Email:         u.Email,
-				Password:      u.Password,
-				Is_Chirpy_Red: value.Is_Chirpy_Red,
+	var updatedUser User
+	err = db.update(func(dbStructure DBStructure, tx *tx) error {
+		for _, value := range dbStructure.Users {
+			if value.Email == u.Email && value.Id != u.Id {
+				return errors.New("user already exists")
 			}
-			dbStructure.Users[key] = updatedUser
-
-			err := db.writeDB(dbStructure)
-			if err != nil {
-				return User{}, err
+		}
+		for key, value := range dbStructure.Users {
+			if value.Id == u.Id {
+				// update user
+				updatedUser = value
+				if updatedUser.Email != u.Email {
+					updatedUser.EmailVerified = false
+				}
+				updatedUser.Email = u.Email
+				updatedUser.Password = hash
+				tx.put("users", key, updatedUser)
+				return nil
 			}
-
-			return User{
-				Id:    updatedUser.Id,
-				Email: updatedUser.Email,
-			}, nil
 		}
+
+		return errors.New("user not found")
+	})
+	if err != nil {
+		return User{}, err
 	}
 
-	return User{}, errors.New("user not found")
+	return User{
+		Id:            updatedUser.Id,
+		Email:         updatedUser.Email,
+		Role:          updatedUser.Role,
+		EmailVerified: updatedUser.EmailVerified,
+	}, nil
 }
 
+// RevokeToken blacklists token and, if it is a refresh token, revokes
+// its session
 func (db *DB) RevokeToken(token string) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	size := len(dbStructure.Tokens)
-	newRevokedToken := Token{
-		Id:         token,
-		RevokeTime: time.Now().String(),
-	}
-	dbStructure.Tokens[size+1] = newRevokedToken
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
-	}
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		revokeTokenSession(dbStructure, tx, token)
 
-	return nil
+		newRevokedToken := Token{
+			Id:         token,
+			RevokeTime: time.Now().String(),
+		}
+		tx.put("tokens", tx.nextId(dbStructure, "tokens"), newRevokedToken)
+		return nil
+	})
 }
 
 func (db *DB) IsTokenRevoked(token string) (bool, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return false, err
-	}
-
-	for _, value := range dbStructure.Tokens {
-		if value.Id == token {
-			return true, nil
+	revoked := false
+	err := db.view(func(dbStructure DBStructure) error {
+		for _, value := range dbStructure.Tokens {
+			if value.Id == token {
+				revoked = true
+				return nil
+			}
 		}
-	}
+		return nil
+	})
 
-	return false, nil
+	return revoked, err
 }
 
+// DeleteChirp deletes chirp chirpId written by userId. A chirp with
+// replies is left as a tombstone.
 func (db *DB) DeleteChirp(chirpId int, userId int) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	for key, value := range dbStructure.Chirps {
-		if value.Id == chirpId && value.Author_Id == userId {
-			delete(dbStructure.Chirps, key)
-			err = db.writeDB(dbStructure)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
-			return nil
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		chirp, ok := dbStructure.Chirps[chirpId]
+		if !ok || chirp.Deleted || chirp.Author_Id != userId {
+			return errors.New("chirp not found")
 		}
-	}
 
-	return errors.New("chirp not found")
+		removeChirp(dbStructure, tx, chirp)
+		return nil
+	})
 }
 
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
+// DeleteChirpAsModerator deletes chirp chirpId whoever wrote it. Deleting
+// someone else's chirp is audited as moderatorId's action.
+func (db *DB) DeleteChirpAsModerator(chirpId int, moderatorId int) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		chirp, ok := dbStructure.Chirps[chirpId]
+		if !ok || chirp.Deleted {
+			return errors.New("chirp not found")
+		}
 
-	size := len(dbStructure.Chirps)
-	newChirp := Chirp{
-		Author_Id: userId,
-		Id:        size + 1,
-		Body:      body,
-	}
-	dbStructure.Chirps[newChirp.Id] = newChirp
+		removeChirp(dbStructure, tx, chirp)
+		if chirp.Author_Id != moderatorId {
+			audit(dbStructure, tx, chirpDeleteEntry(chirp.Id, chirp.Author_Id, moderatorId))
+		}
+		return nil
+	})
+}
 
-	err = db.writeDB(dbStructure)
+// CreateChirp saves a new chirp. The caller sets Author_Id, Body and
+// optionally Parent_Id and Entities; the id and creation time are filled
+// in.
+func (db *DB) CreateChirp(chirp Chirp) (Chirp, error) {
+	var newChirp Chirp
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		if chirp.Parent_Id != 0 {
+			parent, ok := dbStructure.Chirps[chirp.Parent_Id]
+			if !ok || !parent.visible() {
+				return ErrParentChirpNotFound
+			}
+			parent.Reply_Count++
+			tx.put("chirps", parent.Id, parent)
+		}
+
+		newChirp = Chirp{
+			Author_Id:  chirp.Author_Id,
+			Id:         tx.nextId(dbStructure, "chirps"),
+			Body:       chirp.Body,
+			Parent_Id:  chirp.Parent_Id,
+			Entities:   chirp.Entities,
+			Moderation: chirp.Moderation,
+			Created_At: time.Now().UTC(),
+		}
+		tx.put("chirps", newChirp.Id, newChirp)
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -243,207 +499,341 @@ func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
 	return newChirp, nil
 }
 
-// GetUsers returns all users in the database
-func (db *DB) GetUsers() ([]User, error) {
-	dbStructure, err := db.loadDB()
+// GetUsers returns the users in the database, ordered by id
+func (db *DB) GetUsers(page Page) ([]User, error) {
+	var respSlice []User
+	err := db.view(func(dbStructure DBStructure) error {
+		for _, v := range dbStructure.Users {
+			v.Password = ""
+			respSlice = append(respSlice, v)
+		}
+		return nil
+	})
 	if err != nil {
 		return []User{}, err
 	}
-
-	var respSlice []User
-	for _, v := range dbStructure.Users {
-		respSlice = append(respSlice, v)
-	}
 	sort.Slice(respSlice, func(i, j int) bool { return respSlice[i].Id < respSlice[j].Id })
 
-	return respSlice, nil
+	return pageOf(respSlice, func(u User) int { return u.Id }, false, page), nil
 }
 
 type Options struct {
 	AuthorId int
-	Sorting  string
+	// AuthorIds, when not nil, keeps only chirps by these authors
+	AuthorIds []int
+	// Ids, when not nil, keeps only the chirps with these ids
+	Ids []int
+	// Tag keeps only chirps with this hashtag, lowercased without its #
+	Tag string
+	// MentionedUserId keeps only chirps mentioning this user
+	MentionedUserId int
+	Sorting         string
+	Page            Page
 }
 
-// GetChirps returns all chirps in the database
+// GetChirps returns the chirps in the database selected by options
 func (db *DB) GetChirps(options Options) ([]Chirp, error) {
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return []Chirp{}, err
+	var authors map[int]bool
+	if options.AuthorIds != nil {
+		authors = map[int]bool{}
+		for _, id := range options.AuthorIds {
+			authors[id] = true
+		}
+	}
+	var ids map[int]bool
+	if options.Ids != nil {
+		ids = map[int]bool{}
+		for _, id := range options.Ids {
+			ids[id] = true
+		}
 	}
 
 	var respSlice []Chirp
-	for _, v := range dbStructure.Chirps {
-		if options.AuthorId != 0 {
-			if v.Author_Id == options.AuthorId {
+	err := db.view(func(dbStructure DBStructure) error {
+		for _, v := range dbStructure.Chirps {
+			if !v.visible() || (authors != nil && !authors[v.Author_Id]) || (ids != nil && !ids[v.Id]) {
+				continue
+			}
+			if options.Tag != "" && !v.hasEntity(entities.Hashtag, options.Tag, 0) {
+				continue
+			}
+			if options.MentionedUserId != 0 && !v.hasEntity(entities.Mention, "", options.MentionedUserId) {
+				continue
+			}
+			if options.AuthorId != 0 {
+				if v.Author_Id == options.AuthorId {
+					respSlice = append(respSlice, v)
+				}
+			} else {
 				respSlice = append(respSlice, v)
 			}
-		} else {
-			respSlice = append(respSlice, v)
 		}
+		return nil
+	})
+	if err != nil {
+		return []Chirp{}, err
 	}
-	if options.Sorting == "desc" {
+	desc := options.Sorting == "desc"
+	if desc {
 		sort.Slice(respSlice, func(i, j int) bool { return respSlice[i].Id > respSlice[j].Id })
 	} else {
 		sort.Slice(respSlice, func(i, j int) bool { return respSlice[i].Id < respSlice[j].Id })
 	}
 
-	return respSlice, nil
+	return pageOf(respSlice, func(c Chirp) int { return c.Id }, desc, options.Page), nil
 }
 
 func (db *DB) GetUser(v string) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
 	id, err := strconv.Atoi(v)
 	if err != nil {
 		return User{}, err
 	}
 
-	for key, value := range dbStructure.Users {
-		if value.Id == id {
-			return dbStructure.Users[key], nil
+	var user User
+	err = db.view(func(dbStructure DBStructure) error {
+		for key, value := range dbStructure.Users {
+			if value.Id == id {
+				user = dbStructure.Users[key]
+				user.Password = ""
+				return nil
+			}
 		}
-	}
 
-	err = errors.New("user does not exist")
-	return User{}, err
+		return errors.New("user does not exist")
+	})
+
+	return user, err
 }
 
 func (db *DB) GetChirp(v string) (Chirp, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
-
 	id, err := strconv.Atoi(v)
 	if err != nil {
 		fmt.Println("Cannot convert to int")
 		return Chirp{}, err
 	}
 
-	for key, value := range dbStructure.Chirps {
-		if value.Id == id {
-			return dbStructure.Chirps[key], nil
+	var chirp Chirp
+	err = db.view(func(dbStructure DBStructure) error {
+		for key, value := range dbStructure.Chirps {
+			if value.Id == id && value.visible() {
+				chirp = dbStructure.Chirps[key]
+				return nil
+			}
 		}
-	}
 
-	err = errors.New("chirp does not exist")
-	return Chirp{}, err
+		return errors.New("chirp does not exist")
+	})
+
+	return chirp, err
 }
 
-// ensureDB creates a new database file if it doesn't exist
-func (db *DB) ensureDB() error {
+// ensureDB creates a new database file if it doesn't exist, then replays
+// any write-ahead log records newer than the file. A file that can't be
+// parsed (e.g. cut short by a crash during an old in-place write) is moved
+// aside to path.corrupt and rebuilt from the log. Pending schema
+// migrations are applied last. The log records are returned for repairIds.
+func (db *DB) ensureDB(opts MigrateOptions) ([]mutation, error) {
 	db.mux.Lock()
-	_, err := os.Stat(db.path)
-	if err != nil {
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if errors.Is(err, os.ErrNotExist) {
 		fmt.Println("create file...")
-		// create db
-		file, err := os.Create(db.path)
+		dbStructure = newDBStructure()
+		dbStructure.SchemaVersion = jsonSchemaVersion()
+	} else if err != nil {
+		var syntaxErr *json.SyntaxError
+		if !errors.As(err, &syntaxErr) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+		log.Printf("database file %s is damaged (%v), rebuilding from write-ahead log\n", db.path, err)
+		err = os.Rename(db.path, db.path+".corrupt")
 		if err != nil {
-			return err
+			return nil, err
 		}
+		dbStructure = newDBStructure()
+		dbStructure.SchemaVersion = jsonSchemaVersion()
+	}
 
-		_, err = file.Write([]byte("{}"))
+	w, records, err := openWAL(db.path + ".wal")
+	if err != nil {
+		return nil, err
+	}
+	db.wal = w
+	db.seq = dbStructure.WalSeq
+
+	replayed := 0
+	for _, m := range records {
+		if m.Seq <= dbStructure.WalSeq {
+			continue
+		}
+		err = dbStructure.apply(m)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("replaying wal record %d: %w", m.Seq, err)
 		}
+		dbStructure.WalSeq = m.Seq
+		replayed++
+	}
+	if replayed > 0 {
+		log.Printf("replayed %d records from write-ahead log\n", replayed)
+	}
+	db.seq = dbStructure.WalSeq
+	db.data = dbStructure
 
-		db.mux.Unlock()
-		return file.Close()
+	_, err = os.Stat(db.path)
+	if replayed > 0 || err != nil {
+		db.dirty = true
+		err = db.flush()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	db.mux.Unlock()
-	return nil
+	err = db.migrate(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
 }
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	db.mux.RLock()
+// update runs fn against the in-memory state and commits the mutations it
+// records. The mutations are synced to the write-ahead log before they are
+// applied, so once update returns the change survives a crash even if no
+// snapshot has been written yet. The write lock is held throughout, so
+// concurrent updates can't interleave. fn must not modify dbStructure;
+// changes go through tx.
+func (db *DB) update(fn func(dbStructure DBStructure, tx *tx) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	dbStructure := DBStructure{
-		Chirps: map[int]Chirp{},
-		Users:  map[int]User{},
-		Tokens: map[int]Token{},
+	t := &tx{}
+	err := fn(db.data, t)
+	if err != nil {
+		return err
+	}
+	if t.err != nil {
+		return t.err
+	}
+	if len(t.mutations) == 0 {
+		return nil
 	}
 
-	file, err := os.OpenFile(db.path, os.O_RDONLY, 0o755)
-	if err != nil {
-		return dbStructure, err
+	seq := db.seq
+	for i := range t.mutations {
+		seq++
+		t.mutations[i].Seq = seq
 	}
-	fileData, err := os.ReadFile(db.path)
+	t.mutations[len(t.mutations)-1].Last = true
+
+	walSize := db.wal.size
+	err = db.wal.append(t.mutations)
 	if err != nil {
-		return dbStructure, err
+		// the caller sees a failure, so the records must not be replayed later
+		if truncErr := db.wal.truncate(walSize); truncErr != nil {
+			log.Printf("Error rolling back write-ahead log: %s\n", truncErr)
+		}
+		return err
 	}
+	db.seq = seq
 
-	err = json.Unmarshal(fileData, &dbStructure)
-	if err != nil {
-		return dbStructure, err
+	for _, m := range t.mutations {
+		err = db.data.apply(m)
+		if err != nil {
+			return err
+		}
 	}
+	db.data.WalSeq = seq
+	db.dirty = true
 
-	err = file.Close()
-	if err != nil {
-		return dbStructure, err
+	if db.flushInterval <= 0 {
+		// the change is already durable in the log; a failed snapshot is
+		// retried on the next write or on Close
+		err = db.flush()
+		if err != nil {
+			log.Printf("Error writing database snapshot: %s\n", err)
+		}
 	}
 
-	defer db.mux.RUnlock()
-	return dbStructure, err
+	return nil
 }
 
-// writeDB writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	newFileData, err := json.Marshal(dbStructure)
-	if err != nil {
-		return err
+func newDBStructure() DBStructure {
+	return DBStructure{
+		Sequences: map[string]int{},
+		Chirps:    map[int]Chirp{},
+		Users:     map[int]User{},
+		Tokens:    map[int]Token{},
+
+		Sessions:      map[int]Session{},
+		RefreshTokens: map[int]RefreshToken{},
+
+		Follows: map[int]Follow{},
+
+		Likes:    map[int]Engagement{},
+		Rechirps: map[int]Engagement{},
+
+		Reports:  map[int]Report{},
+		AuditLog: map[int]AuditEntry{},
+
+		LoginThrottles: map[string]LoginThrottle{},
+		Notifications:  map[int]Notification{},
+
+		TOTP: map[int]TOTP{},
+
+		UsedTokens: map[string]UsedToken{},
+
+		PersonalTokens: map[int]PersonalToken{},
 	}
+}
+
+// loadDB reads the database file. The caller must hold db.mux.
+func (db *DB) loadDB() (DBStructure, error) {
+	dbStructure := newDBStructure()
 
-	file, err := os.OpenFile(db.path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0o755)
+	fileData, err := os.ReadFile(db.path)
 	if err != nil {
-		return err
+		return dbStructure, err
 	}
 
-	_, err = file.Write(newFileData)
+	err = json.Unmarshal(fileData, &dbStructure)
 	if err != nil {
-		return err
+		return dbStructure, err
 	}
 
-	err = file.Close()
+	return dbStructure, nil
+}
+
+// writeDB atomically replaces the database file. The caller must hold db.mux.
+func (db *DB) writeDB(dbStructure DBStructure) error {
+	newFileData, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
 
-	db.mux.Unlock()
-	return nil
+	return writeFileAtomic(db.path, newFileData)
 }
 
 func (db *DB) UpgradeUser(obj UpgradeUserStruct) (User, error) {
 	userId := obj.Data.User_id
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	for key, value := range dbStructure.Users {
-		if value.Id == userId {
-			dbStructure.Users[key] = User{
-				Email:         value.Email,
-				Password:      value.Password,
-				Is_Chirpy_Red: true,
-				Id:            value.Id,
+	var upgraded User
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		for key, value := range dbStructure.Users {
+			if value.Id == userId {
+				value.Is_Chirpy_Red = true
+				tx.put("users", key, value)
+				upgraded = value
+				upgraded.Password = ""
+				return nil
 			}
-
-			err = db.writeDB(dbStructure)
-			if err != nil {
-				return User{}, err
-			}
-
-			return value, nil
 		}
+
+		return errors.New("user not found")
+	})
+	if err != nil {
+		return User{}, err
 	}
 
-	return User{}, errors.New("user not found")
+	return upgraded, nil
 }
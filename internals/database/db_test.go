@@ -0,0 +1,1614 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jming514/chirpy/internals/entities"
+	"github.com/jming514/chirpy/internals/password"
+)
+
+func TestMain(m *testing.M) {
+	// full-strength hashing makes seeding databases very slow
+	password.DefaultParams.Memory = 64
+	os.Exit(m.Run())
+}
+
+// seedDB creates a database in a fresh directory with n users and n chirps
+func seedDB(t *testing.T, n int) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		_, err = db.CreateUser(fmt.Sprintf("user%d@example.com", i), "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateChirp(Chirp{Body: fmt.Sprintf("chirp %d", i), Author_Id: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func truncateFile(t *testing.T, path string, size int64) {
+	t.Helper()
+
+	err := os.Truncate(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// forEachStore runs fn against a fresh store of each driver holding users
+// user1@example.com, user2@example.com, ... with the password "password"
+func forEachStore(t *testing.T, users int, fn func(t *testing.T, db Store)) {
+	t.Helper()
+
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			db, err := NewStore(StoreConfig{Driver: driver, Path: filepath.Join(t.TempDir(), "database")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 1; i <= users; i++ {
+				_, err = db.CreateUser(fmt.Sprintf("user%d@example.com", i), "password")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			fn(t, db)
+		})
+	}
+}
+
+// rotate rotates oldToken of sessionId into newToken
+func rotate(db Store, oldToken string, userId, sessionId int, newToken string, expiresAt time.Time) error {
+	_, _, err := db.RotateRefreshToken(Rotation{
+		OldToken:  oldToken,
+		UserId:    userId,
+		SessionId: sessionId,
+		ExpiresAt: expiresAt,
+		Mint:      func(int) (string, error) { return newToken, nil },
+	})
+	return err
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// checkChirps asserts the database holds chirps 1..n with their original bodies
+func checkChirps(t *testing.T, db *DB, n int) {
+	t.Helper()
+
+	chirps, err := db.GetChirps(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != n {
+		t.Fatalf("got %d chirps, want %d", len(chirps), n)
+	}
+	for i, c := range chirps {
+		if c.Id != i+1 || c.Body != fmt.Sprintf("chirp %d", i+1) {
+			t.Fatalf("chirp %d is %+v", i+1, c)
+		}
+	}
+}
+
+func TestRecoverTruncatedDatabaseFile(t *testing.T) {
+	const n = 20
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 25; i++ {
+		path := seedDB(t, n)
+		offset := rng.Int63n(fileSize(t, path))
+		truncateFile(t, path, offset)
+
+		db, err := NewDB(path, 0)
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+
+		users, err := db.GetUsers(Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != n {
+			t.Fatalf("offset %d: got %d users, want %d", offset, len(users), n)
+		}
+		checkChirps(t, db, n)
+
+		_, err = os.Stat(path + ".corrupt")
+		if err != nil {
+			t.Fatalf("offset %d: damaged file was not kept: %v", offset, err)
+		}
+		db.Close()
+	}
+}
+
+func TestRecoverTornWAL(t *testing.T) {
+	const n = 20
+	rng := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 25; i++ {
+		path := seedDB(t, n)
+
+		// simulate a crash after the log append but before the file was
+		// rewritten by rolling the file back to an empty database
+		err := writeFileAtomic(path, []byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		walPath := path + ".wal"
+		offset := rng.Int63n(fileSize(t, walPath))
+		truncateFile(t, walPath, offset)
+
+		db, err := NewDB(path, 0)
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+
+		// every whole record survives, so chirps form an unbroken prefix
+		chirps, err := db.GetChirps(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkChirps(t, db, len(chirps))
+
+		// the log must still accept writes after the torn tail
+		_, err = db.CreateChirp(Chirp{Body: fmt.Sprintf("chirp %d", len(chirps)+1), Author_Id: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		db, err = NewDB(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkChirps(t, db, len(chirps)+1)
+		db.Close()
+	}
+}
+
+func TestSnapshotOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp(Chirp{Body: "chirp 1", Author_Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reads are served from memory before any snapshot is written
+	checkChirps(t, db, 1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "chirp 1") {
+		t.Fatal("snapshot written before the flush interval elapsed")
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "chirp 1") {
+		t.Fatal("Close did not write a snapshot")
+	}
+}
+
+func TestCloseKeepsLogWhenSnapshotFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp(Chirp{Body: "chirp 1", Author_Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// point the snapshot somewhere it can't be written
+	db.path = filepath.Join(t.TempDir(), "missing", "database.json")
+	if err = db.Close(); err == nil {
+		t.Fatal("Close reported success without writing a snapshot")
+	}
+	_, err = db.CreateChirp(Chirp{Body: "chirp 2", Author_Id: 1})
+	if err != nil {
+		t.Fatalf("the log was closed after the failed snapshot: %v", err)
+	}
+
+	db.path = path
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("closing twice got %v", err)
+	}
+
+	db, err = NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkChirps(t, db, 2)
+}
+
+func TestJournalReplayWithoutSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		_, err = db.CreateChirp(Chirp{Body: fmt.Sprintf("chirp %d", i), Author_Id: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// simulate a crash: drop the handle without Close
+	db.wal.close()
+
+	db, err = NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkChirps(t, db, 3)
+}
+
+func TestTornFirstUpdateIsNotReplayed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the chirp and its id's sequence are written in one update
+	_, err = db.CreateChirp(Chirp{Body: "lost", Author_Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.wal.close()
+
+	// crash after the first record of the log's first update
+	walPath := path + ".wal"
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := bytes.IndexByte(data, '\n') + 1
+	if first == 0 || first == len(data) {
+		t.Fatalf("the update wrote one record: %s", data)
+	}
+	truncateFile(t, walPath, int64(first))
+
+	db, err = NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkChirps(t, db, 0)
+	chirp, err := db.CreateChirp(Chirp{Body: "chirp 1", Author_Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != 1 {
+		t.Fatalf("chirp after the torn update got id %d, want 1", chirp.Id)
+	}
+}
+
+func TestIdsNotReusedAfterDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 1; i <= 3; i++ {
+		_, err = db.CreateChirp(Chirp{Body: fmt.Sprintf("chirp %d", i), Author_Id: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.DeleteChirp(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := db.CreateChirp(Chirp{Body: "chirp 4", Author_Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Id != 4 {
+		t.Fatalf("new chirp got id %d, want 4", c.Id)
+	}
+	chirps, err := db.GetChirps(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 3 || chirps[1].Body != "chirp 3" {
+		t.Fatalf("chirps after delete and create: %+v", chirps)
+	}
+}
+
+func TestRepairIdsRestoresOverwrittenChirp(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.json")
+
+	// a file written by len(map)+1 allocation: chirp 1 was deleted, so
+	// the fourth chirp was given id 3 and replaced "old three"
+	snapshot := `{"wal_seq":5,"chirps":{
+		"2":{"author_id":1,"body":"two","id":2},
+		"3":{"author_id":2,"body":"new three","id":3}},"users":{},"tokens":{}}`
+	history := []string{
+		`{"seq":1,"table":"chirps","op":"put","key":1,"value":{"author_id":1,"body":"one","id":1},"last":true}`,
+		`{"seq":2,"table":"chirps","op":"put","key":2,"value":{"author_id":1,"body":"two","id":2},"last":true}`,
+		`{"seq":3,"table":"chirps","op":"put","key":3,"value":{"author_id":1,"body":"old three","id":3},"last":true}`,
+		`{"seq":4,"table":"chirps","op":"delete","key":1,"last":true}`,
+		`{"seq":5,"table":"chirps","op":"put","key":3,"value":{"author_id":2,"body":"new three","id":3},"last":true}`,
+	}
+	err := os.WriteFile(path, []byte(snapshot), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+".wal", []byte(strings.Join(history, "\n")+"\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	restored, err := db.GetChirp("4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Body != "old three" || restored.Author_Id != 1 {
+		t.Fatalf("restored chirp is %+v", restored)
+	}
+
+	c, err := db.CreateChirp(Chirp{Body: "five", Author_Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Id != 5 {
+		t.Fatalf("new chirp got id %d, want 5", c.Id)
+	}
+}
+
+func TestMigrateLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"chirps":{"1":{"author_id":1,"body":"chirp 1","id":1}},"users":{},"tokens":{}}`
+	err := os.WriteFile(path, []byte(legacy), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := Migrate(StoreConfig{Path: path}, MigrateOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(jsonMigrations) {
+		t.Fatalf("dry run found %d pending migrations, want %d", len(pending), len(jsonMigrations))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != legacy {
+		t.Fatal("dry run changed the database file")
+	}
+
+	db, err := NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkChirps(t, db, 1)
+	if db.data.SchemaVersion != jsonSchemaVersion() {
+		t.Fatalf("schema version is %d, want %d", db.data.SchemaVersion, jsonSchemaVersion())
+	}
+
+	backup, err := os.ReadFile(path + ".v0.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != legacy {
+		t.Fatal("backup does not match the file before migrating")
+	}
+}
+
+func TestLoginRehashesPlaintextPassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"users":{"1":{"email":"walt@example.com","password":"123456","id":1}},"chirps":{},"tokens":{}}`
+	err := os.WriteFile(path, []byte(legacy), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Login("walt@example.com", "wrong")
+	if err == nil {
+		t.Fatal("login succeeded with the wrong password")
+	}
+	_, err = db.Login("walt@example.com", "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := db.data.Users[1].Password; !strings.HasPrefix(stored, "$argon2id$") {
+		t.Fatalf("password was not rehashed: %q", stored)
+	}
+	_, err = db.Login("walt@example.com", "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.CreateUser("user1@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := db.CreateSession(Session{UserId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	err = db.CreateRefreshToken(session.Id, "r1", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rotate(db, "r1", 1, session.Id, "r2", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rotate(db, "r1", 1, session.Id, "r3", expires)
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reusing r1: got %v, want ErrRefreshTokenReused", err)
+	}
+	err = rotate(db, "r2", 1, session.Id, "r4", expires)
+	if !errors.Is(err, ErrRefreshTokenRevoked) {
+		t.Fatalf("rotating r2 after reuse: got %v, want ErrRefreshTokenRevoked", err)
+	}
+}
+
+func TestLegacyUsersGetRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"schema_version":1,"users":{"1":{"email":"walt@example.com","password":"123456","id":1}},"chirps":{},"tokens":{}}`
+	err := os.WriteFile(path, []byte(legacy), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	user, err := db.Login("walt@example.com", "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != RoleUser {
+		t.Fatalf("migrated user has role %q, want %q", user.Role, RoleUser)
+	}
+
+	_, err = db.SetUserRole(1, "superuser", 0)
+	if err == nil {
+		t.Fatal("set an unknown role")
+	}
+	_, err = db.SetUserRole(1, RoleAdmin, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := db.UpdateUser(User{Id: 1, Email: "walt@example.com", Password: "new password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Role != RoleAdmin {
+		t.Fatalf("role after update is %q, want %q", updated.Role, RoleAdmin)
+	}
+}
+
+func TestMigrateNormalizesEmails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"schema_version":2,"users":{
+		"1":{"email":"Walt@Example.com","password":"123456","role":"user","id":1},
+		"2":{"email":"Jesse@Example.com","password":"123456","role":"user","id":2},
+		"3":{"email":"jesse@example.com","password":"123456","role":"user","id":3}
+	},"chirps":{},"tokens":{}}`
+	err := os.WriteFile(path, []byte(legacy), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	user, err := db.Login("walt@example.com", "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "walt@example.com" {
+		t.Fatalf("migrated user has email %q", user.Email)
+	}
+	// the address is already taken in its normal form
+	user, err = db.Login("jesse@example.com", "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Id != 3 {
+		t.Fatalf("jesse@example.com is user %d, want 3", user.Id)
+	}
+}
+
+func TestDeleteChirpLeavesTombstone(t *testing.T) {
+	forEachStore(t, 1, func(t *testing.T, db Store) {
+		for _, parent := range []int{0, 1, 2} {
+			_, err := db.CreateChirp(Chirp{Body: fmt.Sprintf("reply to %d", parent), Author_Id: 1, Parent_Id: parent})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := db.CreateChirp(Chirp{Body: "orphan", Author_Id: 1, Parent_Id: 42})
+		if !errors.Is(err, ErrParentChirpNotFound) {
+			t.Fatalf("reply to a missing chirp: got %v, want ErrParentChirpNotFound", err)
+		}
+
+		err = db.DeleteChirp(2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thread, err := db.GetThread(1, MaxThreadDepth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thread.Reply_Count != 0 || len(thread.Replies) != 1 {
+			t.Fatalf("root has reply count %d and %d replies, want 0 and 1", thread.Reply_Count, len(thread.Replies))
+		}
+		tombstone := thread.Replies[0]
+		if !tombstone.Deleted || tombstone.Body != "" || len(tombstone.Replies) != 1 {
+			t.Fatalf("deleted chirp with a reply is not a tombstone: %+v", tombstone)
+		}
+
+		// deleting the last reply takes the tombstone with it
+		err = db.DeleteChirp(3, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thread, err = db.GetThread(1, MaxThreadDepth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(thread.Replies) != 0 {
+			t.Fatalf("tombstone without replies was kept: %+v", thread.Replies)
+		}
+	})
+}
+
+func TestFollowGraph(t *testing.T) {
+	forEachStore(t, 3, func(t *testing.T, db Store) {
+		for i := 1; i <= 3; i++ {
+			_, err := db.CreateChirp(Chirp{Body: fmt.Sprintf("chirp %d", i), Author_Id: i})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, followee := range []int{2, 3, 3} {
+			err := db.Follow(1, followee)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if db.Follow(1, 1) == nil {
+			t.Fatal("user followed themselves")
+		}
+		err := db.Unfollow(1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		following, err := db.GetFollowing(1, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(following) != 1 || following[0].Id != 3 {
+			t.Fatalf("user 1 follows %+v, want only user 3", following)
+		}
+		followers, err := db.GetFollowers(3, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(followers) != 1 || followers[0].Id != 1 {
+			t.Fatalf("user 3 is followed by %+v, want only user 1", followers)
+		}
+
+		chirps, err := db.GetChirps(Options{AuthorIds: []int{3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chirps) != 1 || chirps[0].Author_Id != 3 {
+			t.Fatalf("timeline holds %+v, want only the chirp of user 3", chirps)
+		}
+	})
+}
+
+func TestPagesStableAcrossDeletes(t *testing.T) {
+	ids := func(chirps []Chirp) string {
+		s := make([]string, len(chirps))
+		for i, c := range chirps {
+			s[i] = fmt.Sprint(c.Id)
+		}
+		return strings.Join(s, ",")
+	}
+
+	forEachStore(t, 1, func(t *testing.T, db Store) {
+		for i := 1; i <= 7; i++ {
+			_, err := db.CreateChirp(Chirp{Body: fmt.Sprintf("chirp %d", i), Author_Id: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// each page holds one extra item when the list goes on
+		steps := []struct {
+			options Options
+			want    string
+		}{
+			{Options{Page: Page{Limit: 2}}, "1,2,3"},
+			{Options{Page: Page{Limit: 2, After: 2}}, "3,5,6"},
+			{Options{Page: Page{Limit: 2, After: 6}}, "7"},
+			{Options{Page: Page{Limit: 2, Before: 5}}, "1,2,3"},
+			{Options{Page: Page{Limit: 2, Before: 3}}, "1,2"},
+			{Options{Sorting: "desc", Page: Page{Limit: 2, After: 6}}, "5,3,2"},
+			{Options{Sorting: "desc", Page: Page{Limit: 2, Before: 2}}, "6,5,3"},
+			// the deleted chirp is left out before the page is cut
+			{Options{Ids: []int{3, 4, 5, 6}, Page: Page{Limit: 2}}, "3,5,6"},
+			{Options{Ids: []int{}}, ""},
+		}
+		err := db.DeleteChirp(4, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range steps {
+			chirps, err := db.GetChirps(step.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(chirps); got != step.want {
+				t.Errorf("%+v: got %s, want %s", step.options, got, step.want)
+			}
+		}
+	})
+}
+
+func TestTagsAndMentions(t *testing.T) {
+	forEachStore(t, 2, func(t *testing.T, db Store) {
+		for _, body := range []string{"#go #Go #chirpy", "#go hi @user2@example.com", "#chirpy"} {
+			ents := entities.Parse(body)
+			for i, e := range ents {
+				if e.Type == entities.Mention {
+					user, err := db.GetUserByEmail(e.Text)
+					if err != nil {
+						t.Fatal(err)
+					}
+					ents[i].UserId = user.Id
+				}
+			}
+			_, err := db.CreateChirp(Chirp{Body: body, Author_Id: 1, Entities: ents})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tagged, err := db.GetChirps(Options{Tag: "go"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tagged) != 2 || tagged[0].Id != 1 || tagged[1].Id != 2 {
+			t.Fatalf("#go is on %+v, want chirps 1 and 2", tagged)
+		}
+		mentions, err := db.GetChirps(Options{MentionedUserId: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mentions) != 1 || mentions[0].Id != 2 || len(mentions[0].Entities) != 2 {
+			t.Fatalf("user 2 is mentioned in %+v, want only chirp 2", mentions)
+		}
+
+		trending, err := db.TrendingTags(time.Now().Add(-time.Hour), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []TagCount{{"chirpy", 2}, {"go", 2}}
+		if fmt.Sprint(trending) != fmt.Sprint(want) {
+			t.Fatalf("trending tags are %v, want %v", trending, want)
+		}
+		trending, err = db.TrendingTags(time.Now().Add(time.Hour), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trending) != 0 {
+			t.Fatalf("trending tags from the future are %v", trending)
+		}
+
+		err = db.DeleteChirp(1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tagged, err = db.GetChirps(Options{Tag: "chirpy"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tagged) != 1 || tagged[0].Id != 3 {
+			t.Fatalf("#chirpy is on %+v after deleting chirp 1, want only chirp 3", tagged)
+		}
+	})
+}
+
+func TestConcurrentLikesKeepCounts(t *testing.T) {
+	const users = 8
+	forEachStore(t, users, func(t *testing.T, db Store) {
+		_, err := db.CreateChirp(Chirp{Body: "popular", Author_Id: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every user likes and rechirps several times at once, and the
+		// even ones take their like back
+		var wg sync.WaitGroup
+		errs := make(chan error, users*8)
+		for i := 1; i <= users; i++ {
+			for j := 0; j < 3; j++ {
+				wg.Add(1)
+				go func(userId int) {
+					defer wg.Done()
+					_, err := db.LikeChirp(userId, 1)
+					errs <- err
+					_, err = db.Rechirp(userId, 1)
+					errs <- err
+				}(i)
+			}
+		}
+		wg.Wait()
+		for i := 2; i <= users; i += 2 {
+			wg.Add(1)
+			go func(userId int) {
+				defer wg.Done()
+				_, err := db.UnlikeChirp(userId, 1)
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		chirp, err := db.GetChirp("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		likers, err := db.GetLikers(1, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chirp.Like_Count != users/2 || len(likers) != users/2 || likers[0].Id != 1 {
+			t.Fatalf("chirp has %d likes from %+v, want %d from the odd users", chirp.Like_Count, likers, users/2)
+		}
+		if chirp.Rechirp_Count != users {
+			t.Fatalf("chirp has %d rechirps, want %d", chirp.Rechirp_Count, users)
+		}
+
+		_, err = db.LikeChirp(1, 2)
+		if !errors.Is(err, ErrChirpNotFound) {
+			t.Fatalf("liking a missing chirp returned %v", err)
+		}
+	})
+}
+
+func TestReportQueue(t *testing.T) {
+	forEachStore(t, 4, func(t *testing.T, db Store) {
+		// user 1 posts, user 2 reports, users 3 and 4 moderate
+		for i := 3; i <= 4; i++ {
+			_, err := db.SetUserRole(i, RoleModerator, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 1; i <= 2; i++ {
+			_, err := db.CreateChirp(Chirp{Body: fmt.Sprintf("chirp %d", i), Author_Id: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		first, err := db.CreateReport(1, 2, "rude")
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := db.CreateReport(1, 2, "very rude")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.Id != first.Id || again.Reason != "rude" || first.AuthorId != 1 {
+			t.Fatalf("reporting twice gave %+v then %+v", first, again)
+		}
+		second, err := db.CreateReport(2, 2, "spam")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.CreateReport(9, 2, "gone"); !errors.Is(err, ErrChirpNotFound) {
+			t.Fatalf("reporting a missing chirp returned %v", err)
+		}
+
+		_, err = db.ClaimReport(first.Id, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.ResolveReport(first.Id, 4, Resolution{Action: ResolutionDismiss}); !errors.Is(err, ErrReportClaimed) {
+			t.Fatalf("resolving another moderator's report returned %v", err)
+		}
+		open, err := db.GetReports(ReportOpen, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(open) != 1 || open[0].Id != second.Id {
+			t.Fatalf("open reports are %+v, want only report %d", open, second.Id)
+		}
+
+		resolved, err := db.ResolveReport(first.Id, 3, Resolution{Action: ResolutionHideChirp, Note: "hidden"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved.Status != ReportResolved || resolved.Resolution != ResolutionHideChirp {
+			t.Fatalf("resolved report is %+v", resolved)
+		}
+		if _, err = db.GetChirp("1"); err == nil {
+			t.Fatal("hidden chirp is still returned")
+		}
+		if _, err = db.ClaimReport(first.Id, 3); !errors.Is(err, ErrReportResolved) {
+			t.Fatalf("claiming a resolved report returned %v", err)
+		}
+
+		until := time.Now().Add(time.Hour).UTC()
+		_, err = db.ResolveReport(second.Id, 4, Resolution{Action: ResolutionSuspendAuthor, SuspendUntil: &until})
+		if err != nil {
+			t.Fatal(err)
+		}
+		author, err := db.GetUser("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !author.Suspension.Active(time.Now()) || author.Suspension.By != 4 || author.Suspension.Active(until) {
+			t.Fatalf("author suspension is %+v, want one by user 4 for an hour", author.Suspension)
+		}
+
+		entries, err := db.GetAuditLog(Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actions []string
+		for _, e := range entries {
+			actions = append(actions, e.Action)
+		}
+		want := "report.resolve,chirp.hide,user.suspend,report.resolve,chirp.hide,report.claim"
+		if got := strings.Join(actions, ","); got != want {
+			t.Fatalf("audit log is %s, want %s", got, want)
+		}
+
+		// a moderator can't suspend another moderator through a report
+		chirp, err := db.CreateChirp(Chirp{Body: "chirp 3", Author_Id: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := db.CreateReport(chirp.Id, 2, "rude")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.ResolveReport(peer.Id, 4, Resolution{Action: ResolutionSuspendAuthor})
+		if !errors.Is(err, ErrOutranked) {
+			t.Fatalf("suspending a peer through a report got %v", err)
+		}
+		if open, _ = db.GetReports(ReportOpen, Page{}); len(open) != 1 || open[0].Id != peer.Id {
+			t.Fatalf("after the refused resolution, open reports are %+v", open)
+		}
+
+		// deleting someone else's chirp is audited, deleting your own isn't
+		err = db.DeleteChirpAsModerator(chirp.Id, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := db.CreateChirp(Chirp{Body: "chirp 4", Author_Id: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.DeleteChirpAsModerator(other.Id, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.GetChirp(strconv.Itoa(other.Id)); err == nil {
+			t.Fatal("chirp deleted by a moderator is still returned")
+		}
+		entries, err = db.GetAuditLog(Page{Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entries[0].Action != "chirp.delete" || entries[0].ActorId != 3 || entries[0].TargetId != other.Id {
+			t.Fatalf("latest audit entry is %+v", entries[0])
+		}
+		if entries, _ = db.GetAuditLog(Page{}); len(entries) != 7 {
+			t.Fatalf("audit log has %d entries, want 7", len(entries))
+		}
+	})
+}
+
+func TestSuspendedUsersCantLogIn(t *testing.T) {
+	forEachStore(t, 4, func(t *testing.T, db Store) {
+		// user 2 moderates, user 3 is another moderator and user 4 an admin
+		for id, role := range map[int]string{2: RoleModerator, 3: RoleModerator, 4: RoleAdmin} {
+			_, err := db.SetUserRole(id, role, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		user, err := db.SuspendUser(1, 2, "spam", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !user.Suspension.Banned() || user.Suspension.Reason != "spam" || user.Password != "" {
+			t.Fatalf("banned user is %+v", user)
+		}
+		if _, err = db.Login("user1@example.com", "password"); !errors.Is(err, ErrUserSuspended) {
+			t.Fatalf("banned user logging in got %v", err)
+		}
+		if _, err = db.Login("user1@example.com", "wrong"); errors.Is(err, ErrUserSuspended) {
+			t.Fatal("a wrong password revealed the suspension")
+		}
+
+		past := time.Now().Add(-time.Minute).UTC()
+		_, err = db.SuspendUser(1, 2, "served", &past)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Login("user1@example.com", "password"); err != nil {
+			t.Fatalf("user whose suspension ended can't log in: %v", err)
+		}
+
+		_, err = db.SuspendUser(1, 2, "again", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err = db.ReinstateUser(1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Suspension != nil {
+			t.Fatalf("reinstated user is %+v", user)
+		}
+		if _, err = db.Login("user1@example.com", "password"); err != nil {
+			t.Fatalf("reinstated user can't log in: %v", err)
+		}
+
+		entries, err := db.GetAuditLog(Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 4 || entries[0].Action != "user.reinstate" || entries[0].ActorId != 2 {
+			t.Fatalf("audit log is %+v", entries)
+		}
+
+		for _, c := range []struct{ target, moderator int }{{3, 2}, {4, 2}, {2, 2}, {4, 4}, {2, 1}} {
+			_, err = db.SuspendUser(c.target, c.moderator, "no", nil)
+			if !errors.Is(err, ErrOutranked) {
+				t.Fatalf("user %d suspending user %d got %v", c.moderator, c.target, err)
+			}
+		}
+		if _, err = db.SuspendUser(2, 4, "admin over moderator", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// role changes by an admin are audited
+		if _, err = db.SetUserRole(1, RoleModerator, 4); err != nil {
+			t.Fatal(err)
+		}
+		entries, err = db.GetAuditLog(Page{Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := entries[0]; e.Action != "user.role" || e.ActorId != 4 || e.TargetId != 1 || e.Detail != "user to moderator" {
+			t.Fatalf("latest audit entry is %+v", e)
+		}
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	policy := LockoutPolicy{
+		FreeAttempts: 2,
+		Backoff:      time.Second,
+		MaxBackoff:   4 * time.Second,
+		LockAfter:    5,
+		LockFor:      time.Minute,
+		MaxLockFor:   time.Hour,
+		Window:       time.Hour,
+	}
+	forEachStore(t, 1, func(t *testing.T, db Store) {
+		key := AccountThrottleKey(" User1@Example.com")
+
+		var throttle LoginThrottle
+		var locked bool
+		var err error
+		for i := 1; i <= 4; i++ {
+			throttle, locked, err = db.RecordLoginFailure(key, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if locked || throttle.Failures != i {
+				t.Fatalf("after %d failures throttle is %+v, locked %v", i, throttle, locked)
+			}
+		}
+		now := throttle.LastFailure
+		if wait := throttle.RetryAfter(policy, now); wait != 2*time.Second {
+			t.Fatalf("after 4 failures wait is %s, want 2s", wait)
+		}
+
+		throttle, locked, err = db.RecordLoginFailure(key, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !locked || throttle.Lockouts != 1 || throttle.Failures != 0 {
+			t.Fatalf("fifth failure left %+v, locked %v", throttle, locked)
+		}
+		stored, err := db.GetLoginThrottle(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait := stored.RetryAfter(policy, throttle.LastFailure); wait != time.Minute {
+			t.Fatalf("locked key waits %s, want 1m", wait)
+		}
+
+		err = db.UnlockUser(1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err = db.GetLoginThrottle(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Failures != 0 || stored.Locked(time.Now()) {
+			t.Fatalf("unlocked key is %+v", stored)
+		}
+		entries, err := db.GetAuditLog(Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Action != "user.unlock" {
+			t.Fatalf("audit log is %+v", entries)
+		}
+
+		_, err = db.AddNotification(1, NotifyLoginLockout, "locked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		notifications, err := db.GetNotifications(1, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notifications) != 1 || notifications[0].Kind != NotifyLoginLockout {
+			t.Fatalf("notifications are %+v", notifications)
+		}
+
+		// a throttle is removed once its failures are forgotten
+		short := policy
+		short.Window = time.Millisecond
+		_, _, err = db.RecordLoginFailure(IPThrottleKey("10.0.0.1"), short)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, _, err = db.RecordLoginFailure(IPThrottleKey("10.0.0.2"), short)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err = db.GetLoginThrottle(IPThrottleKey("10.0.0.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Failures != 0 {
+			t.Fatalf("expired throttle is still stored as %+v", stored)
+		}
+	})
+}
+
+func TestEmailsAreNormalized(t *testing.T) {
+	forEachStore(t, 0, func(t *testing.T, db Store) {
+		user, err := db.CreateUser(" User1@Example.COM", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Email != "user1@example.com" {
+			t.Fatalf("created user has email %q", user.Email)
+		}
+		_, err = db.CreateUser("user1@example.com", "password")
+		if err == nil {
+			t.Fatal("created a second user with an address differing only in case")
+		}
+
+		_, err = db.Login("USER1@example.com", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := db.GetUserByEmail("User1@Example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.Id != user.Id {
+			t.Fatalf("looking up the address found user %d, want %d", found.Id, user.Id)
+		}
+
+		updated, err := db.UpdateUser(User{Id: user.Id, Email: "New@Example.com", Password: "password"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Email != "new@example.com" {
+			t.Fatalf("updated user has email %q", updated.Email)
+		}
+		_, err = db.Login("new@EXAMPLE.com", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestUpdateUserKeepsEmailsUnique(t *testing.T) {
+	forEachStore(t, 2, func(t *testing.T, db Store) {
+		_, err := db.UpdateUser(User{Id: 2, Email: "user1@example.com", Password: "password"})
+		if err == nil {
+			t.Fatal("took another user's address")
+		}
+		user, err := db.GetUser("2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Email != "user2@example.com" {
+			t.Fatalf("after a refused update, email is %q", user.Email)
+		}
+
+		// keeping one's own address is fine
+		_, err = db.UpdateUser(User{Id: 2, Email: "user2@example.com", Password: "new password"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTOTPCodesAreSingleUse(t *testing.T) {
+	forEachStore(t, 1, func(t *testing.T, db Store) {
+		if _, err := db.GetTOTP(1); !errors.Is(err, ErrTOTPNotEnrolled) {
+			t.Fatalf("user without an authenticator got %v", err)
+		}
+		_, err := db.EnrollTOTP(1, "OLDSECRET")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.EnrollTOTP(1, "JBSWY3DPEHPK3PXP")
+		if err != nil {
+			t.Fatalf("re-enrolling before confirming: %v", err)
+		}
+		if err = db.UseTOTPCode(1, 100); !errors.Is(err, ErrTOTPNotEnrolled) {
+			t.Fatalf("code for an unconfirmed authenticator got %v", err)
+		}
+
+		err = db.ConfirmTOTP(1, 100, []string{"aaaaa-aaaaa", "bbbbb-bbbbb"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.EnrollTOTP(1, "NEWSECRET"); !errors.Is(err, ErrTOTPEnabled) {
+			t.Fatalf("enrolling over an enabled authenticator got %v", err)
+		}
+		enrollment, err := db.GetTOTP(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !enrollment.Enabled() || enrollment.Secret != "JBSWY3DPEHPK3PXP" || len(enrollment.RecoveryCodes) != 2 {
+			t.Fatalf("enrollment is %+v", enrollment)
+		}
+		if enrollment.RecoveryCodes[0] == "aaaaa-aaaaa" || enrollment.RecoveryCodes[1] == "aaaaa-aaaaa" {
+			t.Fatal("recovery codes are stored in the clear")
+		}
+
+		if err = db.UseTOTPCode(1, 100); !errors.Is(err, ErrTOTPCodeUsed) {
+			t.Fatalf("reusing the confirmation code got %v", err)
+		}
+		if err = db.UseTOTPCode(1, 101); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.UseTOTPCode(1, 100); !errors.Is(err, ErrTOTPCodeUsed) {
+			t.Fatalf("an older code got %v", err)
+		}
+
+		if err = db.UseRecoveryCode(1, "aaaaa-aaaaa"); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.UseRecoveryCode(1, "aaaaa-aaaaa"); !errors.Is(err, ErrRecoveryCodeInvalid) {
+			t.Fatalf("reusing a recovery code got %v", err)
+		}
+
+		err = db.DisableTOTP(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.GetTOTP(1); !errors.Is(err, ErrTOTPNotEnrolled) {
+			t.Fatalf("disabled authenticator got %v", err)
+		}
+	})
+}
+
+func TestEmailVerificationAndReset(t *testing.T) {
+	forEachStore(t, 0, func(t *testing.T, db Store) {
+		user, err := db.CreateUser("user1@example.com", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.EmailVerified {
+			t.Fatal("new user is verified")
+		}
+
+		expiresAt := time.Now().Add(time.Hour)
+		if err = db.ConsumeToken("token", expiresAt); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.ConsumeToken("token", expiresAt); !errors.Is(err, ErrTokenUsed) {
+			t.Fatalf("spending a token twice got %v", err)
+		}
+
+		if _, err = db.VerifyEmail(1, "old@example.com"); !errors.Is(err, ErrEmailChanged) {
+			t.Fatalf("verifying another address got %v", err)
+		}
+		verified, err := db.VerifyEmail(1, "user1@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !verified.EmailVerified || verified.Password != "" {
+			t.Fatalf("verified user is %+v", verified)
+		}
+
+		updated, err := db.UpdateUser(User{Id: 1, Email: "new@example.com", Password: "password"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.EmailVerified {
+			t.Fatal("a changed address is still verified")
+		}
+
+		session, err := db.CreateSession(Session{UserId: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.CreateRefreshToken(session.Id, "refresh", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stamp, err := db.PasswordStamp(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.ResetPassword(1, "user1@example.com", stamp, "reset"); !errors.Is(err, ErrEmailChanged) {
+			t.Fatalf("resetting through the old address got %v", err)
+		}
+		// a token from before the last password change is refused
+		if err = db.ResetPassword(1, "new@example.com", "stale", "reset"); !errors.Is(err, ErrPasswordChanged) {
+			t.Fatalf("resetting with a stale stamp got %v", err)
+		}
+		if err = db.ResetPassword(1, "new@example.com", stamp, "reset"); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.ResetPassword(1, "new@example.com", stamp, "again"); !errors.Is(err, ErrPasswordChanged) {
+			t.Fatalf("resetting twice with one stamp got %v", err)
+		}
+		login, err := db.Login("new@example.com", "reset")
+		if err != nil {
+			t.Fatalf("can't log in with the reset password: %v", err)
+		}
+		if !login.EmailVerified {
+			t.Fatal("resetting the password didn't verify the address")
+		}
+		err = rotate(db, "refresh", 1, session.Id, "refresh2", time.Now().Add(time.Hour))
+		if !errors.Is(err, ErrRefreshTokenRevoked) {
+			t.Fatalf("refresh token from before the reset got %v", err)
+		}
+	})
+}
+
+func TestRotateTokensFromBeforeSessions(t *testing.T) {
+	forEachStore(t, 1, func(t *testing.T, db Store) {
+		// a token rotated before sessions was recorded in a family,
+		// which is now its session
+		family, err := db.CreateSession(Session{UserId: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expires := time.Now().Add(time.Hour)
+		err = db.CreateRefreshToken(family.Id, "known", expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		minted := 0
+		rotation := Rotation{
+			OldToken:   "known",
+			UserId:     1,
+			NewSession: Session{Device: "old client"},
+			ExpiresAt:  expires,
+			Mint: func(sessionId int) (string, error) {
+				minted = sessionId
+				return "known2", nil
+			},
+		}
+		sessionId, token, err := db.RotateRefreshToken(rotation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessionId != family.Id || minted != family.Id || token != "known2" {
+			t.Fatalf("known token rotated into session %d, minted for %d, want %d", sessionId, minted, family.Id)
+		}
+		if err = rotate(db, "known2", 1, family.Id, "known3", expires); err != nil {
+			t.Fatalf("rotating the new token got %v", err)
+		}
+
+		rotation.OldToken = "unknown"
+		rotation.Mint = func(int) (string, error) { return "", errors.New("can't sign") }
+		if _, _, err = db.RotateRefreshToken(rotation); err == nil {
+			t.Fatal("a failed mint didn't fail the rotation")
+		}
+		if active, _ := db.GetSessions(1); len(active) != 1 {
+			t.Fatalf("a failed rotation left sessions %+v", active)
+		}
+
+		rotation.Mint = func(sessionId int) (string, error) {
+			minted = sessionId
+			return "unknown2", nil
+		}
+		sessionId, _, err = db.RotateRefreshToken(rotation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessionId == family.Id || minted != sessionId {
+			t.Fatalf("unknown token rotated into session %d, minted for %d", sessionId, minted)
+		}
+		session, err := db.GetSession(sessionId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.UserId != 1 || session.Device != "old client" || !session.Active(time.Now()) {
+			t.Fatalf("new session is %+v", session)
+		}
+		if err = rotate(db, "unknown", 1, 0, "unknown3", expires); !errors.Is(err, ErrRefreshTokenReused) {
+			t.Fatalf("reusing the unknown token got %v", err)
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	forEachStore(t, 2, func(t *testing.T, db Store) {
+		expires := time.Now().Add(time.Hour)
+		var sessions []Session
+		for i, device := range []string{"laptop", "phone", "tablet"} {
+			session, err := db.CreateSession(Session{UserId: 1, Device: device, IP: "10.0.0.1", UserAgent: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.CreateRefreshToken(session.Id, fmt.Sprintf("r%d", i), expires)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessions = append(sessions, session)
+		}
+		other, err := db.CreateSession(Session{UserId: 2, Device: "other"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = rotate(db, "r0", 1, sessions[1].Id, "r0b", expires)
+		if !errors.Is(err, ErrRefreshTokenRevoked) {
+			t.Fatalf("rotating into another session got %v", err)
+		}
+		err = rotate(db, "r0", 1, sessions[0].Id, "r0b", expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		active, err := db.GetSessions(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(active) != 3 || active[0].Id != sessions[0].Id || active[0].Device != "laptop" || active[0].IP != "10.0.0.1" {
+			t.Fatalf("sessions are %+v", active)
+		}
+
+		if err = db.RevokeSession(1, other.Id); !errors.Is(err, ErrSessionNotFound) {
+			t.Fatalf("revoking another user's session got %v", err)
+		}
+		err = db.RevokeSession(1, sessions[1].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rotate(db, "r1", 1, sessions[1].Id, "r1b", expires)
+		if !errors.Is(err, ErrRefreshTokenRevoked) {
+			t.Fatalf("refreshing a revoked session got %v", err)
+		}
+		if active, _ = db.GetSessions(1); len(active) != 2 {
+			t.Fatalf("after revoking one, sessions are %+v", active)
+		}
+
+		n, err := db.RevokeSessions(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("logging out everywhere ended %d sessions, want 2", n)
+		}
+		if active, _ = db.GetSessions(1); len(active) != 0 {
+			t.Fatalf("after logging out everywhere, sessions are %+v", active)
+		}
+		session, err := db.GetSession(other.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !session.Active(time.Now()) {
+			t.Fatal("logging out everywhere revoked another user's session")
+		}
+	})
+}
+
+func TestPersonalTokens(t *testing.T) {
+	forEachStore(t, 2, func(t *testing.T, db Store) {
+		deploy, err := db.CreatePersonalToken(PersonalToken{UserId: 1, Name: "deploy", Scopes: []string{"chirps:write"}}, "secret-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deploy.TokenHash == "secret-1" || deploy.TokenHash == "" {
+			t.Fatalf("token hash is %q", deploy.TokenHash)
+		}
+		_, err = db.CreatePersonalToken(PersonalToken{UserId: 1, Name: "expired", ExpiresAt: time.Now().Add(-time.Minute)}, "secret-2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bot, err := db.CreatePersonalToken(PersonalToken{UserId: 1, Name: "bot", ExpiresAt: time.Now().Add(time.Hour)}, "secret-3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := db.CreatePersonalToken(PersonalToken{UserId: 2, Name: "other"}, "secret-4")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := db.GetPersonalToken("secret-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Id != deploy.Id || token.Name != "deploy" || len(token.Scopes) != 1 || token.Scopes[0] != "chirps:write" {
+			t.Fatalf("looked up %+v", token)
+		}
+		if !token.ExpiresAt.IsZero() || !token.Active(time.Now()) {
+			t.Fatalf("token without expiry is %+v", token)
+		}
+		if _, err = db.GetPersonalToken("nope"); !errors.Is(err, ErrPersonalTokenNotFound) {
+			t.Fatalf("unknown secret got %v", err)
+		}
+
+		tokens, err := db.GetPersonalTokens(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != 2 || tokens[0].Id != bot.Id || tokens[1].Id != deploy.Id {
+			t.Fatalf("active tokens are %+v", tokens)
+		}
+
+		if err = db.TouchPersonalToken(deploy.Id); err != nil {
+			t.Fatal(err)
+		}
+		if token, _ = db.GetPersonalToken("secret-1"); token.LastUsedAt.IsZero() {
+			t.Fatal("touching the token didn't record its use")
+		}
+
+		if err = db.RevokePersonalToken(1, other.Id); !errors.Is(err, ErrPersonalTokenNotFound) {
+			t.Fatalf("revoking another user's token got %v", err)
+		}
+		if err = db.RevokePersonalToken(1, deploy.Id); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.RevokePersonalToken(1, deploy.Id); err != nil {
+			t.Fatalf("revoking twice got %v", err)
+		}
+		if token, _ = db.GetPersonalToken("secret-1"); token.Active(time.Now()) {
+			t.Fatal("revoked token is still active")
+		}
+		if tokens, _ = db.GetPersonalTokens(1); len(tokens) != 1 || tokens[0].Id != bot.Id {
+			t.Fatalf("after revoking, tokens are %+v", tokens)
+		}
+
+		if _, err = db.RevokeSessions(1); err != nil {
+			t.Fatal(err)
+		}
+		if tokens, _ = db.GetPersonalTokens(1); len(tokens) != 1 {
+			t.Fatalf("logging out everywhere revoked tokens, left %+v", tokens)
+		}
+		stamp, err := db.PasswordStamp(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.ResetPassword(1, "user1@example.com", stamp, "reset"); err != nil {
+			t.Fatal(err)
+		}
+		if tokens, _ = db.GetPersonalTokens(1); len(tokens) != 0 {
+			t.Fatalf("after a password reset, tokens are %+v", tokens)
+		}
+		if token, _ = db.GetPersonalToken("secret-4"); !token.Active(time.Now()) {
+			t.Fatal("resetting a password revoked another user's token")
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Follow records that FollowerId follows FolloweeId
+type Follow struct {
+	Id         int       `json:"id"`
+	FollowerId int       `json:"follower_id"`
+	FolloweeId int       `json:"followee_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Follow makes followerId follow followeeId. Following someone twice is
+// not an error.
+func (db *DB) Follow(followerId int, followeeId int) error {
+	if followerId == followeeId {
+		return errors.New("users can't follow themselves")
+	}
+
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		if _, ok := dbStructure.Users[followeeId]; !ok {
+			return errors.New("user not found")
+		}
+		for _, f := range dbStructure.Follows {
+			if f.FollowerId == followerId && f.FolloweeId == followeeId {
+				return nil
+			}
+		}
+
+		follow := Follow{
+			Id:         tx.nextId(dbStructure, "follows"),
+			FollowerId: followerId,
+			FolloweeId: followeeId,
+			CreatedAt:  time.Now().UTC(),
+		}
+		tx.put("follows", follow.Id, follow)
+		return nil
+	})
+}
+
+// Unfollow makes followerId stop following followeeId. Unfollowing someone
+// who isn't followed is not an error.
+func (db *DB) Unfollow(followerId int, followeeId int) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		for key, f := range dbStructure.Follows {
+			if f.FollowerId == followerId && f.FolloweeId == followeeId {
+				tx.delete("follows", key)
+			}
+		}
+		return nil
+	})
+}
+
+// GetFollowers returns the users following userId, ordered by id
+func (db *DB) GetFollowers(userId int, page Page) ([]User, error) {
+	return db.followUsers(page, func(f Follow) (int, bool) {
+		return f.FollowerId, f.FolloweeId == userId
+	})
+}
+
+// GetFollowing returns the users userId follows, ordered by id
+func (db *DB) GetFollowing(userId int, page Page) ([]User, error) {
+	return db.followUsers(page, func(f Follow) (int, bool) {
+		return f.FolloweeId, f.FollowerId == userId
+	})
+}
+
+// followUsers returns the users pick selects from the follows
+func (db *DB) followUsers(page Page, pick func(f Follow) (int, bool)) ([]User, error) {
+	respSlice := []User{}
+	err := db.view(func(dbStructure DBStructure) error {
+		for _, f := range dbStructure.Follows {
+			id, ok := pick(f)
+			if !ok {
+				continue
+			}
+			user, ok := dbStructure.Users[id]
+			if !ok {
+				continue
+			}
+			user.Password = ""
+			respSlice = append(respSlice, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return []User{}, err
+	}
+	sort.Slice(respSlice, func(i, j int) bool { return respSlice[i].Id < respSlice[j].Id })
+
+	return pageOf(respSlice, func(u User) int { return u.Id }, false, page), nil
+}
@@ -0,0 +1,182 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+)
+
+// nextId allocates the next id for table. Ids come from a sequence stored
+// in DBStructure.Sequences, so they are never reused, even after deletes.
+func (t *tx) nextId(dbStructure DBStructure, table string) int {
+	if t.sequences == nil {
+		t.sequences = map[string]int{}
+	}
+	id, ok := t.sequences[table]
+	if !ok {
+		id = dbStructure.Sequences[table]
+	}
+	id++
+	t.sequences[table] = id
+	t.put("sequences", table, id)
+
+	return id
+}
+
+// IdCollision describes a record damaged by an id being handed out twice
+// before ids came from sequences
+type IdCollision struct {
+	Table  string `json:"table"`
+	Id     int    `json:"id"`
+	NewId  int    `json:"new_id,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// needsIdRepair reports whether the file predates id sequences
+func (dbStructure DBStructure) needsIdRepair() bool {
+	if len(dbStructure.Sequences) > 0 {
+		return false
+	}
+
+	return len(dbStructure.Chirps) > 0 || len(dbStructure.Users) > 0 || len(dbStructure.Tokens) > 0
+}
+
+// repairIds runs once on files written before id sequences existed.
+// It seeds each sequence past the highest id in use, moves records filed
+// under a key that doesn't match their id, and uses the write-ahead log
+// history to find chirps that were overwritten by a later chirp reusing
+// their id; those are restored under fresh ids. Every problem found is
+// returned and logged.
+func (db *DB) repairIds(history []mutation) ([]IdCollision, error) {
+	var collisions []IdCollision
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		collisions = nil
+
+		seqs := map[string]int{
+			"chirps": maxKey(dbStructure.Chirps),
+			"users":  maxKey(dbStructure.Users),
+			"tokens": maxKey(dbStructure.Tokens),
+		}
+		for _, c := range dbStructure.Chirps {
+			seqs["chirps"] = max(seqs["chirps"], c.Id)
+		}
+		for _, u := range dbStructure.Users {
+			seqs["users"] = max(seqs["users"], u.Id)
+		}
+		for _, m := range history {
+			var key int
+			if m.Op == opPut && json.Unmarshal(m.Key, &key) == nil {
+				seqs[m.Table] = max(seqs[m.Table], key)
+			}
+		}
+		tx.sequences = seqs
+
+		for _, key := range sortedKeys(dbStructure.Chirps) {
+			c := dbStructure.Chirps[key]
+			if c.Id == key {
+				continue
+			}
+			c.Id = tx.nextId(dbStructure, "chirps")
+			tx.delete("chirps", key)
+			tx.put("chirps", c.Id, c)
+			collisions = append(collisions, IdCollision{
+				Table:  "chirps",
+				Id:     key,
+				NewId:  c.Id,
+				Detail: "chirp was stored under another chirp's id",
+			})
+		}
+		for _, key := range sortedKeys(dbStructure.Users) {
+			if u := dbStructure.Users[key]; u.Id != key {
+				collisions = append(collisions, IdCollision{
+					Table:  "users",
+					Id:     key,
+					Detail: fmt.Sprintf("user %s is stored under id %d but claims id %d", u.Email, key, u.Id),
+				})
+			}
+		}
+
+		// chirps are never edited, so a second put to a live chirp id means
+		// the first chirp was overwritten
+		live := map[int]Chirp{}
+		for _, m := range history {
+			if m.Table != "chirps" {
+				continue
+			}
+			var key int
+			err := json.Unmarshal(m.Key, &key)
+			if err != nil {
+				return err
+			}
+			if m.Op == opDelete {
+				delete(live, key)
+				continue
+			}
+
+			var c Chirp
+			err = json.Unmarshal(m.Value, &c)
+			if err != nil {
+				return err
+			}
+			lost, ok := live[key]
+			live[key] = c
+			if !ok || reflect.DeepEqual(lost, c) {
+				continue
+			}
+
+			lost.Id = tx.nextId(dbStructure, "chirps")
+			tx.put("chirps", lost.Id, lost)
+			collisions = append(collisions, IdCollision{
+				Table:  "chirps",
+				Id:     key,
+				NewId:  lost.Id,
+				Detail: fmt.Sprintf("chirp by user %d was overwritten; restored from the write-ahead log", lost.Author_Id),
+			})
+		}
+
+		for table, seq := range seqs {
+			tx.put("sequences", table, seq)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range collisions {
+		if c.NewId != 0 {
+			log.Printf("id repair: %s %d: %s (now id %d)\n", c.Table, c.Id, c.Detail, c.NewId)
+		} else {
+			log.Printf("id repair: %s %d: %s\n", c.Table, c.Id, c.Detail)
+		}
+	}
+	log.Printf("id repair: seeded id sequences, found %d collisions\n", len(collisions))
+
+	return collisions, nil
+}
+
+func maxKey[V any](table map[int]V) int {
+	m := 0
+	for key := range table {
+		m = max(m, key)
+	}
+	return m
+}
+
+func sortedKeys[V any](table map[int]V) []int {
+	keys := make([]int, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
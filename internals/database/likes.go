@@ -0,0 +1,134 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrChirpNotFound means a chirp doesn't exist, was deleted or is hidden
+var ErrChirpNotFound = errors.New("chirp not found")
+
+// Engagement records that UserId liked or rechirped ChirpId
+type Engagement struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	ChirpId   int       `json:"chirp_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// engagements returns the likes or rechirps table
+func (dbStructure DBStructure) engagements(table string) map[int]Engagement {
+	if table == "likes" {
+		return dbStructure.Likes
+	}
+	return dbStructure.Rechirps
+}
+
+// LikeChirp makes userId like chirpId and returns the chirp. Liking a
+// chirp twice is not an error.
+func (db *DB) LikeChirp(userId int, chirpId int) (Chirp, error) {
+	return db.engage("likes", userId, chirpId, true)
+}
+
+// UnlikeChirp takes back userId's like of chirpId and returns the chirp.
+// Unliking a chirp that isn't liked is not an error.
+func (db *DB) UnlikeChirp(userId int, chirpId int) (Chirp, error) {
+	return db.engage("likes", userId, chirpId, false)
+}
+
+// Rechirp makes userId rechirp chirpId and returns the chirp. Rechirping
+// a chirp twice is not an error.
+func (db *DB) Rechirp(userId int, chirpId int) (Chirp, error) {
+	return db.engage("rechirps", userId, chirpId, true)
+}
+
+// Unrechirp takes back userId's rechirp of chirpId and returns the chirp.
+// Undoing a rechirp that wasn't made is not an error.
+func (db *DB) Unrechirp(userId int, chirpId int) (Chirp, error) {
+	return db.engage("rechirps", userId, chirpId, false)
+}
+
+// engage adds (on) or removes userId's like or rechirp of chirpId. The
+// chirp's counter changes in the same update as the table, so the two
+// can't disagree.
+func (db *DB) engage(table string, userId int, chirpId int, on bool) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		var ok bool
+		chirp, ok = dbStructure.Chirps[chirpId]
+		if !ok || !chirp.visible() {
+			return ErrChirpNotFound
+		}
+
+		existing := 0
+		for key, e := range dbStructure.engagements(table) {
+			if e.UserId == userId && e.ChirpId == chirpId {
+				existing = key
+				break
+			}
+		}
+		if on == (existing != 0) {
+			return nil
+		}
+
+		delta := -1
+		if on {
+			if _, ok := dbStructure.Users[userId]; !ok {
+				return errors.New("user not found")
+			}
+			e := Engagement{
+				Id:        tx.nextId(dbStructure, table),
+				UserId:    userId,
+				ChirpId:   chirpId,
+				CreatedAt: time.Now().UTC(),
+			}
+			tx.put(table, e.Id, e)
+			delta = 1
+		} else {
+			tx.delete(table, existing)
+		}
+
+		if table == "likes" {
+			chirp.Like_Count += delta
+		} else {
+			chirp.Rechirp_Count += delta
+		}
+		tx.put("chirps", chirp.Id, chirp)
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// GetLikers returns the users who liked chirpId, ordered by id
+func (db *DB) GetLikers(chirpId int, page Page) ([]User, error) {
+	respSlice := []User{}
+	err := db.view(func(dbStructure DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpId]
+		if !ok || !chirp.visible() {
+			return ErrChirpNotFound
+		}
+		for _, e := range dbStructure.Likes {
+			if e.ChirpId != chirpId {
+				continue
+			}
+			user, ok := dbStructure.Users[e.UserId]
+			if !ok {
+				continue
+			}
+			user.Password = ""
+			respSlice = append(respSlice, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return []User{}, err
+	}
+	sort.Slice(respSlice, func(i, j int) bool { return respSlice[i].Id < respSlice[j].Id })
+
+	return pageOf(respSlice, func(u User) int { return u.Id }, false, page), nil
+}
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// LockoutPolicy decides how failed logins for one key are throttled. The
+// first FreeAttempts failures cost nothing; each one after that doubles
+// the wait before the next attempt, starting at Backoff and capped at
+// MaxBackoff. LockAfter failures lock the key for LockFor, doubling with
+// each lockout up to MaxLockFor. Failures are forgotten after Window
+// without one.
+type LockoutPolicy struct {
+	FreeAttempts int
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	LockAfter    int
+	LockFor      time.Duration
+	MaxLockFor   time.Duration
+	Window       time.Duration
+}
+
+// LoginThrottle counts the failed logins for one key, made with
+// AccountThrottleKey or IPThrottleKey
+type LoginThrottle struct {
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	Lockouts    int        `json:"lockouts"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// AccountThrottleKey is the throttle key of the account with email. It
+// doesn't depend on whether the account exists.
+func AccountThrottleKey(email string) string {
+	return "account:" + NormalizeEmail(email)
+}
+
+// IPThrottleKey is the throttle key of a client address
+func IPThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// throttleKind is "account" or "ip", for the keys one policy applies to
+func throttleKind(key string) string {
+	kind, _, _ := strings.Cut(key, ":")
+	return kind
+}
+
+// Locked reports whether the key is locked out at now
+func (t LoginThrottle) Locked(now time.Time) bool {
+	return t.LockedUntil != nil && now.Before(*t.LockedUntil)
+}
+
+// expired reports whether the throttle holds nothing back at now under
+// policy: it isn't locked and its failures have been forgotten
+func (t LoginThrottle) expired(policy LockoutPolicy, now time.Time) bool {
+	return !t.Locked(now) && now.Sub(t.LastFailure) > policy.Window
+}
+
+// RetryAfter is how long from now the key must wait before its next
+// attempt, or zero if it may try at once
+func (t LoginThrottle) RetryAfter(policy LockoutPolicy, now time.Time) time.Duration {
+	if t.Locked(now) {
+		return t.LockedUntil.Sub(now)
+	}
+	if t.Failures <= policy.FreeAttempts || now.Sub(t.LastFailure) > policy.Window {
+		return 0
+	}
+	wait := doubled(policy.Backoff, t.Failures-policy.FreeAttempts-1, policy.MaxBackoff)
+	if wait -= now.Sub(t.LastFailure); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// fail records a failure at now and reports whether it locked the key
+func (t *LoginThrottle) fail(policy LockoutPolicy, now time.Time) bool {
+	if !t.Locked(now) && now.Sub(t.LastFailure) > policy.Window {
+		t.Failures, t.Lockouts = 0, 0
+	}
+	t.Failures++
+	t.LastFailure = now
+	if t.Failures < policy.LockAfter || t.Locked(now) {
+		return false
+	}
+
+	t.Lockouts++
+	t.Failures = 0
+	until := now.Add(doubled(policy.LockFor, t.Lockouts-1, policy.MaxLockFor))
+	t.LockedUntil = &until
+	return true
+}
+
+// doubled is d doubled n times, but no more than max
+func doubled(d time.Duration, n int, max time.Duration) time.Duration {
+	for ; n > 0 && d < max; n-- {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// GetLoginThrottle returns the failed logins recorded for key. A key
+// without any has an empty throttle.
+func (db *DB) GetLoginThrottle(key string) (LoginThrottle, error) {
+	throttle := LoginThrottle{Key: key}
+	err := db.view(func(dbStructure DBStructure) error {
+		if t, ok := dbStructure.LoginThrottles[key]; ok {
+			throttle = t
+		}
+		return nil
+	})
+
+	return throttle, err
+}
+
+// RecordLoginFailure adds a failed login to key under policy. locked
+// reports whether this failure locked the key out. Expired throttles of
+// the same kind of key are removed on the way.
+func (db *DB) RecordLoginFailure(key string, policy LockoutPolicy) (throttle LoginThrottle, locked bool, err error) {
+	err = db.update(func(dbStructure DBStructure, tx *tx) error {
+		now := time.Now().UTC()
+		kind := throttleKind(key)
+		for k, t := range dbStructure.LoginThrottles {
+			if k != key && throttleKind(k) == kind && t.expired(policy, now) {
+				tx.delete("login_throttles", k)
+			}
+		}
+
+		throttle = LoginThrottle{Key: key}
+		if t, ok := dbStructure.LoginThrottles[key]; ok {
+			throttle = t
+		}
+		locked = throttle.fail(policy, now)
+		tx.put("login_throttles", key, throttle)
+		return nil
+	})
+	if err != nil {
+		return LoginThrottle{}, false, err
+	}
+
+	return throttle, locked, nil
+}
+
+// ClearLoginThrottle forgets the failed logins of key
+func (db *DB) ClearLoginThrottle(key string) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		if _, ok := dbStructure.LoginThrottles[key]; ok {
+			tx.delete("login_throttles", key)
+		}
+		return nil
+	})
+}
+
+// UnlockUser forgets the failed logins of userId's account, lifting any
+// lockout, and audits it as adminId's action
+func (db *DB) UnlockUser(userId int, adminId int) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			return errors.New("user not found")
+		}
+		key := AccountThrottleKey(user.Email)
+		if _, ok := dbStructure.LoginThrottles[key]; ok {
+			tx.delete("login_throttles", key)
+		}
+		audit(dbStructure, tx, AuditEntry{ActorId: adminId, Action: "user.unlock", TargetType: TargetUser, TargetId: userId})
+		return nil
+	})
+}
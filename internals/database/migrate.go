@@ -0,0 +1,209 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// Migration is one step in a backend's schema history
+type Migration struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+}
+
+// MigrateOptions controls how pending migrations are applied
+type MigrateOptions struct {
+	// DryRun reports the pending migrations without changing anything
+	DryRun bool
+	// Backup copies the database aside before it is migrated
+	Backup bool
+}
+
+type jsonMigration struct {
+	Migration
+	up func(dbStructure *DBStructure) error
+}
+
+// jsonMigrations is the ordered registry of JSON schema changes.
+// Append new steps at the end; never edit or reorder released ones.
+var jsonMigrations = []jsonMigration{
+	{
+		Migration: Migration{Version: 1, Description: "add schema_version"},
+		up:        func(*DBStructure) error { return nil },
+	},
+	{
+		Migration: Migration{Version: 2, Description: "give every user a role"},
+		up: func(dbStructure *DBStructure) error {
+			for id, user := range dbStructure.Users {
+				if user.Role == "" {
+					user.Role = RoleUser
+					dbStructure.Users[id] = user
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 3, Description: "normalize email addresses"},
+		up: func(dbStructure *DBStructure) error {
+			ids := make([]int, 0, len(dbStructure.Users))
+			taken := map[string]bool{}
+			for id, user := range dbStructure.Users {
+				ids = append(ids, id)
+				if user.Email == NormalizeEmail(user.Email) {
+					taken[user.Email] = true
+				}
+			}
+			// of addresses that differ only in case, the one already in
+			// normal form is kept, or else the oldest account's is changed
+			sort.Ints(ids)
+			for _, id := range ids {
+				user := dbStructure.Users[id]
+				email := NormalizeEmail(user.Email)
+				if email == user.Email {
+					continue
+				}
+				if taken[email] {
+					log.Printf("user %d keeps email %q, which another user has in another case\n", id, user.Email)
+					continue
+				}
+				taken[email] = true
+				user.Email = email
+				dbStructure.Users[id] = user
+			}
+			return nil
+		},
+	},
+}
+
+// jsonSchemaVersion is the version written by this build
+func jsonSchemaVersion() int {
+	return jsonMigrations[len(jsonMigrations)-1].Version
+}
+
+// pendingJSONMigrations returns the steps needed to bring version up to date
+func pendingJSONMigrations(version int) ([]jsonMigration, error) {
+	if version > jsonSchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than this build supports (%d)", version, jsonSchemaVersion())
+	}
+
+	var pending []jsonMigration
+	for _, m := range jsonMigrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrate runs the pending migrations against db.data. The caller must
+// hold db.mux. A migrated database is snapshotted and the write-ahead log
+// emptied at once, so records written under the old schema are never
+// replayed over the new one.
+func (db *DB) migrate(opts MigrateOptions) error {
+	pending, err := pendingJSONMigrations(db.data.SchemaVersion)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	if opts.Backup {
+		backup := fmt.Sprintf("%s.v%d.bak", db.path, db.data.SchemaVersion)
+		err = copyFile(db.path, backup)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("backing up before migrating: %w", err)
+		}
+		if err == nil {
+			log.Printf("backed up %s to %s\n", db.path, backup)
+		}
+	}
+
+	for _, m := range pending {
+		err = m.up(&db.data)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		db.data.SchemaVersion = m.Version
+		log.Printf("applied migration %d: %s\n", m.Version, m.Description)
+	}
+
+	db.dirty = true
+	err = db.flush()
+	if err != nil {
+		return err
+	}
+
+	return db.wal.truncate(0)
+}
+
+// Migrate brings the database described by config up to the current
+// schema and returns the migrations it applied, or on a dry run the ones
+// it would apply. Opening a Store migrates too; this exists so upgrades
+// can be run, previewed and backed up on their own.
+func Migrate(config StoreConfig, opts MigrateOptions) ([]Migration, error) {
+	path := config.Path
+	switch config.Driver {
+	case "", "json":
+		if path == "" {
+			path = "./database.json"
+		}
+		return migrateJSON(path, opts)
+	case "sqlite":
+		if path == "" {
+			path = "./database.db"
+		}
+		return migrateSQLite(path, opts)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", config.Driver)
+	}
+}
+
+func migrateJSON(path string, opts MigrateOptions) ([]Migration, error) {
+	var version struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	fileData, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// a new database starts at the current version
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(fileData, &version)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := pendingJSONMigrations(version.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, m := range pending {
+		applied = append(applied, m.Migration)
+	}
+	if opts.DryRun || len(pending) == 0 {
+		return applied, nil
+	}
+
+	db, err := openDB(path, 0, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return applied, db.Close()
+}
+
+// copyFile copies src to dst, syncing dst before returning
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(dst, data)
+}
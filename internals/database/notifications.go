@@ -0,0 +1,61 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// Notification kinds
+const (
+	NotifyLoginLockout = "login.lockout"
+)
+
+// Notification is a message recorded on a user's account, such as a
+// warning that it was locked after failed logins
+type Notification struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	Kind      string    `json:"kind"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddNotification records a notification on userId's account
+func (db *DB) AddNotification(userId int, kind string, message string) (Notification, error) {
+	var n Notification
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		n = Notification{
+			Id:        tx.nextId(dbStructure, "notifications"),
+			UserId:    userId,
+			Kind:      kind,
+			Message:   message,
+			CreatedAt: time.Now().UTC(),
+		}
+		tx.put("notifications", n.Id, n)
+		return nil
+	})
+	if err != nil {
+		return Notification{}, err
+	}
+
+	return n, nil
+}
+
+// GetNotifications returns the notifications of userId, newest first
+func (db *DB) GetNotifications(userId int, page Page) ([]Notification, error) {
+	notifications := []Notification{}
+	err := db.view(func(dbStructure DBStructure) error {
+		for _, n := range dbStructure.Notifications {
+			if n.UserId == userId {
+				notifications = append(notifications, n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []Notification{}, err
+	}
+	sort.Slice(notifications, func(i, j int) bool { return notifications[i].Id > notifications[j].Id })
+
+	return pageOf(notifications, func(n Notification) int { return n.Id }, true, page), nil
+}
@@ -0,0 +1,93 @@
+package database
+
+import "fmt"
+
+// Page selects part of a list ordered by id. Ids are never reused, so a
+// page boundary stays put when items around it are deleted.
+//
+// After and Before are ids from a previous page and are excluded; zero
+// leaves that side open. With only Before set, the page is the Limit items
+// just before it. Limit zero returns everything. Stores return up to
+// Limit+1 items so the caller can tell whether the list goes on.
+type Page struct {
+	Limit  int
+	After  int
+	Before int
+}
+
+// Backwards reports whether the page is read towards the start of the list
+func (p Page) Backwards() bool {
+	return p.Before != 0 && p.After == 0
+}
+
+// pageOf returns the window p selects from items, which must be sorted by
+// id, descending if desc is set
+func pageOf[T any](items []T, id func(T) int, desc bool, p Page) []T {
+	// further along the list is a higher id ascending, a lower one descending
+	beyond := func(i, cursor int) bool {
+		if desc {
+			return i < cursor
+		}
+		return i > cursor
+	}
+
+	var window []T
+	for _, item := range items {
+		i := id(item)
+		if p.After != 0 && !beyond(i, p.After) {
+			continue
+		}
+		if p.Before != 0 && !beyond(p.Before, i) {
+			continue
+		}
+		window = append(window, item)
+	}
+
+	if p.Limit <= 0 || len(window) <= p.Limit+1 {
+		return window
+	}
+	if p.Backwards() {
+		return window[len(window)-p.Limit-1:]
+	}
+	return window[:p.Limit+1]
+}
+
+// pageQuery appends the conditions, order and limit of p to query, which
+// must end in a WHERE clause. column is the id column. Results of a
+// backwards page come out reversed and must go through reversePage.
+func pageQuery(query string, args []any, column string, desc bool, p Page) (string, []any) {
+	after, before := ">", "<"
+	if desc {
+		after, before = "<", ">"
+	}
+	if p.After != 0 {
+		query += fmt.Sprintf(" AND %s %s ?", column, after)
+		args = append(args, p.After)
+	}
+	if p.Before != 0 {
+		query += fmt.Sprintf(" AND %s %s ?", column, before)
+		args = append(args, p.Before)
+	}
+
+	if desc != p.Backwards() {
+		query += fmt.Sprintf(" ORDER BY %s DESC", column)
+	} else {
+		query += fmt.Sprintf(" ORDER BY %s ASC", column)
+	}
+	if p.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, p.Limit+1)
+	}
+
+	return query, args
+}
+
+// reversePage puts the rows of a backwards pageQuery back in list order
+func reversePage[T any](items []T, p Page) {
+	if !p.Backwards() {
+		return
+	}
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+}
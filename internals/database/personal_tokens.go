@@ -0,0 +1,138 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrPersonalTokenNotFound means the personal access token doesn't exist
+// or belongs to another user
+var ErrPersonalTokenNotFound = errors.New("personal access token not found")
+
+// PersonalToken is a long-lived credential a user mints for scripts and
+// bots. Only a hash of the secret is stored; the secret itself is shown
+// once, when the token is created. A zero ExpiresAt never expires.
+type PersonalToken struct {
+	Id         int       `json:"id"`
+	UserId     int       `json:"user_id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	TokenHash  string    `json:"token_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+// Active reports whether the token can still be used at now
+func (p PersonalToken) Active(now time.Time) bool {
+	return p.RevokedAt.IsZero() && (p.ExpiresAt.IsZero() || now.Before(p.ExpiresAt))
+}
+
+// CreatePersonalToken stores token for token.UserId under the hash of
+// secret
+func (db *DB) CreatePersonalToken(token PersonalToken, secret string) (PersonalToken, error) {
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		if _, ok := dbStructure.Users[token.UserId]; !ok {
+			return errors.New("user not found")
+		}
+		token.Id = tx.nextId(dbStructure, "personal_tokens")
+		token.TokenHash = hashToken(secret)
+		token.CreatedAt = time.Now().UTC()
+		token.LastUsedAt = time.Time{}
+		token.ExpiresAt = token.ExpiresAt.UTC()
+		token.RevokedAt = time.Time{}
+		if token.Scopes == nil {
+			token.Scopes = []string{}
+		}
+		tx.put("personal_tokens", token.Id, token)
+		return nil
+	})
+	if err != nil {
+		return PersonalToken{}, err
+	}
+
+	return token, nil
+}
+
+// GetPersonalToken returns the token whose secret is secret, revoked or not
+func (db *DB) GetPersonalToken(secret string) (PersonalToken, error) {
+	var token PersonalToken
+	err := db.view(func(dbStructure DBStructure) error {
+		hash := hashToken(secret)
+		for _, t := range dbStructure.PersonalTokens {
+			if t.TokenHash == hash {
+				token = t
+				return nil
+			}
+		}
+		return ErrPersonalTokenNotFound
+	})
+	if err != nil {
+		return PersonalToken{}, err
+	}
+
+	return token, nil
+}
+
+// GetPersonalTokens returns the active tokens of userId, newest first
+func (db *DB) GetPersonalTokens(userId int) ([]PersonalToken, error) {
+	tokens := []PersonalToken{}
+	err := db.view(func(dbStructure DBStructure) error {
+		now := time.Now()
+		for _, token := range dbStructure.PersonalTokens {
+			if token.UserId == userId && token.Active(now) {
+				tokens = append(tokens, token)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []PersonalToken{}, err
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Id > tokens[j].Id })
+
+	return tokens, nil
+}
+
+// TouchPersonalToken records that token tokenId was just used
+func (db *DB) TouchPersonalToken(tokenId int) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		token, ok := dbStructure.PersonalTokens[tokenId]
+		if !ok {
+			return ErrPersonalTokenNotFound
+		}
+		token.LastUsedAt = time.Now().UTC()
+		tx.put("personal_tokens", token.Id, token)
+		return nil
+	})
+}
+
+// RevokePersonalToken revokes userId's token tokenId. Revoking a token
+// twice is not an error.
+func (db *DB) RevokePersonalToken(userId int, tokenId int) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		token, ok := dbStructure.PersonalTokens[tokenId]
+		if !ok || token.UserId != userId {
+			return ErrPersonalTokenNotFound
+		}
+		if token.RevokedAt.IsZero() {
+			token.RevokedAt = time.Now().UTC()
+			tx.put("personal_tokens", token.Id, token)
+		}
+		return nil
+	})
+}
+
+// revokeUserPersonalTokens revokes every personal access token of userId
+// as part of tx
+func revokeUserPersonalTokens(dbStructure DBStructure, tx *tx, userId int) {
+	now := time.Now().UTC()
+	for _, token := range dbStructure.PersonalTokens {
+		if token.UserId == userId && token.RevokedAt.IsZero() {
+			token.RevokedAt = now
+			tx.put("personal_tokens", token.Id, token)
+		}
+	}
+}
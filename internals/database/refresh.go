@@ -0,0 +1,188 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrRefreshTokenReused means a refresh token that was already rotated
+	// was presented again. Its session has been revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	// ErrRefreshTokenRevoked means the token's session was revoked
+	ErrRefreshTokenRevoked = errors.New("refresh token revoked")
+)
+
+// RefreshToken is one refresh token of a session. Only a hash of the token
+// is stored. ReplacedBy is the id of the token it was rotated into, or 0
+// while it is the session's current token.
+type RefreshToken struct {
+	Id         int       `json:"id"`
+	TokenHash  string    `json:"token_hash"`
+	SessionId  int       `json:"session_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	ReplacedBy int       `json:"replaced_by,omitempty"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateRefreshToken stores the refresh token issued at login as the first
+// token of sessionId
+func (db *DB) CreateRefreshToken(sessionId int, token string, expiresAt time.Time) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		session, ok := dbStructure.Sessions[sessionId]
+		if !ok {
+			return ErrSessionNotFound
+		}
+		session.ExpiresAt = expiresAt.UTC()
+		tx.put("sessions", session.Id, session)
+
+		refreshToken := RefreshToken{
+			Id:        tx.nextId(dbStructure, "refresh_tokens"),
+			TokenHash: hashToken(token),
+			SessionId: session.Id,
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: expiresAt,
+		}
+		tx.put("refresh_tokens", refreshToken.Id, refreshToken)
+		return nil
+	})
+}
+
+// Rotation asks for a refresh token to be rotated. Mint makes the new
+// token for the session it will belong to, which isn't known beforehand
+// for a token from before sessions.
+type Rotation struct {
+	OldToken string
+	UserId   int
+	// SessionId is the session named in the old token, zero if it was
+	// issued before sessions
+	SessionId int
+	// NewSession is recorded for a token from before sessions that the
+	// store never saw, issued before refresh tokens were rotated
+	NewSession Session
+	ExpiresAt  time.Time
+	Mint       func(sessionId int) (string, error)
+}
+
+// RotateRefreshToken replaces rotation.OldToken with a new token minted for
+// its session and returns the session id and the new token. If the old
+// token was already rotated, the whole session is revoked and
+// ErrRefreshTokenReused is returned. A token that belongs to another
+// session or user is refused.
+//
+// A token from before sessions names none. If the store knows it, it
+// stays in the session it was recorded in, once its token family;
+// otherwise it starts rotation.NewSession. Either way that happens in the
+// same update as the rotation, so a refused rotation leaves nothing behind.
+func (db *DB) RotateRefreshToken(rotation Rotation) (int, string, error) {
+	var sessionId int
+	var newToken string
+	var reused bool
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		now := time.Now().UTC()
+		oldHash := hashToken(rotation.OldToken)
+
+		var old RefreshToken
+		found := false
+		for _, value := range dbStructure.RefreshTokens {
+			if value.TokenHash == oldHash {
+				old = value
+				found = true
+				break
+			}
+		}
+
+		sessionId = rotation.SessionId
+		if sessionId == 0 && found {
+			sessionId = old.SessionId
+		}
+		var session Session
+		if sessionId == 0 {
+			if _, ok := dbStructure.Users[rotation.UserId]; !ok {
+				return errors.New("user not found")
+			}
+			session = rotation.NewSession
+			session.Id = tx.nextId(dbStructure, "sessions")
+			session.UserId = rotation.UserId
+			session.CreatedAt = now
+			session.RevokedAt = time.Time{}
+			sessionId = session.Id
+		} else {
+			var ok bool
+			session, ok = dbStructure.Sessions[sessionId]
+			if !ok || session.UserId != rotation.UserId || (found && old.SessionId != sessionId) {
+				return ErrRefreshTokenRevoked
+			}
+		}
+		if !found {
+			old = RefreshToken{
+				Id:        tx.nextId(dbStructure, "refresh_tokens"),
+				TokenHash: oldHash,
+				SessionId: session.Id,
+				CreatedAt: now,
+			}
+		}
+
+		if session.revoked() {
+			return ErrRefreshTokenRevoked
+		}
+		if old.ReplacedBy != 0 {
+			session.RevokedAt = now
+			tx.put("sessions", session.Id, session)
+			reused = true
+			return nil
+		}
+
+		var err error
+		newToken, err = rotation.Mint(session.Id)
+		if err != nil {
+			return err
+		}
+		newRefreshToken := RefreshToken{
+			Id:        tx.nextId(dbStructure, "refresh_tokens"),
+			TokenHash: hashToken(newToken),
+			SessionId: session.Id,
+			CreatedAt: now,
+			ExpiresAt: rotation.ExpiresAt,
+		}
+		tx.put("refresh_tokens", newRefreshToken.Id, newRefreshToken)
+		old.ReplacedBy = newRefreshToken.Id
+		tx.put("refresh_tokens", old.Id, old)
+		session.LastUsedAt = now
+		session.ExpiresAt = rotation.ExpiresAt.UTC()
+		tx.put("sessions", session.Id, session)
+		return nil
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	if reused {
+		return sessionId, "", ErrRefreshTokenReused
+	}
+
+	return sessionId, newToken, nil
+}
+
+// revokeTokenSession records the revocation of the session token belongs
+// to, if the token is known
+func revokeTokenSession(dbStructure DBStructure, tx *tx, token string) {
+	tokenHash := hashToken(token)
+	for _, value := range dbStructure.RefreshTokens {
+		if value.TokenHash != tokenHash {
+			continue
+		}
+		session, ok := dbStructure.Sessions[value.SessionId]
+		if ok && !session.revoked() {
+			session.RevokedAt = time.Now().UTC()
+			tx.put("sessions", session.Id, session)
+		}
+		return
+	}
+}
@@ -0,0 +1,231 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Report statuses. A report is open until a moderator claims it, and
+// claimed until they resolve it.
+const (
+	ReportOpen     = "open"
+	ReportClaimed  = "claimed"
+	ReportResolved = "resolved"
+)
+
+// Ways to resolve a report
+const (
+	ResolutionDismiss = "dismiss"
+	// ResolutionHideChirp hides the reported chirp
+	ResolutionHideChirp = "hide_chirp"
+	// ResolutionSuspendAuthor hides the reported chirp and suspends its
+	// author
+	ResolutionSuspendAuthor = "suspend_author"
+)
+
+var (
+	ErrReportNotFound = errors.New("report not found")
+	// ErrReportClaimed means another moderator claimed the report
+	ErrReportClaimed  = errors.New("report is claimed by another moderator")
+	ErrReportResolved = errors.New("report is already resolved")
+)
+
+// Report is a user's complaint about a chirp. AuthorId is the chirp's
+// author, kept so the report still makes sense if the chirp is deleted.
+type Report struct {
+	Id         int       `json:"id"`
+	ChirpId    int       `json:"chirp_id"`
+	AuthorId   int       `json:"author_id"`
+	ReporterId int       `json:"reporter_id"`
+	Reason     string    `json:"reason"`
+	Status     string    `json:"status"`
+	ClaimedBy  int       `json:"claimed_by,omitempty"`
+	Resolution string    `json:"resolution,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Resolution is how a moderator resolves a report. SuspendUntil ends the
+// suspension of ResolutionSuspendAuthor; nil suspends with no end.
+type Resolution struct {
+	Action       string
+	Note         string
+	SuspendUntil *time.Time
+}
+
+// ValidResolution reports whether action is a known way to resolve a
+// report
+func ValidResolution(action string) bool {
+	switch action {
+	case ResolutionDismiss, ResolutionHideChirp, ResolutionSuspendAuthor:
+		return true
+	}
+	return false
+}
+
+// CreateReport files reporterId's report about chirpId. If they already
+// have an unresolved report about it, that one is returned instead.
+func (db *DB) CreateReport(chirpId int, reporterId int, reason string) (Report, error) {
+	var report Report
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		chirp, ok := dbStructure.Chirps[chirpId]
+		if !ok || !chirp.visible() {
+			return ErrChirpNotFound
+		}
+		for _, r := range dbStructure.Reports {
+			if r.ChirpId == chirpId && r.ReporterId == reporterId && r.Status != ReportResolved {
+				report = r
+				return nil
+			}
+		}
+
+		now := time.Now().UTC()
+		report = Report{
+			Id:         tx.nextId(dbStructure, "reports"),
+			ChirpId:    chirpId,
+			AuthorId:   chirp.Author_Id,
+			ReporterId: reporterId,
+			Reason:     reason,
+			Status:     ReportOpen,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+		tx.put("reports", report.Id, report)
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+// GetReports returns the reports with status, or all of them when status
+// is empty, oldest first
+func (db *DB) GetReports(status string, page Page) ([]Report, error) {
+	reports := []Report{}
+	err := db.view(func(dbStructure DBStructure) error {
+		for _, r := range dbStructure.Reports {
+			if status == "" || r.Status == status {
+				reports = append(reports, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []Report{}, err
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Id < reports[j].Id })
+
+	return pageOf(reports, func(r Report) int { return r.Id }, false, page), nil
+}
+
+// ClaimReport assigns reportId to moderatorId so other moderators leave it
+// alone. Claiming a report twice is not an error.
+func (db *DB) ClaimReport(reportId int, moderatorId int) (Report, error) {
+	var report Report
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		var ok bool
+		report, ok = dbStructure.Reports[reportId]
+		if !ok {
+			return ErrReportNotFound
+		}
+		err := checkClaim(report, moderatorId)
+		if err != nil || report.Status == ReportClaimed {
+			return err
+		}
+
+		report.Status = ReportClaimed
+		report.ClaimedBy = moderatorId
+		report.UpdatedAt = time.Now().UTC()
+		tx.put("reports", report.Id, report)
+		audit(dbStructure, tx, AuditEntry{ActorId: moderatorId, Action: "report.claim", TargetType: TargetReport, TargetId: report.Id})
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+// ResolveReport closes reportId, which must be open or claimed by
+// moderatorId, and carries out the resolution. Every change is written to
+// the audit log in the same update.
+func (db *DB) ResolveReport(reportId int, moderatorId int, resolution Resolution) (Report, error) {
+	if !ValidResolution(resolution.Action) {
+		return Report{}, fmt.Errorf("unknown resolution %q", resolution.Action)
+	}
+
+	var report Report
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		var ok bool
+		report, ok = dbStructure.Reports[reportId]
+		if !ok {
+			return ErrReportNotFound
+		}
+		err := checkClaim(report, moderatorId)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+
+		if resolution.Action == ResolutionSuspendAuthor {
+			_, err = suspend(dbStructure, tx, report.AuthorId, moderatorId, suspensionReason(report, resolution), resolution.SuspendUntil)
+			if err != nil {
+				return err
+			}
+		}
+		if resolution.Action != ResolutionDismiss {
+			chirp, ok := dbStructure.Chirps[report.ChirpId]
+			if ok && chirp.visible() {
+				chirp.Hidden = true
+				tx.put("chirps", chirp.Id, chirp)
+				audit(dbStructure, tx, AuditEntry{
+					ActorId: moderatorId, Action: "chirp.hide", TargetType: TargetChirp, TargetId: chirp.Id,
+					Detail: fmt.Sprintf("report %d", report.Id),
+				})
+			}
+		}
+
+		report.Status = ReportResolved
+		report.ClaimedBy = moderatorId
+		report.Resolution = resolution.Action
+		report.Note = resolution.Note
+		report.UpdatedAt = now
+		tx.put("reports", report.Id, report)
+		audit(dbStructure, tx, AuditEntry{
+			ActorId: moderatorId, Action: "report.resolve", TargetType: TargetReport, TargetId: report.Id,
+			Detail: resolution.Action,
+		})
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+// checkClaim returns why moderatorId can't act on report, if they can't
+func checkClaim(report Report, moderatorId int) error {
+	switch {
+	case report.Status == ReportResolved:
+		return ErrReportResolved
+	case report.Status == ReportClaimed && report.ClaimedBy != moderatorId:
+		return ErrReportClaimed
+	}
+	return nil
+}
+
+// suspensionReason is the reason recorded for suspending the author of a
+// reported chirp
+func suspensionReason(report Report, resolution Resolution) string {
+	if resolution.Note != "" {
+		return resolution.Note
+	}
+	return fmt.Sprintf("report %d: %s", report.Id, report.Reason)
+}
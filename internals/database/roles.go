@@ -0,0 +1,76 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// User roles, from least to most privileged
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// ErrOutranked means the acting user's role doesn't rank above the role of
+// the user they tried to act on
+var ErrOutranked = errors.New("only users of a lower role can be suspended")
+
+var roleRanks = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// RoleRank orders the roles, higher ranks being more privileged. An
+// unknown role ranks below them all.
+func RoleRank(role string) int {
+	return roleRanks[role]
+}
+
+// roleChangeEntry audits adminId changing userId's role from old to role
+func roleChangeEntry(userId int, old string, role string, adminId int) AuditEntry {
+	return AuditEntry{
+		ActorId: adminId, Action: "user.role", TargetType: TargetUser, TargetId: userId,
+		Detail: fmt.Sprintf("%s to %s", old, role),
+	}
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	switch role {
+	case RoleUser, RoleModerator, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// SetUserRole changes the role of user userId and audits the change as
+// adminId's action. Changes made with the role command, which pass an
+// adminId of zero, have no actor to audit and aren't.
+func (db *DB) SetUserRole(userId int, role string, adminId int) (User, error) {
+	if !ValidRole(role) {
+		return User{}, fmt.Errorf("unknown role %q", role)
+	}
+
+	var updated User
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			return errors.New("user not found")
+		}
+		if user.Role != role && adminId != 0 {
+			audit(dbStructure, tx, roleChangeEntry(userId, user.Role, role, adminId))
+		}
+		user.Role = role
+		tx.put("users", user.Id, user)
+		updated = user
+		updated.Password = ""
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrSessionNotFound means the session doesn't exist or belongs to
+// another user
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is one login: where it came from, when it was last refreshed
+// and when its refresh token runs out. The refresh tokens rotated from the
+// one issued at login all belong to it; revoking the session invalidates
+// all of them. Sessions from before this was recorded have no device, IP
+// or expiry.
+type Session struct {
+	Id         int       `json:"id"`
+	UserId     int       `json:"user_id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+func (s Session) revoked() bool {
+	return !s.RevokedAt.IsZero()
+}
+
+// Active reports whether the session can still be used at now
+func (s Session) Active(now time.Time) bool {
+	return !s.revoked() && (s.ExpiresAt.IsZero() || now.Before(s.ExpiresAt))
+}
+
+// CreateSession records a new login of session.UserId
+func (db *DB) CreateSession(session Session) (Session, error) {
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		if _, ok := dbStructure.Users[session.UserId]; !ok {
+			return errors.New("user not found")
+		}
+		now := time.Now().UTC()
+		session.Id = tx.nextId(dbStructure, "sessions")
+		session.CreatedAt = now
+		session.LastUsedAt = now
+		session.RevokedAt = time.Time{}
+		tx.put("sessions", session.Id, session)
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// GetSession returns session sessionId, revoked or not
+func (db *DB) GetSession(sessionId int) (Session, error) {
+	var session Session
+	err := db.view(func(dbStructure DBStructure) error {
+		var ok bool
+		session, ok = dbStructure.Sessions[sessionId]
+		if !ok {
+			return ErrSessionNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// GetSessions returns the active sessions of userId, most recently used
+// first
+func (db *DB) GetSessions(userId int) ([]Session, error) {
+	sessions := []Session{}
+	err := db.view(func(dbStructure DBStructure) error {
+		now := time.Now()
+		for _, session := range dbStructure.Sessions {
+			if session.UserId == userId && session.Active(now) {
+				sessions = append(sessions, session)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []Session{}, err
+	}
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].Id > sessions[j].Id
+	})
+}
+
+// TouchSession records that sessionId was just used
+func (db *DB) TouchSession(sessionId int) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		session, ok := dbStructure.Sessions[sessionId]
+		if !ok {
+			return ErrSessionNotFound
+		}
+		session.LastUsedAt = time.Now().UTC()
+		tx.put("sessions", session.Id, session)
+		return nil
+	})
+}
+
+// RevokeSession logs userId's session sessionId out. Revoking a session
+// twice is not an error.
+func (db *DB) RevokeSession(userId int, sessionId int) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		session, ok := dbStructure.Sessions[sessionId]
+		if !ok || session.UserId != userId {
+			return ErrSessionNotFound
+		}
+		if !session.revoked() {
+			session.RevokedAt = time.Now().UTC()
+			tx.put("sessions", session.Id, session)
+		}
+		return nil
+	})
+}
+
+// RevokeSessions logs userId out everywhere and returns how many sessions
+// that ended. Personal access tokens aren't logins and keep working; they
+// are revoked one by one, or all at once by a password reset.
+func (db *DB) RevokeSessions(userId int) (int, error) {
+	var n int
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		n = revokeUserSessions(dbStructure, tx, userId)
+		return nil
+	})
+
+	return n, err
+}
+
+// revokeUserSessions revokes every session of userId as part of tx
+func revokeUserSessions(dbStructure DBStructure, tx *tx, userId int) int {
+	n := 0
+	now := time.Now().UTC()
+	for _, session := range dbStructure.Sessions {
+		if session.UserId == userId && !session.revoked() {
+			session.RevokedAt = now
+			tx.put("sessions", session.Id, session)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,804 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jming514/chirpy/internals/entities"
+	"github.com/jming514/chirpy/internals/password"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDB is a Store backed by an embedded SQLite database
+type SQLiteDB struct {
+	db     *sql.DB
+	hasher *password.Hasher
+}
+
+type sqliteMigration struct {
+	Migration
+	sql string
+}
+
+// sqliteMigrations is the ordered registry of SQLite schema changes. The
+// applied version is kept in PRAGMA user_version. Append new steps at the
+// end; never edit or reorder released ones.
+var sqliteMigrations = []sqliteMigration{
+	{
+		Migration: Migration{Version: 1, Description: "create users, chirps and revoked_tokens"},
+		sql: `
+CREATE TABLE IF NOT EXISTS users (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	email         TEXT    NOT NULL UNIQUE,
+	password      TEXT    NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS chirps (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	author_id INTEGER NOT NULL REFERENCES users (id),
+	body      TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS chirps_author_id ON chirps (author_id);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	token       TEXT PRIMARY KEY,
+	revoke_time TEXT NOT NULL
+);
+`,
+	},
+	{
+		Migration: Migration{Version: 2, Description: "add refresh token families"},
+		sql: `
+CREATE TABLE token_families (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id    INTEGER  NOT NULL REFERENCES users (id),
+	created_at DATETIME NOT NULL,
+	revoked_at DATETIME
+);
+
+CREATE TABLE refresh_tokens (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	token_hash  TEXT     NOT NULL UNIQUE,
+	family_id   INTEGER  NOT NULL REFERENCES token_families (id),
+	created_at  DATETIME NOT NULL,
+	expires_at  DATETIME,
+	replaced_by INTEGER REFERENCES refresh_tokens (id)
+);
+CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id);
+`,
+	},
+	{
+		Migration: Migration{Version: 3, Description: "add user roles"},
+		sql: `
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+`,
+	},
+	{
+		Migration: Migration{Version: 4, Description: "add reply threads"},
+		sql: `
+ALTER TABLE chirps ADD COLUMN parent_id INTEGER REFERENCES chirps (id);
+ALTER TABLE chirps ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX chirps_parent_id ON chirps (parent_id);
+`,
+	},
+	{
+		Migration: Migration{Version: 5, Description: "add follows"},
+		sql: `
+CREATE TABLE follows (
+	follower_id INTEGER  NOT NULL REFERENCES users (id),
+	followee_id INTEGER  NOT NULL REFERENCES users (id),
+	created_at  DATETIME NOT NULL,
+	PRIMARY KEY (follower_id, followee_id)
+);
+CREATE INDEX follows_followee_id ON follows (followee_id);
+`,
+	},
+	{
+		Migration: Migration{Version: 6, Description: "add chirp creation times, hashtags and mentions"},
+		sql: `
+ALTER TABLE chirps ADD COLUMN created_at DATETIME;
+ALTER TABLE chirps ADD COLUMN entities TEXT;
+CREATE INDEX chirps_created_at ON chirps (created_at);
+
+CREATE TABLE chirp_tags (
+	chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	tag      TEXT    NOT NULL,
+	PRIMARY KEY (tag, chirp_id)
+);
+CREATE INDEX chirp_tags_chirp_id ON chirp_tags (chirp_id);
+
+CREATE TABLE chirp_mentions (
+	chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	user_id  INTEGER NOT NULL REFERENCES users (id),
+	PRIMARY KEY (user_id, chirp_id)
+);
+CREATE INDEX chirp_mentions_chirp_id ON chirp_mentions (chirp_id);
+`,
+	},
+	{
+		Migration: Migration{Version: 7, Description: "add likes and rechirps"},
+		sql: `
+CREATE TABLE likes (
+	chirp_id   INTEGER  NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	user_id    INTEGER  NOT NULL REFERENCES users (id),
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (chirp_id, user_id)
+);
+
+CREATE TABLE rechirps (
+	chirp_id   INTEGER  NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	user_id    INTEGER  NOT NULL REFERENCES users (id),
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (chirp_id, user_id)
+);
+CREATE INDEX rechirps_user_id ON rechirps (user_id);
+`,
+	},
+	{
+		Migration: Migration{Version: 8, Description: "record moderation findings on chirps"},
+		sql:       `ALTER TABLE chirps ADD COLUMN moderation TEXT;`,
+	},
+	{
+		Migration: Migration{Version: 9, Description: "add reports, the audit log, hidden chirps and suspensions"},
+		sql: `
+ALTER TABLE chirps ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE users ADD COLUMN suspension_reason TEXT;
+ALTER TABLE users ADD COLUMN suspended_at DATETIME;
+ALTER TABLE users ADD COLUMN suspended_until DATETIME;
+ALTER TABLE users ADD COLUMN suspended_by INTEGER REFERENCES users (id);
+
+-- reports outlive their chirp, so chirp_id has no foreign key
+CREATE TABLE reports (
+	id          INTEGER  PRIMARY KEY,
+	chirp_id    INTEGER  NOT NULL,
+	author_id   INTEGER  NOT NULL REFERENCES users (id),
+	reporter_id INTEGER  NOT NULL REFERENCES users (id),
+	reason      TEXT     NOT NULL,
+	status      TEXT     NOT NULL,
+	claimed_by  INTEGER  REFERENCES users (id),
+	resolution  TEXT,
+	note        TEXT,
+	created_at  DATETIME NOT NULL,
+	updated_at  DATETIME NOT NULL
+);
+CREATE INDEX reports_status ON reports (status, id);
+
+CREATE TABLE audit_log (
+	id          INTEGER  PRIMARY KEY,
+	actor_id    INTEGER  NOT NULL REFERENCES users (id),
+	action      TEXT     NOT NULL,
+	target_type TEXT     NOT NULL,
+	target_id   INTEGER  NOT NULL,
+	detail      TEXT     NOT NULL,
+	created_at  DATETIME NOT NULL
+);
+`,
+	},
+	{
+		Migration: Migration{Version: 10, Description: "add login throttles and notifications"},
+		sql: `
+CREATE TABLE login_throttles (
+	key          TEXT     PRIMARY KEY,
+	failures     INTEGER  NOT NULL,
+	lockouts     INTEGER  NOT NULL,
+	last_failure DATETIME NOT NULL,
+	locked_until DATETIME
+);
+
+CREATE TABLE notifications (
+	id         INTEGER  PRIMARY KEY,
+	user_id    INTEGER  NOT NULL REFERENCES users (id),
+	kind       TEXT     NOT NULL,
+	message    TEXT     NOT NULL,
+	created_at DATETIME NOT NULL
+);
+CREATE INDEX notifications_user ON notifications (user_id, id);
+`,
+	},
+	{
+		Migration: Migration{Version: 11, Description: "add totp enrollments and recovery codes"},
+		sql: `
+CREATE TABLE totp (
+	user_id      INTEGER  PRIMARY KEY REFERENCES users (id),
+	secret       TEXT     NOT NULL,
+	created_at   DATETIME NOT NULL,
+	confirmed_at DATETIME,
+	last_counter INTEGER  NOT NULL
+);
+
+CREATE TABLE recovery_codes (
+	user_id   INTEGER NOT NULL REFERENCES users (id),
+	code_hash TEXT    NOT NULL,
+	PRIMARY KEY (user_id, code_hash)
+);
+`,
+	},
+	{
+		Migration: Migration{Version: 12, Description: "add email verification and used mail tokens"},
+		sql: `
+ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE used_tokens (
+	token_hash TEXT     PRIMARY KEY,
+	used_at    DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL
+);
+`,
+	},
+	{
+		Migration: Migration{Version: 13, Description: "turn token families into sessions that record where and when they are used"},
+		sql: `
+ALTER TABLE token_families RENAME TO sessions;
+ALTER TABLE sessions ADD COLUMN device TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN last_used_at DATETIME;
+ALTER TABLE sessions ADD COLUMN expires_at DATETIME;
+CREATE INDEX sessions_user_id ON sessions (user_id);
+
+ALTER TABLE refresh_tokens RENAME COLUMN family_id TO session_id;
+DROP INDEX refresh_tokens_family_id;
+CREATE INDEX refresh_tokens_session_id ON refresh_tokens (session_id);
+`,
+	},
+	{
+		Migration: Migration{Version: 14, Description: "add personal access tokens"},
+		sql: `
+CREATE TABLE personal_tokens (
+	id           INTEGER  PRIMARY KEY AUTOINCREMENT,
+	user_id      INTEGER  NOT NULL REFERENCES users (id),
+	name         TEXT     NOT NULL,
+	scopes       TEXT     NOT NULL DEFAULT '',
+	token_hash   TEXT     NOT NULL UNIQUE,
+	created_at   DATETIME NOT NULL,
+	last_used_at DATETIME,
+	expires_at   DATETIME,
+	revoked_at   DATETIME
+);
+CREATE INDEX personal_tokens_user_id ON personal_tokens (user_id);
+`,
+	},
+	{
+		Migration: Migration{Version: 15, Description: "normalize email addresses"},
+		// lower() only folds ASCII; an address that differs from another
+		// only in case is left as it is
+		sql: `
+UPDATE OR IGNORE users SET email = lower(email) WHERE email != lower(email);
+`,
+	},
+}
+
+// NewSQLiteDB opens the SQLite database at path, creating the file if it
+// doesn't exist. Pending schema migrations are applied after backing the
+// database up.
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SQLiteDB{db: db, hasher: password.Default()}
+	_, err = s.migrate(path, MigrateOptions{Backup: true})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	return sql.Open("sqlite", dsn)
+}
+
+// migrate applies the pending migrations, each in its own transaction,
+// and returns them
+func (s *SQLiteDB) migrate(path string, opts MigrateOptions) ([]Migration, error) {
+	var version int
+	err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := sqliteMigrations[len(sqliteMigrations)-1].Version
+	if version > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than this build supports (%d)", version, latest)
+	}
+
+	var pending []Migration
+	for _, m := range sqliteMigrations {
+		if m.Version > version {
+			pending = append(pending, m.Migration)
+		}
+	}
+	if opts.DryRun || len(pending) == 0 {
+		return pending, nil
+	}
+
+	if opts.Backup && version > 0 {
+		backup := fmt.Sprintf("%s.v%d.bak", path, version)
+		os.Remove(backup)
+		_, err = s.db.Exec(`VACUUM INTO ?`, backup)
+		if err != nil {
+			return nil, fmt.Errorf("backing up before migrating: %w", err)
+		}
+		log.Printf("backed up %s to %s\n", path, backup)
+	}
+
+	for _, m := range sqliteMigrations {
+		if m.Version <= version {
+			continue
+		}
+		err = s.runMigration(m)
+		if err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		log.Printf("applied migration %d: %s\n", m.Version, m.Description)
+	}
+
+	return pending, nil
+}
+
+func (s *SQLiteDB) runMigration(m sqliteMigration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(m.sql)
+	if err != nil {
+		return err
+	}
+	// PRAGMA doesn't take bound parameters
+	_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.Version))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLite(path string, opts MigrateOptions) ([]Migration, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	s := &SQLiteDB{db: db}
+	return s.migrate(path, opts)
+}
+
+// Close closes the underlying database handle
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+// Login checks if user exists with password, and if so, returns the user.
+// A password stored in plaintext or with weaker hash settings than the
+// current ones is rehashed.
+func (s *SQLiteDB) Login(email, password string) (UserReturn, error) {
+	user, err := scanUser(s.db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE email = ?`, NormalizeEmail(email),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		s.hasher.VerifyMissing(password)
+		return UserReturn{}, errors.New("user not found")
+	}
+	if err != nil {
+		return UserReturn{}, err
+	}
+
+	ok, needsRehash, err := s.hasher.Verify(password, user.Password)
+	if err != nil {
+		return UserReturn{}, err
+	}
+	if !ok {
+		return UserReturn{}, errors.New("user not found")
+	}
+	if user.Suspension.Active(time.Now()) {
+		return UserReturn{}, ErrUserSuspended
+	}
+	if needsRehash {
+		err = s.rehashPassword(user, password)
+		if err != nil {
+			log.Printf("Error rehashing password for user %d: %s\n", user.Id, err)
+		}
+	}
+
+	return UserReturn{
+		Id:            user.Id,
+		Email:         user.Email,
+		Is_Chirpy_Red: user.Is_Chirpy_Red,
+		Role:          user.Role,
+		EmailVerified: user.EmailVerified,
+		Suspension:    user.Suspension,
+	}, nil
+}
+
+// rehashPassword replaces the stored hash of a user who just logged in,
+// unless the password was changed in the meantime
+func (s *SQLiteDB) rehashPassword(user User, password string) error {
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`UPDATE users SET password = ? WHERE id = ? AND password = ?`, hash, user.Id, user.Password)
+	return err
+}
+
+// CreateUser creates a new user
+func (s *SQLiteDB) CreateUser(email string, password string) (UserReturn, error) {
+	email = NormalizeEmail(email)
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return UserReturn{}, err
+	}
+
+	res, err := s.db.Exec(`INSERT INTO users (email, password) VALUES (?, ?)`, email, hash)
+	if isUniqueViolation(err) {
+		return UserReturn{}, errors.New("user already exists")
+	}
+	if err != nil {
+		return UserReturn{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return UserReturn{}, err
+	}
+
+	return UserReturn{
+		Id:    int(id),
+		Email: email,
+		Role:  RoleUser,
+	}, nil
+}
+
+// UpdateUser sets the email and password of user u.Id.
+// u.Password is the new plaintext password.
+func (s *SQLiteDB) UpdateUser(u User) (User, error) {
+	u.Email = NormalizeEmail(u.Email)
+	hash, err := s.hasher.Hash(u.Password)
+	if err != nil {
+		return User{}, err
+	}
+
+	// a new address has to be verified again
+	var role string
+	var verified bool
+	err = s.db.QueryRow(
+		`UPDATE users SET email = ?, password = ?, email_verified = email_verified AND email = ?
+		 WHERE id = ? RETURNING role, email_verified`, u.Email, hash, u.Email, u.Id,
+	).Scan(&role, &verified)
+	if isUniqueViolation(err) {
+		return User{}, errors.New("user already exists")
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("user not found")
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{
+		Id:            u.Id,
+		Email:         u.Email,
+		Role:          role,
+		EmailVerified: verified,
+	}, nil
+}
+
+func (s *SQLiteDB) UpgradeUser(obj UpgradeUserStruct) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET is_chirpy_red = 1 WHERE id = ?`, obj.Data.User_id)
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := scanUser(tx.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE id = ?`, obj.Data.User_id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("user not found")
+	}
+	if err != nil {
+		return User{}, err
+	}
+	user.Password = ""
+
+	return user, tx.Commit()
+}
+
+func (s *SQLiteDB) GetUser(v string) (User, error) {
+	id, err := strconv.Atoi(v)
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := scanUser(s.db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE id = ?`, id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("user does not exist")
+	}
+	user.Password = ""
+
+	return user, err
+}
+
+// GetUsers returns the users in the database, ordered by id
+func (s *SQLiteDB) GetUsers(page Page) ([]User, error) {
+	query, args := pageQuery(`SELECT `+userColumns+` FROM users WHERE true`, nil, "id", false, page)
+	users, err := s.queryUsers(query, args...)
+	reversePage(users, page)
+
+	return users, err
+}
+
+// CreateChirp saves a new chirp. The caller sets Author_Id, Body and
+// optionally Parent_Id and Entities; the id and creation time are filled
+// in.
+func (s *SQLiteDB) CreateChirp(chirp Chirp) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	var parent sql.NullInt64
+	if chirp.Parent_Id != 0 {
+		var exists bool
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0)`, chirp.Parent_Id).Scan(&exists)
+		if err != nil {
+			return Chirp{}, err
+		}
+		if !exists {
+			return Chirp{}, ErrParentChirpNotFound
+		}
+		parent = sql.NullInt64{Int64: int64(chirp.Parent_Id), Valid: true}
+	}
+
+	entitiesJSON, err := nullJSON(chirp.Entities, len(chirp.Entities))
+	if err != nil {
+		return Chirp{}, err
+	}
+	moderationJSON, err := nullJSON(chirp.Moderation, len(chirp.Moderation))
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	newChirp := Chirp{
+		Author_Id:  chirp.Author_Id,
+		Body:       chirp.Body,
+		Parent_Id:  chirp.Parent_Id,
+		Entities:   chirp.Entities,
+		Moderation: chirp.Moderation,
+		Created_At: time.Now().UTC(),
+	}
+	res, err := tx.Exec(
+		`INSERT INTO chirps (author_id, body, parent_id, entities, moderation, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		newChirp.Author_Id, newChirp.Body, parent, entitiesJSON, moderationJSON, newChirp.Created_At,
+	)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+	newChirp.Id = int(id)
+
+	for _, e := range chirp.Entities {
+		switch {
+		case e.Type == entities.Hashtag:
+			_, err = tx.Exec(`INSERT INTO chirp_tags (chirp_id, tag) VALUES (?, ?) ON CONFLICT DO NOTHING`, id, e.Text)
+		case e.Type == entities.Mention && e.UserId != 0:
+			_, err = tx.Exec(`INSERT INTO chirp_mentions (chirp_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING`, id, e.UserId)
+		}
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+
+	return newChirp, tx.Commit()
+}
+
+func (s *SQLiteDB) GetChirp(v string) (Chirp, error) {
+	id, err := strconv.Atoi(v)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp, err := scanChirp(s.db.QueryRow(`SELECT `+chirpColumns+` FROM chirps c WHERE c.id = ? AND c.deleted = 0 AND c.hidden = 0`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, errors.New("chirp does not exist")
+	}
+
+	return chirp, err
+}
+
+// GetChirps returns the chirps in the database selected by options
+func (s *SQLiteDB) GetChirps(options Options) ([]Chirp, error) {
+	query := `SELECT ` + chirpColumns + ` FROM chirps c WHERE c.deleted = 0 AND c.hidden = 0`
+	var args []any
+	if options.AuthorId != 0 {
+		query += ` AND c.author_id = ?`
+		args = append(args, options.AuthorId)
+	}
+	if options.Tag != "" {
+		query += ` AND c.id IN (SELECT chirp_id FROM chirp_tags WHERE tag = ?)`
+		args = append(args, options.Tag)
+	}
+	if options.MentionedUserId != 0 {
+		query += ` AND c.id IN (SELECT chirp_id FROM chirp_mentions WHERE user_id = ?)`
+		args = append(args, options.MentionedUserId)
+	}
+	if options.AuthorIds != nil {
+		query += ` AND c.author_id IN (SELECT value FROM json_each(?))`
+		ids, err := json.Marshal(options.AuthorIds)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		args = append(args, string(ids))
+	}
+	if options.Ids != nil {
+		query += ` AND c.id IN (SELECT value FROM json_each(?))`
+		ids, err := json.Marshal(options.Ids)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		args = append(args, string(ids))
+	}
+	query, args = pageQuery(query, args, "c.id", options.Sorting == "desc", options.Page)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+
+	var respSlice []Chirp
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		respSlice = append(respSlice, chirp)
+	}
+	reversePage(respSlice, options.Page)
+
+	return respSlice, rows.Err()
+}
+
+// RevokeToken blacklists token and, if it is a refresh token, revokes
+// its session
+func (s *SQLiteDB) RevokeToken(token string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO revoked_tokens (token, revoke_time) VALUES (?, ?) ON CONFLICT (token) DO NOTHING`,
+		token, time.Now().String(),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`UPDATE sessions SET revoked_at = ?
+		 WHERE revoked_at IS NULL
+		   AND id = (SELECT session_id FROM refresh_tokens WHERE token_hash = ?)`,
+		time.Now().UTC(), hashToken(token),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) IsTokenRevoked(token string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE token = ?)`, token).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// userColumns selects a User from users, for scanUser
+const userColumns = `id, email, password, is_chirpy_red, role, email_verified,
+	suspension_reason, suspended_at, suspended_until, suspended_by`
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var reason sql.NullString
+	var at, until sql.NullTime
+	var by sql.NullInt64
+	err := row.Scan(&user.Id, &user.Email, &user.Password, &user.Is_Chirpy_Red, &user.Role, &user.EmailVerified, &reason, &at, &until, &by)
+	if err != nil {
+		return user, err
+	}
+	if at.Valid {
+		user.Suspension = &Suspension{Reason: reason.String, By: int(by.Int64), At: at.Time}
+		if until.Valid {
+			user.Suspension.Until = &until.Time
+		}
+	}
+	return user, nil
+}
+
+// chirpColumns selects a Chirp from chirps aliased as c, for scanChirp
+const chirpColumns = `c.id, c.author_id, c.body, COALESCE(c.parent_id, 0), c.deleted, c.hidden,
+	(SELECT COUNT(*) FROM chirps r WHERE r.parent_id = c.id AND r.deleted = 0),
+	(SELECT COUNT(*) FROM likes l WHERE l.chirp_id = c.id),
+	(SELECT COUNT(*) FROM rechirps rc WHERE rc.chirp_id = c.id),
+	c.entities, c.moderation, c.created_at`
+
+func scanChirp(row rowScanner) (Chirp, error) {
+	var chirp Chirp
+	var entitiesJSON, moderationJSON sql.NullString
+	var createdAt sql.NullTime
+	err := row.Scan(
+		&chirp.Id, &chirp.Author_Id, &chirp.Body, &chirp.Parent_Id, &chirp.Deleted, &chirp.Hidden, &chirp.Reply_Count,
+		&chirp.Like_Count, &chirp.Rechirp_Count, &entitiesJSON, &moderationJSON, &createdAt,
+	)
+	if err != nil {
+		return chirp, err
+	}
+	if entitiesJSON.Valid {
+		err = json.Unmarshal([]byte(entitiesJSON.String), &chirp.Entities)
+		if err != nil {
+			return chirp, err
+		}
+	}
+	if moderationJSON.Valid {
+		err = json.Unmarshal([]byte(moderationJSON.String), &chirp.Moderation)
+	}
+	chirp.Created_At = createdAt.Time
+	return chirp, err
+}
+
+// isUniqueViolation reports whether err came from a UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// nullJSON encodes v for a nullable JSON column, or NULL when n is 0
+func nullJSON(v any, n int) (sql.NullString, error) {
+	if n == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
@@ -0,0 +1,44 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// auditTx adds entry to the audit log as part of tx
+func auditTx(tx *sql.Tx, entry AuditEntry) error {
+	_, err := tx.Exec(
+		`INSERT INTO audit_log (actor_id, action, target_type, target_id, detail, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		entry.ActorId, entry.Action, entry.TargetType, entry.TargetId, entry.Detail, time.Now().UTC(),
+	)
+	return err
+}
+
+// GetAuditLog returns the audit log, newest first
+func (s *SQLiteDB) GetAuditLog(page Page) ([]AuditEntry, error) {
+	query, args := pageQuery(
+		`SELECT id, actor_id, action, target_type, target_id, detail, created_at FROM audit_log WHERE true`,
+		nil, "id", true, page,
+	)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		err = rows.Scan(&e.Id, &e.ActorId, &e.Action, &e.TargetType, &e.TargetId, &e.Detail, &e.CreatedAt)
+		if err != nil {
+			return []AuditEntry{}, err
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return []AuditEntry{}, err
+	}
+	reversePage(entries, page)
+
+	return entries, nil
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Follow makes followerId follow followeeId. Following someone twice is
+// not an error.
+func (s *SQLiteDB) Follow(followerId int, followeeId int) error {
+	if followerId == followeeId {
+		return errors.New("users can't follow themselves")
+	}
+
+	_, err := s.db.Exec(
+		`INSERT INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)
+		 ON CONFLICT (follower_id, followee_id) DO NOTHING`,
+		followerId, followeeId, time.Now().UTC(),
+	)
+	if err != nil && strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+		return errors.New("user not found")
+	}
+
+	return err
+}
+
+// Unfollow makes followerId stop following followeeId. Unfollowing someone
+// who isn't followed is not an error.
+func (s *SQLiteDB) Unfollow(followerId int, followeeId int) error {
+	_, err := s.db.Exec(`DELETE FROM follows WHERE follower_id = ? AND followee_id = ?`, followerId, followeeId)
+	return err
+}
+
+// GetFollowers returns the users following userId, ordered by id
+func (s *SQLiteDB) GetFollowers(userId int, page Page) ([]User, error) {
+	query, args := pageQuery(
+		`SELECT `+userColumns+`
+		 FROM follows f JOIN users u ON u.id = f.follower_id
+		 WHERE f.followee_id = ?`, []any{userId}, "u.id", false, page,
+	)
+	users, err := s.queryUsers(query, args...)
+	reversePage(users, page)
+
+	return users, err
+}
+
+// GetFollowing returns the users userId follows, ordered by id
+func (s *SQLiteDB) GetFollowing(userId int, page Page) ([]User, error) {
+	query, args := pageQuery(
+		`SELECT `+userColumns+`
+		 FROM follows f JOIN users u ON u.id = f.followee_id
+		 WHERE f.follower_id = ?`, []any{userId}, "u.id", false, page,
+	)
+	users, err := s.queryUsers(query, args...)
+	reversePage(users, page)
+
+	return users, err
+}
+
+// queryUsers runs a query selecting users, without their passwords
+func (s *SQLiteDB) queryUsers(query string, args ...any) ([]User, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []User{}, err
+	}
+	defer rows.Close()
+
+	respSlice := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return []User{}, err
+		}
+		user.Password = ""
+		respSlice = append(respSlice, user)
+	}
+
+	return respSlice, rows.Err()
+}
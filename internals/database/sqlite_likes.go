@@ -0,0 +1,83 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LikeChirp makes userId like chirpId and returns the chirp. Liking a
+// chirp twice is not an error.
+func (s *SQLiteDB) LikeChirp(userId int, chirpId int) (Chirp, error) {
+	return s.engage("likes", userId, chirpId, true)
+}
+
+// UnlikeChirp takes back userId's like of chirpId and returns the chirp.
+// Unliking a chirp that isn't liked is not an error.
+func (s *SQLiteDB) UnlikeChirp(userId int, chirpId int) (Chirp, error) {
+	return s.engage("likes", userId, chirpId, false)
+}
+
+// Rechirp makes userId rechirp chirpId and returns the chirp. Rechirping
+// a chirp twice is not an error.
+func (s *SQLiteDB) Rechirp(userId int, chirpId int) (Chirp, error) {
+	return s.engage("rechirps", userId, chirpId, true)
+}
+
+// Unrechirp takes back userId's rechirp of chirpId and returns the chirp.
+// Undoing a rechirp that wasn't made is not an error.
+func (s *SQLiteDB) Unrechirp(userId int, chirpId int) (Chirp, error) {
+	return s.engage("rechirps", userId, chirpId, false)
+}
+
+// engage adds (on) or removes userId's like or rechirp of chirpId. The
+// counts are read from the tables themselves, so they can't drift.
+func (s *SQLiteDB) engage(table string, userId int, chirpId int, on bool) (Chirp, error) {
+	var err error
+	if on {
+		_, err = s.db.Exec(
+			`INSERT INTO `+table+` (chirp_id, user_id, created_at)
+			 SELECT id, ?, ? FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0
+			 ON CONFLICT (chirp_id, user_id) DO NOTHING`,
+			userId, time.Now().UTC(), chirpId,
+		)
+	} else {
+		_, err = s.db.Exec(`DELETE FROM `+table+` WHERE chirp_id = ? AND user_id = ?`, chirpId, userId)
+	}
+	if err != nil && strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+		return Chirp{}, errors.New("user not found")
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp, err := s.GetChirp(strconv.Itoa(chirpId))
+	if err != nil {
+		return Chirp{}, ErrChirpNotFound
+	}
+
+	return chirp, nil
+}
+
+// GetLikers returns the users who liked chirpId, ordered by id
+func (s *SQLiteDB) GetLikers(chirpId int, page Page) ([]User, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0)`, chirpId).Scan(&exists)
+	if err != nil {
+		return []User{}, err
+	}
+	if !exists {
+		return []User{}, ErrChirpNotFound
+	}
+
+	query, args := pageQuery(
+		`SELECT `+userColumns+`
+		 FROM likes l JOIN users u ON u.id = l.user_id
+		 WHERE l.chirp_id = ?`, []any{chirpId}, "u.id", false, page,
+	)
+	users, err := s.queryUsers(query, args...)
+	reversePage(users, page)
+
+	return users, err
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const throttleColumns = `key, failures, lockouts, last_failure, locked_until`
+
+func scanThrottle(row rowScanner) (LoginThrottle, error) {
+	var t LoginThrottle
+	var until sql.NullTime
+	err := row.Scan(&t.Key, &t.Failures, &t.Lockouts, &t.LastFailure, &until)
+	if err != nil {
+		return t, err
+	}
+	if until.Valid {
+		t.LockedUntil = &until.Time
+	}
+	return t, nil
+}
+
+// GetLoginThrottle returns the failed logins recorded for key. A key
+// without any has an empty throttle.
+func (s *SQLiteDB) GetLoginThrottle(key string) (LoginThrottle, error) {
+	t, err := scanThrottle(s.db.QueryRow(`SELECT `+throttleColumns+` FROM login_throttles WHERE key = ?`, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginThrottle{Key: key}, nil
+	}
+	return t, err
+}
+
+// RecordLoginFailure adds a failed login to key under policy. locked
+// reports whether this failure locked the key out. Expired throttles of
+// the same kind of key are removed on the way.
+func (s *SQLiteDB) RecordLoginFailure(key string, policy LockoutPolicy) (LoginThrottle, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return LoginThrottle{}, false, err
+	}
+	defer tx.Rollback()
+
+	// writing first takes the write lock, so concurrent failures can't
+	// both read the same count
+	now := time.Now().UTC()
+	_, err = tx.Exec(
+		`DELETE FROM login_throttles WHERE key LIKE ? AND key != ? AND last_failure < ?
+		 AND (locked_until IS NULL OR locked_until <= ?)`,
+		throttleKind(key)+":%", key, now.Add(-policy.Window), now,
+	)
+	if err != nil {
+		return LoginThrottle{}, false, err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO login_throttles (key, failures, lockouts, last_failure) VALUES (?, 0, 0, ?)
+		 ON CONFLICT (key) DO NOTHING`, key, time.Time{},
+	)
+	if err != nil {
+		return LoginThrottle{}, false, err
+	}
+	throttle, err := scanThrottle(tx.QueryRow(`SELECT `+throttleColumns+` FROM login_throttles WHERE key = ?`, key))
+	if err != nil {
+		return LoginThrottle{}, false, err
+	}
+
+	locked := throttle.fail(policy, now)
+	_, err = tx.Exec(
+		`UPDATE login_throttles SET failures = ?, lockouts = ?, last_failure = ?, locked_until = ? WHERE key = ?`,
+		throttle.Failures, throttle.Lockouts, throttle.LastFailure, throttle.LockedUntil, key,
+	)
+	if err != nil {
+		return LoginThrottle{}, false, err
+	}
+
+	return throttle, locked, tx.Commit()
+}
+
+// ClearLoginThrottle forgets the failed logins of key
+func (s *SQLiteDB) ClearLoginThrottle(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_throttles WHERE key = ?`, key)
+	return err
+}
+
+// UnlockUser forgets the failed logins of userId's account, lifting any
+// lockout, and audits it as adminId's action
+func (s *SQLiteDB) UnlockUser(userId int, adminId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRow(`SELECT email FROM users WHERE id = ?`, userId).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("user not found")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM login_throttles WHERE key = ?`, AccountThrottleKey(email))
+	if err != nil {
+		return err
+	}
+	err = auditTx(tx, AuditEntry{ActorId: adminId, Action: "user.unlock", TargetType: TargetUser, TargetId: userId})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,46 @@
+package database
+
+import "time"
+
+// AddNotification records a notification on userId's account
+func (s *SQLiteDB) AddNotification(userId int, kind string, message string) (Notification, error) {
+	n := Notification{UserId: userId, Kind: kind, Message: message, CreatedAt: time.Now().UTC()}
+	err := s.db.QueryRow(
+		`INSERT INTO notifications (user_id, kind, message, created_at) VALUES (?, ?, ?, ?) RETURNING id`,
+		n.UserId, n.Kind, n.Message, n.CreatedAt,
+	).Scan(&n.Id)
+	if err != nil {
+		return Notification{}, err
+	}
+
+	return n, nil
+}
+
+// GetNotifications returns the notifications of userId, newest first
+func (s *SQLiteDB) GetNotifications(userId int, page Page) ([]Notification, error) {
+	query, args := pageQuery(
+		`SELECT id, user_id, kind, message, created_at FROM notifications WHERE user_id = ?`,
+		[]any{userId}, "id", true, page,
+	)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []Notification{}, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		err = rows.Scan(&n.Id, &n.UserId, &n.Kind, &n.Message, &n.CreatedAt)
+		if err != nil {
+			return []Notification{}, err
+		}
+		notifications = append(notifications, n)
+	}
+	if err = rows.Err(); err != nil {
+		return []Notification{}, err
+	}
+	reversePage(notifications, page)
+
+	return notifications, nil
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// personalTokenColumns selects a PersonalToken, for scanPersonalToken.
+// Scopes are stored space separated, as in a token's scope claim.
+const personalTokenColumns = `id, user_id, name, scopes, token_hash, created_at, last_used_at, expires_at, revoked_at`
+
+func scanPersonalToken(row rowScanner) (PersonalToken, error) {
+	var token PersonalToken
+	var scopes string
+	var lastUsedAt, expiresAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&token.Id, &token.UserId, &token.Name, &scopes, &token.TokenHash,
+		&token.CreatedAt, &lastUsedAt, &expiresAt, &revokedAt,
+	)
+	if err != nil {
+		return token, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	token.LastUsedAt = lastUsedAt.Time
+	token.ExpiresAt = expiresAt.Time
+	token.RevokedAt = revokedAt.Time
+	return token, nil
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// CreatePersonalToken stores token for token.UserId under the hash of
+// secret
+func (s *SQLiteDB) CreatePersonalToken(token PersonalToken, secret string) (PersonalToken, error) {
+	created, err := scanPersonalToken(s.db.QueryRow(
+		`INSERT INTO personal_tokens (user_id, name, scopes, token_hash, created_at, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?) RETURNING `+personalTokenColumns,
+		token.UserId, token.Name, strings.Join(token.Scopes, " "), hashToken(secret),
+		time.Now().UTC(), nullTime(token.ExpiresAt),
+	))
+	if err != nil {
+		return PersonalToken{}, err
+	}
+
+	return created, nil
+}
+
+// GetPersonalToken returns the token whose secret is secret, revoked or not
+func (s *SQLiteDB) GetPersonalToken(secret string) (PersonalToken, error) {
+	token, err := scanPersonalToken(s.db.QueryRow(
+		`SELECT `+personalTokenColumns+` FROM personal_tokens WHERE token_hash = ?`, hashToken(secret),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return PersonalToken{}, ErrPersonalTokenNotFound
+	}
+	if err != nil {
+		return PersonalToken{}, err
+	}
+
+	return token, nil
+}
+
+// GetPersonalTokens returns the active tokens of userId, newest first
+func (s *SQLiteDB) GetPersonalTokens(userId int) ([]PersonalToken, error) {
+	rows, err := s.db.Query(
+		`SELECT `+personalTokenColumns+` FROM personal_tokens
+		 WHERE user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)
+		 ORDER BY id DESC`,
+		userId, time.Now().UTC(),
+	)
+	if err != nil {
+		return []PersonalToken{}, err
+	}
+	defer rows.Close()
+
+	tokens := []PersonalToken{}
+	for rows.Next() {
+		token, err := scanPersonalToken(rows)
+		if err != nil {
+			return []PersonalToken{}, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		return []PersonalToken{}, err
+	}
+
+	return tokens, nil
+}
+
+// TouchPersonalToken records that token tokenId was just used
+func (s *SQLiteDB) TouchPersonalToken(tokenId int) error {
+	res, err := s.db.Exec(`UPDATE personal_tokens SET last_used_at = ? WHERE id = ?`, time.Now().UTC(), tokenId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPersonalTokenNotFound
+	}
+	return nil
+}
+
+// RevokePersonalToken revokes userId's token tokenId. Revoking a token
+// twice is not an error.
+func (s *SQLiteDB) RevokePersonalToken(userId int, tokenId int) error {
+	res, err := s.db.Exec(
+		`UPDATE personal_tokens SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ? AND user_id = ?`,
+		time.Now().UTC(), tokenId, userId,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPersonalTokenNotFound
+	}
+	return nil
+}
+
+// revokeUserPersonalTokensTx revokes every personal access token of
+// userId as part of tx
+func revokeUserPersonalTokensTx(tx *sql.Tx, userId int) error {
+	_, err := tx.Exec(
+		`UPDATE personal_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`,
+		time.Now().UTC(), userId,
+	)
+	return err
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// CreateRefreshToken stores the refresh token issued at login as the first
+// token of sessionId
+func (s *SQLiteDB) CreateRefreshToken(sessionId int, token string, expiresAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE sessions SET expires_at = ? WHERE id = ?`, expiresAt.UTC(), sessionId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	_, err = tx.Exec(
+		`INSERT INTO refresh_tokens (token_hash, session_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		hashToken(token), sessionId, time.Now().UTC(), expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RotateRefreshToken replaces rotation.OldToken with a new token minted for
+// its session and returns the session id and the new token. If the old
+// token was already rotated, the whole session is revoked and
+// ErrRefreshTokenReused is returned. A token that belongs to another
+// session or user is refused.
+//
+// A token from before sessions names none. If the store knows it, it
+// stays in the session it was recorded in, once its token family;
+// otherwise it starts rotation.NewSession. Either way that happens in the
+// same transaction as the rotation, so a refused rotation leaves nothing
+// behind.
+func (s *SQLiteDB) RotateRefreshToken(rotation Rotation) (int, string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	oldHash := hashToken(rotation.OldToken)
+	var oldId, oldSessionId int
+	var replacedBy sql.NullInt64
+	err = tx.QueryRow(
+		`SELECT id, session_id, replaced_by FROM refresh_tokens WHERE token_hash = ?`, oldHash,
+	).Scan(&oldId, &oldSessionId, &replacedBy)
+	found := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, "", err
+	}
+
+	sessionId := rotation.SessionId
+	if sessionId == 0 && found {
+		sessionId = oldSessionId
+	}
+	if sessionId == 0 {
+		session := rotation.NewSession
+		err = tx.QueryRow(
+			`INSERT INTO sessions (user_id, device, ip, user_agent, created_at, last_used_at)
+			 VALUES (?, ?, ?, ?, ?, ?) RETURNING id`,
+			rotation.UserId, session.Device, session.IP, session.UserAgent, now, now,
+		).Scan(&sessionId)
+		if err != nil {
+			return 0, "", err
+		}
+	} else {
+		var ownerId int
+		var revokedAt sql.NullTime
+		err = tx.QueryRow(`SELECT user_id, revoked_at FROM sessions WHERE id = ?`, sessionId).Scan(&ownerId, &revokedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "", ErrRefreshTokenRevoked
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		if ownerId != rotation.UserId || (found && oldSessionId != sessionId) || revokedAt.Valid {
+			return 0, "", ErrRefreshTokenRevoked
+		}
+	}
+
+	if !found {
+		res, err := tx.Exec(
+			`INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES (?, ?, ?)`,
+			oldHash, sessionId, now,
+		)
+		if err != nil {
+			return 0, "", err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, "", err
+		}
+		oldId = int(id)
+	}
+
+	if replacedBy.Valid {
+		_, err = tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE id = ?`, now, sessionId)
+		if err != nil {
+			return 0, "", err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return 0, "", err
+		}
+		return sessionId, "", ErrRefreshTokenReused
+	}
+
+	newToken, err := rotation.Mint(sessionId)
+	if err != nil {
+		return 0, "", err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO refresh_tokens (token_hash, session_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		hashToken(newToken), sessionId, now, rotation.ExpiresAt,
+	)
+	if err != nil {
+		return 0, "", err
+	}
+	newId, err := res.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	_, err = tx.Exec(`UPDATE refresh_tokens SET replaced_by = ? WHERE id = ?`, newId, oldId)
+	if err != nil {
+		return 0, "", err
+	}
+	_, err = tx.Exec(
+		`UPDATE sessions SET last_used_at = ?, expires_at = ? WHERE id = ?`,
+		now, rotation.ExpiresAt.UTC(), sessionId,
+	)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return sessionId, newToken, tx.Commit()
+}
@@ -0,0 +1,209 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// reportColumns selects a Report from reports, for scanReport
+const reportColumns = `id, chirp_id, author_id, reporter_id, reason, status,
+	COALESCE(claimed_by, 0), COALESCE(resolution, ''), COALESCE(note, ''), created_at, updated_at`
+
+func scanReport(row rowScanner) (Report, error) {
+	var r Report
+	err := row.Scan(
+		&r.Id, &r.ChirpId, &r.AuthorId, &r.ReporterId, &r.Reason, &r.Status,
+		&r.ClaimedBy, &r.Resolution, &r.Note, &r.CreatedAt, &r.UpdatedAt,
+	)
+	return r, err
+}
+
+// CreateReport files reporterId's report about chirpId. If they already
+// have an unresolved report about it, that one is returned instead.
+func (s *SQLiteDB) CreateReport(chirpId int, reporterId int, reason string) (Report, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Report{}, err
+	}
+	defer tx.Rollback()
+
+	var authorId int
+	err = tx.QueryRow(`SELECT author_id FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0`, chirpId).Scan(&authorId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Report{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Report{}, err
+	}
+
+	report, err := scanReport(tx.QueryRow(
+		`SELECT `+reportColumns+` FROM reports WHERE chirp_id = ? AND reporter_id = ? AND status != ?`,
+		chirpId, reporterId, ReportResolved,
+	))
+	if err == nil {
+		return report, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Report{}, err
+	}
+
+	now := time.Now().UTC()
+	report, err = scanReport(tx.QueryRow(
+		`INSERT INTO reports (chirp_id, author_id, reporter_id, reason, status, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING `+reportColumns,
+		chirpId, authorId, reporterId, reason, ReportOpen, now, now,
+	))
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, tx.Commit()
+}
+
+// GetReports returns the reports with status, or all of them when status
+// is empty, oldest first
+func (s *SQLiteDB) GetReports(status string, page Page) ([]Report, error) {
+	query := `SELECT ` + reportColumns + ` FROM reports WHERE true`
+	var args []any
+	if status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	query, args = pageQuery(query, args, "id", false, page)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []Report{}, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return []Report{}, err
+		}
+		reports = append(reports, r)
+	}
+	if err = rows.Err(); err != nil {
+		return []Report{}, err
+	}
+	reversePage(reports, page)
+
+	return reports, nil
+}
+
+// lockedReport reads reportId in tx and checks moderatorId may act on it
+func lockedReport(tx *sql.Tx, reportId int, moderatorId int) (Report, error) {
+	report, err := scanReport(tx.QueryRow(`SELECT `+reportColumns+` FROM reports WHERE id = ?`, reportId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Report{}, ErrReportNotFound
+	}
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, checkClaim(report, moderatorId)
+}
+
+// ClaimReport assigns reportId to moderatorId so other moderators leave it
+// alone. Claiming a report twice is not an error.
+func (s *SQLiteDB) ClaimReport(reportId int, moderatorId int) (Report, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Report{}, err
+	}
+	defer tx.Rollback()
+
+	report, err := lockedReport(tx, reportId, moderatorId)
+	if err != nil {
+		return Report{}, err
+	}
+	if report.Status == ReportClaimed {
+		return report, nil
+	}
+
+	report.Status = ReportClaimed
+	report.ClaimedBy = moderatorId
+	report.UpdatedAt = time.Now().UTC()
+	_, err = tx.Exec(
+		`UPDATE reports SET status = ?, claimed_by = ?, updated_at = ? WHERE id = ?`,
+		report.Status, report.ClaimedBy, report.UpdatedAt, report.Id,
+	)
+	if err != nil {
+		return Report{}, err
+	}
+	err = auditTx(tx, AuditEntry{ActorId: moderatorId, Action: "report.claim", TargetType: TargetReport, TargetId: report.Id})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, tx.Commit()
+}
+
+// ResolveReport closes reportId, which must be open or claimed by
+// moderatorId, and carries out the resolution. Every change is written to
+// the audit log in the same transaction.
+func (s *SQLiteDB) ResolveReport(reportId int, moderatorId int, resolution Resolution) (Report, error) {
+	if !ValidResolution(resolution.Action) {
+		return Report{}, fmt.Errorf("unknown resolution %q", resolution.Action)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Report{}, err
+	}
+	defer tx.Rollback()
+
+	report, err := lockedReport(tx, reportId, moderatorId)
+	if err != nil {
+		return Report{}, err
+	}
+	now := time.Now().UTC()
+
+	if resolution.Action == ResolutionSuspendAuthor {
+		_, err = suspendTx(tx, report.AuthorId, moderatorId, suspensionReason(report, resolution), resolution.SuspendUntil)
+		if err != nil {
+			return Report{}, err
+		}
+	}
+	if resolution.Action != ResolutionDismiss {
+		res, err := tx.Exec(`UPDATE chirps SET hidden = 1 WHERE id = ? AND deleted = 0 AND hidden = 0`, report.ChirpId)
+		if err != nil {
+			return Report{}, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			err = auditTx(tx, AuditEntry{
+				ActorId: moderatorId, Action: "chirp.hide", TargetType: TargetChirp, TargetId: report.ChirpId,
+				Detail: fmt.Sprintf("report %d", report.Id),
+			})
+			if err != nil {
+				return Report{}, err
+			}
+		}
+	}
+
+	report.Status = ReportResolved
+	report.ClaimedBy = moderatorId
+	report.Resolution = resolution.Action
+	report.Note = resolution.Note
+	report.UpdatedAt = now
+	_, err = tx.Exec(
+		`UPDATE reports SET status = ?, claimed_by = ?, resolution = ?, note = ?, updated_at = ? WHERE id = ?`,
+		report.Status, report.ClaimedBy, report.Resolution, report.Note, report.UpdatedAt, report.Id,
+	)
+	if err != nil {
+		return Report{}, err
+	}
+	err = auditTx(tx, AuditEntry{
+		ActorId: moderatorId, Action: "report.resolve", TargetType: TargetReport, TargetId: report.Id,
+		Detail: resolution.Action,
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, tx.Commit()
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SetUserRole changes the role of user userId and audits the change as
+// adminId's action. Changes made with the role command, which pass an
+// adminId of zero, have no actor to audit and aren't.
+func (s *SQLiteDB) SetUserRole(userId int, role string, adminId int) (User, error) {
+	if !ValidRole(role) {
+		return User{}, fmt.Errorf("unknown role %q", role)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var old string
+	err = tx.QueryRow(`SELECT role FROM users WHERE id = ?`, userId).Scan(&old)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("user not found")
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := scanUser(tx.QueryRow(
+		`UPDATE users SET role = ? WHERE id = ? RETURNING `+userColumns, role, userId,
+	))
+	if err != nil {
+		return User{}, err
+	}
+	user.Password = ""
+	if old != role && adminId != 0 {
+		err = auditTx(tx, roleChangeEntry(userId, old, role, adminId))
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	return user, tx.Commit()
+}
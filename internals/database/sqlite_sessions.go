@@ -0,0 +1,146 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// sessionColumns selects a Session, for scanSession
+const sessionColumns = `id, user_id, device, ip, user_agent, created_at, last_used_at, expires_at, revoked_at`
+
+func scanSession(row rowScanner) (Session, error) {
+	var session Session
+	var lastUsedAt, expiresAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&session.Id, &session.UserId, &session.Device, &session.IP, &session.UserAgent,
+		&session.CreatedAt, &lastUsedAt, &expiresAt, &revokedAt,
+	)
+	if err != nil {
+		return session, err
+	}
+	// sessions from before this was recorded have no last use
+	session.LastUsedAt = session.CreatedAt
+	if lastUsedAt.Valid {
+		session.LastUsedAt = lastUsedAt.Time
+	}
+	session.ExpiresAt = expiresAt.Time
+	session.RevokedAt = revokedAt.Time
+	return session, nil
+}
+
+// CreateSession records a new login of session.UserId
+func (s *SQLiteDB) CreateSession(session Session) (Session, error) {
+	now := time.Now().UTC()
+	created, err := scanSession(s.db.QueryRow(
+		`INSERT INTO sessions (user_id, device, ip, user_agent, created_at, last_used_at)
+		 VALUES (?, ?, ?, ?, ?, ?) RETURNING `+sessionColumns,
+		session.UserId, session.Device, session.IP, session.UserAgent, now, now,
+	))
+	if err != nil {
+		return Session{}, err
+	}
+
+	return created, nil
+}
+
+// GetSession returns session sessionId, revoked or not
+func (s *SQLiteDB) GetSession(sessionId int) (Session, error) {
+	session, err := scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, sessionId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// GetSessions returns the active sessions of userId, most recently used
+// first
+func (s *SQLiteDB) GetSessions(userId int) ([]Session, error) {
+	rows, err := s.db.Query(
+		`SELECT `+sessionColumns+` FROM sessions
+		 WHERE user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)`,
+		userId, time.Now().UTC(),
+	)
+	if err != nil {
+		return []Session{}, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return []Session{}, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err = rows.Err(); err != nil {
+		return []Session{}, err
+	}
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+// TouchSession records that sessionId was just used
+func (s *SQLiteDB) TouchSession(sessionId int) error {
+	res, err := s.db.Exec(`UPDATE sessions SET last_used_at = ? WHERE id = ?`, time.Now().UTC(), sessionId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeSession logs userId's session sessionId out. Revoking a session
+// twice is not an error.
+func (s *SQLiteDB) RevokeSession(userId int, sessionId int) error {
+	res, err := s.db.Exec(
+		`UPDATE sessions SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ? AND user_id = ?`,
+		time.Now().UTC(), sessionId, userId,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeSessions logs userId out everywhere and returns how many sessions
+// that ended. Personal access tokens aren't logins and keep working; they
+// are revoked one by one, or all at once by a password reset.
+func (s *SQLiteDB) RevokeSessions(userId int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	n, err := revokeUserSessionsTx(tx, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// revokeUserSessionsTx revokes every session of userId as part of tx
+func revokeUserSessionsTx(tx *sql.Tx, userId int) (int, error) {
+	res, err := tx.Exec(
+		`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`,
+		time.Now().UTC(), userId,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
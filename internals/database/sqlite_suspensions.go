@@ -0,0 +1,95 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// SuspendUser suspends userId until the given time, or bans them when
+// until is nil, replacing any earlier suspension. It fails with
+// ErrOutranked unless moderatorId's role ranks above userId's.
+func (s *SQLiteDB) SuspendUser(userId int, moderatorId int, reason string, until *time.Time) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := suspendTx(tx, userId, moderatorId, reason, until)
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, tx.Commit()
+}
+
+// suspendTx records the suspension of userId and audits it as part of tx.
+// The moderator's role must rank above the user's.
+func suspendTx(tx *sql.Tx, userId int, moderatorId int, reason string, until *time.Time) (User, error) {
+	var role, moderatorRole string
+	err := tx.QueryRow(`SELECT role FROM users WHERE id = ?`, userId).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("user not found")
+	}
+	if err != nil {
+		return User{}, err
+	}
+	err = tx.QueryRow(`SELECT role FROM users WHERE id = ?`, moderatorId).Scan(&moderatorRole)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return User{}, err
+	}
+	if RoleRank(moderatorRole) <= RoleRank(role) {
+		return User{}, ErrOutranked
+	}
+
+	user, err := scanUser(tx.QueryRow(
+		`UPDATE users SET suspension_reason = ?, suspended_at = ?, suspended_until = ?, suspended_by = ?
+		 WHERE id = ? RETURNING `+userColumns,
+		reason, time.Now().UTC(), until, moderatorId, userId,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("user not found")
+	}
+	if err != nil {
+		return User{}, err
+	}
+	user.Password = ""
+
+	err = auditTx(tx, AuditEntry{
+		ActorId: moderatorId, Action: "user.suspend", TargetType: TargetUser, TargetId: user.Id,
+		Detail: user.Suspension.auditDetail(),
+	})
+	return user, err
+}
+
+// ReinstateUser lifts the suspension of userId. Reinstating a user who
+// isn't suspended is not an error.
+func (s *SQLiteDB) ReinstateUser(userId int, moderatorId int) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE users SET suspension_reason = NULL, suspended_at = NULL, suspended_until = NULL, suspended_by = NULL
+		 WHERE id = ? AND suspended_at IS NOT NULL`, userId,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		err = auditTx(tx, AuditEntry{ActorId: moderatorId, Action: "user.reinstate", TargetType: TargetUser, TargetId: userId})
+		if err != nil {
+			return User{}, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+
+	return s.GetUser(strconv.Itoa(userId))
+}
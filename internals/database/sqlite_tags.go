@@ -0,0 +1,52 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// TrendingTags returns the hashtags used by the most chirps created since
+// then, most used first. Each chirp counts once per tag.
+func (s *SQLiteDB) TrendingTags(since time.Time, limit int) ([]TagCount, error) {
+	query := `SELECT t.tag, COUNT(*) AS n
+		FROM chirp_tags t JOIN chirps c ON c.id = t.chirp_id
+		WHERE c.deleted = 0 AND c.hidden = 0 AND c.created_at >= ?
+		GROUP BY t.tag ORDER BY n DESC, t.tag`
+	args := []any{since.UTC()}
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []TagCount{}, err
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		err = rows.Scan(&tag.Tag, &tag.Count)
+		if err != nil {
+			return []TagCount{}, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// GetUserByEmail returns the user with email, without their password
+func (s *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	user, err := scanUser(s.db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE email = ?`, NormalizeEmail(email),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("user does not exist")
+	}
+	user.Password = ""
+
+	return user, err
+}
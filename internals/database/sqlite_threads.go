@@ -0,0 +1,136 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// DeleteChirp deletes chirp chirpId written by userId. A chirp with
+// replies is left as a tombstone.
+func (s *SQLiteDB) DeleteChirp(chirpId int, userId int) error {
+	return s.deleteChirp(chirpId, userId, 0)
+}
+
+// DeleteChirpAsModerator deletes chirp chirpId whoever wrote it. Deleting
+// someone else's chirp is audited as moderatorId's action.
+func (s *SQLiteDB) DeleteChirpAsModerator(chirpId int, moderatorId int) error {
+	return s.deleteChirp(chirpId, 0, moderatorId)
+}
+
+// deleteChirp deletes chirpId if userId wrote it or, when moderatorId is
+// set, whoever wrote it
+func (s *SQLiteDB) deleteChirp(chirpId int, userId int, moderatorId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var parentId sql.NullInt64
+	var authorId int
+	err = tx.QueryRow(
+		`SELECT parent_id, author_id FROM chirps WHERE id = ? AND deleted = 0`, chirpId,
+	).Scan(&parentId, &authorId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("chirp not found")
+	}
+	if err != nil {
+		return err
+	}
+	if moderatorId == 0 && authorId != userId {
+		return errors.New("chirp not found")
+	}
+	commit := func() error {
+		if moderatorId != 0 && authorId != moderatorId {
+			err := auditTx(tx, chirpDeleteEntry(chirpId, authorId, moderatorId))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	res, err := tx.Exec(
+		`UPDATE chirps SET body = '', entities = NULL, moderation = NULL, deleted = 1
+		 WHERE id = ? AND EXISTS (SELECT 1 FROM chirps r WHERE r.parent_id = chirps.id)`, chirpId,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		for _, table := range []string{"chirp_tags", "chirp_mentions", "likes", "rechirps"} {
+			_, err = tx.Exec(`DELETE FROM `+table+` WHERE chirp_id = ?`, chirpId)
+			if err != nil {
+				return err
+			}
+		}
+		return commit()
+	}
+
+	_, err = tx.Exec(`DELETE FROM chirps WHERE id = ?`, chirpId)
+	if err != nil {
+		return err
+	}
+
+	// remove tombstones left without replies, up the thread
+	for parentId.Valid {
+		id := parentId.Int64
+		err = tx.QueryRow(
+			`DELETE FROM chirps
+			 WHERE id = ? AND deleted = 1 AND NOT EXISTS (SELECT 1 FROM chirps r WHERE r.parent_id = chirps.id)
+			 RETURNING parent_id`, id,
+		).Scan(&parentId)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return commit()
+}
+
+// GetThread returns chirpId and its replies up to depth levels below it.
+// Tombstones are included so the conversation keeps its shape.
+func (s *SQLiteDB) GetThread(chirpId int, depth int) (Thread, error) {
+	if depth > MaxThreadDepth {
+		depth = MaxThreadDepth
+	}
+
+	rows, err := s.db.Query(
+		`WITH RECURSIVE thread (id, depth) AS (
+			SELECT id, 0 FROM chirps WHERE id = ?
+			UNION ALL
+			SELECT r.id, thread.depth + 1 FROM chirps r JOIN thread ON r.parent_id = thread.id
+			WHERE thread.depth < ?
+		)
+		SELECT `+chirpColumns+` FROM thread JOIN chirps c ON c.id = thread.id`,
+		chirpId, depth,
+	)
+	if err != nil {
+		return Thread{}, err
+	}
+	defer rows.Close()
+
+	var chirps []Chirp
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return Thread{}, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	if err = rows.Err(); err != nil {
+		return Thread{}, err
+	}
+	if len(chirps) == 0 {
+		return Thread{}, errors.New("chirp does not exist")
+	}
+
+	return buildThread(chirpId, chirps), nil
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// EnrollTOTP starts an enrollment of userId with secret, replacing any
+// unconfirmed one
+func (s *SQLiteDB) EnrollTOTP(userId int, secret string) (TOTP, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return TOTP{}, err
+	}
+	defer tx.Rollback()
+
+	var confirmed bool
+	err = tx.QueryRow(`SELECT confirmed_at IS NOT NULL FROM totp WHERE user_id = ?`, userId).Scan(&confirmed)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return TOTP{}, err
+	}
+	if confirmed {
+		return TOTP{}, ErrTOTPEnabled
+	}
+
+	enrollment := TOTP{UserId: userId, Secret: secret, CreatedAt: time.Now().UTC(), RecoveryCodes: []string{}}
+	_, err = tx.Exec(
+		`INSERT INTO totp (user_id, secret, created_at, last_counter) VALUES (?, ?, ?, 0)
+		 ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at`,
+		userId, secret, enrollment.CreatedAt,
+	)
+	if err != nil {
+		return TOTP{}, err
+	}
+
+	return enrollment, tx.Commit()
+}
+
+// GetTOTP returns userId's enrollment, confirmed or not
+func (s *SQLiteDB) GetTOTP(userId int) (TOTP, error) {
+	enrollment := TOTP{UserId: userId, RecoveryCodes: []string{}}
+	var confirmedAt sql.NullTime
+	err := s.db.QueryRow(
+		`SELECT secret, created_at, confirmed_at, last_counter FROM totp WHERE user_id = ?`, userId,
+	).Scan(&enrollment.Secret, &enrollment.CreatedAt, &confirmedAt, &enrollment.LastCounter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TOTP{}, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return TOTP{}, err
+	}
+	if confirmedAt.Valid {
+		enrollment.ConfirmedAt = &confirmedAt.Time
+	}
+
+	rows, err := s.db.Query(`SELECT code_hash FROM recovery_codes WHERE user_id = ?`, userId)
+	if err != nil {
+		return TOTP{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return TOTP{}, err
+		}
+		enrollment.RecoveryCodes = append(enrollment.RecoveryCodes, hash)
+	}
+
+	return enrollment, rows.Err()
+}
+
+// ConfirmTOTP enables userId's pending enrollment, marking counter's code
+// used and storing recoveryCodes
+func (s *SQLiteDB) ConfirmTOTP(userId int, counter int64, recoveryCodes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var confirmed bool
+	err = tx.QueryRow(`SELECT confirmed_at IS NOT NULL FROM totp WHERE user_id = ?`, userId).Scan(&confirmed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	if confirmed {
+		return ErrTOTPEnabled
+	}
+
+	_, err = tx.Exec(`UPDATE totp SET confirmed_at = ?, last_counter = ? WHERE user_id = ?`, time.Now().UTC(), counter, userId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userId)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashRecoveryCodes(recoveryCodes) {
+		_, err = tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userId, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPCode marks the code of time step counter used for userId,
+// refusing it if that step or a later one was used already
+func (s *SQLiteDB) UseTOTPCode(userId int, counter int64) error {
+	res, err := s.db.Exec(
+		`UPDATE totp SET last_counter = ? WHERE user_id = ? AND confirmed_at IS NOT NULL AND last_counter < ?`,
+		counter, userId, counter,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	enrollment, err := s.GetTOTP(userId)
+	if err != nil {
+		return err
+	}
+	if !enrollment.Enabled() {
+		return ErrTOTPNotEnrolled
+	}
+	return ErrTOTPCodeUsed
+}
+
+// UseRecoveryCode spends one of userId's recovery codes
+func (s *SQLiteDB) UseRecoveryCode(userId int, code string) error {
+	res, err := s.db.Exec(
+		`DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?
+		 AND EXISTS (SELECT 1 FROM totp WHERE user_id = ? AND confirmed_at IS NOT NULL)`,
+		userId, hashToken(code), userId,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrRecoveryCodeInvalid
+	}
+	return nil
+}
+
+// DisableTOTP removes userId's enrollment and recovery codes
+func (s *SQLiteDB) DisableTOTP(userId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userId)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM totp WHERE user_id = ?`, userId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTOTPNotEnrolled
+	}
+
+	return tx.Commit()
+}
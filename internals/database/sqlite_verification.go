@@ -0,0 +1,132 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PasswordStamp returns a value that changes whenever userId's password
+// does, to bind a reset token to the password it replaces
+func (s *SQLiteDB) PasswordStamp(userId int) (string, error) {
+	var hash string
+	err := s.db.QueryRow(`SELECT password FROM users WHERE id = ?`, userId).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errors.New("user not found")
+	}
+	if err != nil {
+		return "", err
+	}
+	return passwordStamp(hash), nil
+}
+
+// ConsumeToken spends a single-use token that is good until expiresAt,
+// failing with ErrTokenUsed if it was spent before
+func (s *SQLiteDB) ConsumeToken(token string, expiresAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(`DELETE FROM used_tokens WHERE expires_at < ?`, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO used_tokens (token_hash, used_at, expires_at) VALUES (?, ?, ?)`,
+		hashToken(token), now, expiresAt.UTC(),
+	)
+	if isUniqueViolation(err) {
+		return ErrTokenUsed
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// VerifyEmail marks userId's address verified, provided it is still email
+func (s *SQLiteDB) VerifyEmail(userId int, email string) (User, error) {
+	user, err := scanUser(s.db.QueryRow(
+		`UPDATE users SET email_verified = 1 WHERE id = ? AND email = ? RETURNING `+userColumns, userId, email,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, s.emailMismatch(userId)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	user.Password = ""
+
+	return user, nil
+}
+
+// ResetPassword sets the password of userId, provided their address is
+// still email and their password still has stamp, and revokes their
+// sessions and personal access tokens. Resetting through a mailed link
+// proves the address, so it is marked verified too.
+func (s *SQLiteDB) ResetPassword(userId int, email string, stamp string, password string) error {
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldEmail, oldHash string
+	err = tx.QueryRow(`SELECT email, password FROM users WHERE id = ?`, userId).Scan(&oldEmail, &oldHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("user not found")
+	}
+	if err != nil {
+		return err
+	}
+	if oldEmail != email {
+		return ErrEmailChanged
+	}
+	if passwordStamp(oldHash) != stamp {
+		return ErrPasswordChanged
+	}
+	// matching the hash again keeps a concurrent change from being
+	// overwritten
+	res, err := tx.Exec(
+		`UPDATE users SET password = ?, email_verified = 1 WHERE id = ? AND password = ?`, hash, userId, oldHash,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPasswordChanged
+	}
+	_, err = revokeUserSessionsTx(tx, userId)
+	if err != nil {
+		return err
+	}
+	err = revokeUserPersonalTokensTx(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// emailMismatch tells apart the reasons an update keyed on a user's id
+// and address matched nothing
+func (s *SQLiteDB) emailMismatch(userId int) error {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ?`, userId).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("user not found")
+	}
+	return ErrEmailChanged
+}
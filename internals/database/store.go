@@ -0,0 +1,138 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jming514/chirpy/internals/password"
+)
+
+// Store is the storage backend used by the API handlers.
+// DB (a JSON file) and SQLiteDB both implement it.
+type Store interface {
+	Login(email, password string) (UserReturn, error)
+	CreateUser(email string, password string) (UserReturn, error)
+	UpdateUser(u User) (User, error)
+	UpgradeUser(obj UpgradeUserStruct) (User, error)
+	GetUser(v string) (User, error)
+	GetUserByEmail(email string) (User, error)
+	GetUsers(page Page) ([]User, error)
+	SetUserRole(userId int, role string, adminId int) (User, error)
+	SuspendUser(userId int, moderatorId int, reason string, until *time.Time) (User, error)
+	ReinstateUser(userId int, moderatorId int) (User, error)
+	VerifyEmail(userId int, email string) (User, error)
+	PasswordStamp(userId int) (string, error)
+	ResetPassword(userId int, email string, stamp string, password string) error
+	ConsumeToken(token string, expiresAt time.Time) error
+
+	GetLoginThrottle(key string) (LoginThrottle, error)
+	RecordLoginFailure(key string, policy LockoutPolicy) (throttle LoginThrottle, locked bool, err error)
+	ClearLoginThrottle(key string) error
+	UnlockUser(userId int, adminId int) error
+	AddNotification(userId int, kind string, message string) (Notification, error)
+	GetNotifications(userId int, page Page) ([]Notification, error)
+
+	EnrollTOTP(userId int, secret string) (TOTP, error)
+	GetTOTP(userId int) (TOTP, error)
+	ConfirmTOTP(userId int, counter int64, recoveryCodes []string) error
+	UseTOTPCode(userId int, counter int64) error
+	UseRecoveryCode(userId int, code string) error
+	DisableTOTP(userId int) error
+
+	Follow(followerId int, followeeId int) error
+	Unfollow(followerId int, followeeId int) error
+	GetFollowers(userId int, page Page) ([]User, error)
+	GetFollowing(userId int, page Page) ([]User, error)
+
+	CreateChirp(chirp Chirp) (Chirp, error)
+	DeleteChirp(chirpId int, userId int) error
+	DeleteChirpAsModerator(chirpId int, moderatorId int) error
+	GetChirp(v string) (Chirp, error)
+	GetChirps(options Options) ([]Chirp, error)
+	GetThread(chirpId int, depth int) (Thread, error)
+	TrendingTags(since time.Time, limit int) ([]TagCount, error)
+
+	LikeChirp(userId int, chirpId int) (Chirp, error)
+	UnlikeChirp(userId int, chirpId int) (Chirp, error)
+	Rechirp(userId int, chirpId int) (Chirp, error)
+	Unrechirp(userId int, chirpId int) (Chirp, error)
+	GetLikers(chirpId int, page Page) ([]User, error)
+
+	CreateReport(chirpId int, reporterId int, reason string) (Report, error)
+	GetReports(status string, page Page) ([]Report, error)
+	ClaimReport(reportId int, moderatorId int) (Report, error)
+	ResolveReport(reportId int, moderatorId int, resolution Resolution) (Report, error)
+	GetAuditLog(page Page) ([]AuditEntry, error)
+
+	RevokeToken(token string) error
+	IsTokenRevoked(token string) (bool, error)
+	CreateRefreshToken(sessionId int, token string, expiresAt time.Time) error
+	RotateRefreshToken(rotation Rotation) (int, string, error)
+
+	CreateSession(session Session) (Session, error)
+	GetSession(sessionId int) (Session, error)
+	GetSessions(userId int) ([]Session, error)
+	TouchSession(sessionId int) error
+	RevokeSession(userId int, sessionId int) error
+	RevokeSessions(userId int) (int, error)
+
+	CreatePersonalToken(token PersonalToken, secret string) (PersonalToken, error)
+	GetPersonalToken(secret string) (PersonalToken, error)
+	GetPersonalTokens(userId int) ([]PersonalToken, error)
+	TouchPersonalToken(tokenId int) error
+	RevokePersonalToken(userId int, tokenId int) error
+
+	Close() error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
+
+// StoreConfig selects and configures a storage backend
+type StoreConfig struct {
+	// Driver is "json" or "sqlite". Empty selects the JSON file.
+	Driver string
+	// Path is the database file. Empty selects the backend's default file
+	// in the working directory.
+	Path string
+	// FlushInterval is how often the JSON store snapshots its in-memory
+	// state to disk. Zero snapshots after every change.
+	FlushInterval time.Duration
+	// Hasher hashes passwords. Nil uses password.Default().
+	Hasher *password.Hasher
+}
+
+// NewStore opens the storage backend described by config
+func NewStore(config StoreConfig) (Store, error) {
+	path := config.Path
+	switch config.Driver {
+	case "", "json":
+		if path == "" {
+			path = "./database.json"
+		}
+		db, err := NewDB(path, config.FlushInterval)
+		if err != nil {
+			return nil, err
+		}
+		if config.Hasher != nil {
+			db.hasher = config.Hasher
+		}
+		return db, nil
+	case "sqlite":
+		if path == "" {
+			path = "./database.db"
+		}
+		db, err := NewSQLiteDB(path)
+		if err != nil {
+			return nil, err
+		}
+		if config.Hasher != nil {
+			db.hasher = config.Hasher
+		}
+		return db, nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", config.Driver)
+	}
+}
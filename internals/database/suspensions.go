@@ -0,0 +1,103 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUserSuspended means the user's account is suspended or banned
+var ErrUserSuspended = errors.New("user is suspended")
+
+// Suspension keeps a user from using their account. By is the moderator
+// who suspended them. Until is nil for a ban, which has no end.
+type Suspension struct {
+	Reason string     `json:"reason"`
+	By     int        `json:"by"`
+	At     time.Time  `json:"at"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// Active reports whether the suspension is in force at now. A nil
+// suspension never is.
+func (s *Suspension) Active(now time.Time) bool {
+	return s != nil && (s.Until == nil || now.Before(*s.Until))
+}
+
+// Banned reports whether the suspension has no end
+func (s *Suspension) Banned() bool {
+	return s != nil && s.Until == nil
+}
+
+// auditDetail describes the suspension for the audit log
+func (s *Suspension) auditDetail() string {
+	if s.Until == nil {
+		return "banned: " + s.Reason
+	}
+	return fmt.Sprintf("until %s: %s", s.Until.Format(time.RFC3339), s.Reason)
+}
+
+// SuspendUser suspends userId until the given time, or bans them when
+// until is nil, replacing any earlier suspension. It fails with
+// ErrOutranked unless moderatorId's role ranks above userId's.
+func (db *DB) SuspendUser(userId int, moderatorId int, reason string, until *time.Time) (User, error) {
+	var user User
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		var err error
+		user, err = suspend(dbStructure, tx, userId, moderatorId, reason, until)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	user.Password = ""
+
+	return user, nil
+}
+
+// suspend records the suspension of userId and audits it as part of tx.
+// The moderator's role must rank above the user's.
+func suspend(dbStructure DBStructure, tx *tx, userId int, moderatorId int, reason string, until *time.Time) (User, error) {
+	user, ok := dbStructure.Users[userId]
+	if !ok {
+		return User{}, errors.New("user not found")
+	}
+	moderator, ok := dbStructure.Users[moderatorId]
+	if !ok || RoleRank(moderator.Role) <= RoleRank(user.Role) {
+		return User{}, ErrOutranked
+	}
+	user.Suspension = &Suspension{Reason: reason, By: moderatorId, At: time.Now().UTC(), Until: until}
+	tx.put("users", user.Id, user)
+	audit(dbStructure, tx, AuditEntry{
+		ActorId: moderatorId, Action: "user.suspend", TargetType: TargetUser, TargetId: user.Id,
+		Detail: user.Suspension.auditDetail(),
+	})
+
+	return user, nil
+}
+
+// ReinstateUser lifts the suspension of userId. Reinstating a user who
+// isn't suspended is not an error.
+func (db *DB) ReinstateUser(userId int, moderatorId int) (User, error) {
+	var user User
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		var ok bool
+		user, ok = dbStructure.Users[userId]
+		if !ok {
+			return errors.New("user not found")
+		}
+		if user.Suspension == nil {
+			return nil
+		}
+		user.Suspension = nil
+		tx.put("users", user.Id, user)
+		audit(dbStructure, tx, AuditEntry{ActorId: moderatorId, Action: "user.reinstate", TargetType: TargetUser, TargetId: user.Id})
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	user.Password = ""
+
+	return user, nil
+}
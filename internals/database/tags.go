@@ -0,0 +1,88 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/jming514/chirpy/internals/entities"
+)
+
+// TagCount is how many chirps used a hashtag
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// hasEntity reports whether the chirp has an entity of type kind with the
+// given text, or mentioning userId when it is not zero
+func (c Chirp) hasEntity(kind string, text string, userId int) bool {
+	for _, e := range c.Entities {
+		if e.Type != kind {
+			continue
+		}
+		if (userId != 0 && e.UserId == userId) || (userId == 0 && e.Text == text) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrendingTags returns the hashtags used by the most chirps created since
+// then, most used first. Each chirp counts once per tag.
+func (db *DB) TrendingTags(since time.Time, limit int) ([]TagCount, error) {
+	counts := map[string]int{}
+	err := db.view(func(dbStructure DBStructure) error {
+		for _, c := range dbStructure.Chirps {
+			if !c.visible() || c.Created_At.Before(since) {
+				continue
+			}
+			seen := map[string]bool{}
+			for _, e := range c.Entities {
+				if e.Type == entities.Hashtag && !seen[e.Text] {
+					seen[e.Text] = true
+					counts[e.Text]++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []TagCount{}, err
+	}
+
+	tags := []TagCount{}
+	for tag, count := range counts {
+		tags = append(tags, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	if limit > 0 && len(tags) > limit {
+		tags = tags[:limit]
+	}
+
+	return tags, nil
+}
+
+// GetUserByEmail returns the user with email, without their password
+func (db *DB) GetUserByEmail(email string) (User, error) {
+	email = NormalizeEmail(email)
+	var user User
+	err := db.view(func(dbStructure DBStructure) error {
+		for _, value := range dbStructure.Users {
+			if value.Email == email {
+				user = value
+				user.Password = ""
+				return nil
+			}
+		}
+
+		return errors.New("user does not exist")
+	})
+
+	return user, err
+}
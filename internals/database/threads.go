@@ -0,0 +1,148 @@
+package database
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrParentChirpNotFound means a reply named a parent chirp that doesn't
+// exist or was deleted
+var ErrParentChirpNotFound = errors.New("parent chirp not found")
+
+// MaxThreadDepth caps the depth GetThread will walk
+const MaxThreadDepth = 50
+
+// Thread is a chirp with its replies, nested as deep as was asked for.
+// Replies below the depth limit are left out; Reply_Count still counts them.
+type Thread struct {
+	Chirp
+	Replies []Thread `json:"replies"`
+}
+
+// GetThread returns chirpId and its replies up to depth levels below it.
+// Tombstones are included so the conversation keeps its shape.
+func (db *DB) GetThread(chirpId int, depth int) (Thread, error) {
+	if depth > MaxThreadDepth {
+		depth = MaxThreadDepth
+	}
+
+	var chirps []Chirp
+	err := db.view(func(dbStructure DBStructure) error {
+		root, ok := dbStructure.Chirps[chirpId]
+		if !ok {
+			return errors.New("chirp does not exist")
+		}
+
+		children := map[int][]Chirp{}
+		for _, c := range dbStructure.Chirps {
+			if c.Parent_Id != 0 {
+				children[c.Parent_Id] = append(children[c.Parent_Id], c)
+			}
+		}
+
+		chirps = append(chirps, root)
+		level := []Chirp{root}
+		for d := 0; d < depth && len(level) > 0; d++ {
+			var next []Chirp
+			for _, c := range level {
+				next = append(next, children[c.Id]...)
+			}
+			chirps = append(chirps, next...)
+			level = next
+		}
+		return nil
+	})
+	if err != nil {
+		return Thread{}, err
+	}
+
+	return buildThread(chirpId, chirps), nil
+}
+
+// buildThread nests chirps, which hold rootId and its descendants, under
+// rootId. Replies are in the order they were posted. Hidden chirps keep
+// their place without their body.
+func buildThread(rootId int, chirps []Chirp) Thread {
+	sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id < chirps[j].Id })
+
+	var root Chirp
+	children := map[int][]Chirp{}
+	for _, c := range chirps {
+		if c.Id == rootId {
+			root = c
+			continue
+		}
+		children[c.Parent_Id] = append(children[c.Parent_Id], c)
+	}
+
+	var build func(c Chirp) Thread
+	build = func(c Chirp) Thread {
+		if c.Hidden {
+			c.Body = ""
+			c.Entities = nil
+			c.Moderation = nil
+		}
+		t := Thread{Chirp: c, Replies: []Thread{}}
+		for _, reply := range children[c.Id] {
+			t.Replies = append(t.Replies, build(reply))
+		}
+		return t
+	}
+	return build(root)
+}
+
+// removeChirp deletes chirp, or leaves a tombstone if it has replies, and
+// takes it off its parent's reply count. Tombstones that lose their last
+// reply this way are removed too, up the thread.
+func removeChirp(dbStructure DBStructure, tx *tx, chirp Chirp) {
+	if hasReplies(dbStructure, chirp.Id, 0) {
+		chirp.Body = ""
+		chirp.Entities = nil
+		chirp.Moderation = nil
+		chirp.Like_Count = 0
+		chirp.Rechirp_Count = 0
+		chirp.Deleted = true
+		tx.put("chirps", chirp.Id, chirp)
+	} else {
+		tx.delete("chirps", chirp.Id)
+	}
+	for _, table := range []string{"likes", "rechirps"} {
+		for key, e := range dbStructure.engagements(table) {
+			if e.ChirpId == chirp.Id {
+				tx.delete(table, key)
+			}
+		}
+	}
+
+	parent, ok := dbStructure.Chirps[chirp.Parent_Id]
+	if !ok {
+		return
+	}
+	parent.Reply_Count--
+	tx.put("chirps", parent.Id, parent)
+
+	if chirp.Deleted {
+		return
+	}
+	removed := chirp.Id
+	for ok && parent.Deleted && !hasReplies(dbStructure, parent.Id, removed) {
+		tx.delete("chirps", parent.Id)
+		removed = parent.Id
+		parent, ok = dbStructure.Chirps[parent.Parent_Id]
+	}
+}
+
+// visible reports whether the chirp can be listed, liked and replied to
+func (c Chirp) visible() bool {
+	return !c.Deleted && !c.Hidden
+}
+
+// hasReplies reports whether any chirp other than except replies to id
+func hasReplies(dbStructure DBStructure, id int, except int) bool {
+	for _, c := range dbStructure.Chirps {
+		if c.Parent_Id == id && c.Id != except {
+			return true
+		}
+	}
+	return false
+}
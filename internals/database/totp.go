@@ -0,0 +1,153 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrTOTPNotEnrolled means the user has no authenticator, or hasn't
+	// confirmed the one they enrolled when confirmation is required
+	ErrTOTPNotEnrolled = errors.New("totp not enrolled")
+	// ErrTOTPEnabled means the user already has a confirmed authenticator
+	ErrTOTPEnabled = errors.New("totp already enabled")
+	// ErrTOTPCodeUsed means the code's time step was already used
+	ErrTOTPCodeUsed = errors.New("totp code already used")
+	// ErrRecoveryCodeInvalid means the recovery code doesn't exist or was
+	// already used
+	ErrRecoveryCodeInvalid = errors.New("invalid recovery code")
+)
+
+// TOTP is a user's authenticator enrollment. Until it is confirmed with a
+// code it doesn't guard logins. LastCounter is the time step of the last
+// code accepted; codes from that step or earlier are refused. Only hashes
+// of the recovery codes are stored.
+type TOTP struct {
+	UserId        int        `json:"user_id"`
+	Secret        string     `json:"secret"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ConfirmedAt   *time.Time `json:"confirmed_at,omitempty"`
+	LastCounter   int64      `json:"last_counter"`
+	RecoveryCodes []string   `json:"recovery_codes"`
+}
+
+// Enabled reports whether the enrollment was confirmed
+func (t TOTP) Enabled() bool {
+	return t.ConfirmedAt != nil
+}
+
+// EnrollTOTP starts an enrollment of userId with secret, replacing any
+// unconfirmed one
+func (db *DB) EnrollTOTP(userId int, secret string) (TOTP, error) {
+	var enrollment TOTP
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		if _, ok := dbStructure.Users[userId]; !ok {
+			return errors.New("user not found")
+		}
+		if dbStructure.TOTP[userId].Enabled() {
+			return ErrTOTPEnabled
+		}
+		enrollment = TOTP{UserId: userId, Secret: secret, CreatedAt: time.Now().UTC(), RecoveryCodes: []string{}}
+		tx.put("totp", userId, enrollment)
+		return nil
+	})
+	if err != nil {
+		return TOTP{}, err
+	}
+
+	return enrollment, nil
+}
+
+// GetTOTP returns userId's enrollment, confirmed or not
+func (db *DB) GetTOTP(userId int) (TOTP, error) {
+	var enrollment TOTP
+	err := db.view(func(dbStructure DBStructure) error {
+		var ok bool
+		enrollment, ok = dbStructure.TOTP[userId]
+		if !ok {
+			return ErrTOTPNotEnrolled
+		}
+		return nil
+	})
+	if err != nil {
+		return TOTP{}, err
+	}
+
+	return enrollment, nil
+}
+
+// ConfirmTOTP enables userId's pending enrollment, marking counter's code
+// used and storing recoveryCodes
+func (db *DB) ConfirmTOTP(userId int, counter int64, recoveryCodes []string) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		enrollment, ok := dbStructure.TOTP[userId]
+		if !ok {
+			return ErrTOTPNotEnrolled
+		}
+		if enrollment.Enabled() {
+			return ErrTOTPEnabled
+		}
+		now := time.Now().UTC()
+		enrollment.ConfirmedAt = &now
+		enrollment.LastCounter = counter
+		enrollment.RecoveryCodes = hashRecoveryCodes(recoveryCodes)
+		tx.put("totp", userId, enrollment)
+		return nil
+	})
+}
+
+// UseTOTPCode marks the code of time step counter used for userId,
+// refusing it if that step or a later one was used already
+func (db *DB) UseTOTPCode(userId int, counter int64) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		enrollment, ok := dbStructure.TOTP[userId]
+		if !ok || !enrollment.Enabled() {
+			return ErrTOTPNotEnrolled
+		}
+		if counter <= enrollment.LastCounter {
+			return ErrTOTPCodeUsed
+		}
+		enrollment.LastCounter = counter
+		tx.put("totp", userId, enrollment)
+		return nil
+	})
+}
+
+// UseRecoveryCode spends one of userId's recovery codes
+func (db *DB) UseRecoveryCode(userId int, code string) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		enrollment, ok := dbStructure.TOTP[userId]
+		if !ok || !enrollment.Enabled() {
+			return ErrTOTPNotEnrolled
+		}
+		hash := hashToken(code)
+		for i, h := range enrollment.RecoveryCodes {
+			if h == hash {
+				codes := append([]string{}, enrollment.RecoveryCodes[:i]...)
+				enrollment.RecoveryCodes = append(codes, enrollment.RecoveryCodes[i+1:]...)
+				tx.put("totp", userId, enrollment)
+				return nil
+			}
+		}
+		return ErrRecoveryCodeInvalid
+	})
+}
+
+// DisableTOTP removes userId's enrollment and recovery codes
+func (db *DB) DisableTOTP(userId int) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		if _, ok := dbStructure.TOTP[userId]; !ok {
+			return ErrTOTPNotEnrolled
+		}
+		tx.delete("totp", userId)
+		return nil
+	})
+}
+
+func hashRecoveryCodes(codes []string) []string {
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashToken(code)
+	}
+	return hashes
+}
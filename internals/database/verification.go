@@ -0,0 +1,120 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrTokenUsed means a single-use token was presented a second time
+	ErrTokenUsed = errors.New("token already used")
+	// ErrEmailChanged means the user's address changed after a token was
+	// mailed to the old one
+	ErrEmailChanged = errors.New("email changed")
+	// ErrPasswordChanged means the user's password changed after a reset
+	// token was mailed
+	ErrPasswordChanged = errors.New("password changed")
+)
+
+// UsedToken records a spent single-use token until it would have expired
+// anyway. Only a hash of the token is stored.
+type UsedToken struct {
+	TokenHash string    `json:"token_hash"`
+	UsedAt    time.Time `json:"used_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ConsumeToken spends a single-use token that is good until expiresAt,
+// failing with ErrTokenUsed if it was spent before
+func (db *DB) ConsumeToken(token string, expiresAt time.Time) error {
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		hash := hashToken(token)
+		if _, ok := dbStructure.UsedTokens[hash]; ok {
+			return ErrTokenUsed
+		}
+
+		now := time.Now().UTC()
+		for key, used := range dbStructure.UsedTokens {
+			if used.ExpiresAt.Before(now) {
+				tx.delete("used_tokens", key)
+			}
+		}
+		tx.put("used_tokens", hash, UsedToken{TokenHash: hash, UsedAt: now, ExpiresAt: expiresAt.UTC()})
+		return nil
+	})
+}
+
+// VerifyEmail marks userId's address verified, provided it is still email
+func (db *DB) VerifyEmail(userId int, email string) (User, error) {
+	var user User
+	err := db.update(func(dbStructure DBStructure, tx *tx) error {
+		var ok bool
+		user, ok = dbStructure.Users[userId]
+		if !ok {
+			return errors.New("user not found")
+		}
+		if user.Email != email {
+			return ErrEmailChanged
+		}
+		user.EmailVerified = true
+		tx.put("users", user.Id, user)
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	user.Password = ""
+
+	return user, nil
+}
+
+// passwordStamp identifies a stored password hash without revealing it
+func passwordStamp(hash string) string {
+	return hashToken(hash)
+}
+
+// PasswordStamp returns a value that changes whenever userId's password
+// does, to bind a reset token to the password it replaces
+func (db *DB) PasswordStamp(userId int) (string, error) {
+	var stamp string
+	err := db.view(func(dbStructure DBStructure) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			return errors.New("user not found")
+		}
+		stamp = passwordStamp(user.Password)
+		return nil
+	})
+
+	return stamp, err
+}
+
+// ResetPassword sets the password of userId, provided their address is
+// still email and their password still has stamp, and revokes their
+// sessions and personal access tokens. Resetting through a mailed link
+// proves the address, so it is marked verified too.
+func (db *DB) ResetPassword(userId int, email string, stamp string, password string) error {
+	hash, err := db.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	return db.update(func(dbStructure DBStructure, tx *tx) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			return errors.New("user not found")
+		}
+		if user.Email != email {
+			return ErrEmailChanged
+		}
+		if passwordStamp(user.Password) != stamp {
+			return ErrPasswordChanged
+		}
+		user.Password = hash
+		user.EmailVerified = true
+		tx.put("users", user.Id, user)
+		revokeUserSessions(dbStructure, tx, userId)
+		revokeUserPersonalTokens(dbStructure, tx, userId)
+		return nil
+	})
+}
@@ -0,0 +1,291 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// walCompactSize is the size past which the write-ahead log is emptied
+// after a successful snapshot
+const walCompactSize = 1 << 20
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// mutation is a single change to one table of a DBStructure.
+// It is the unit recorded in the write-ahead log. The mutations of one
+// update are replayed all or nothing; the final one is marked Last.
+type mutation struct {
+	Seq   uint64          `json:"seq"`
+	Table string          `json:"table"`
+	Op    string          `json:"op"`
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Last  bool            `json:"last,omitempty"`
+}
+
+// tx collects the mutations made by one call to DB.update.
+// The first encoding error is kept and reported by update.
+type tx struct {
+	mutations []mutation
+	sequences map[string]int
+	err       error
+}
+
+// put sets table[key] to value
+func (t *tx) put(table string, key, value any) {
+	k, err := json.Marshal(key)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	t.mutations = append(t.mutations, mutation{Table: table, Op: opPut, Key: k, Value: v})
+}
+
+// delete removes table[key]
+func (t *tx) delete(table string, key any) {
+	k, err := json.Marshal(key)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	t.mutations = append(t.mutations, mutation{Table: table, Op: opDelete, Key: k})
+}
+
+func (t *tx) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// apply replays a single mutation against the structure
+func (dbStructure *DBStructure) apply(m mutation) error {
+	switch m.Table {
+	case "sequences":
+		return applyTo(dbStructure.Sequences, m)
+	case "chirps":
+		return applyTo(dbStructure.Chirps, m)
+	case "users":
+		return applyTo(dbStructure.Users, m)
+	case "tokens":
+		return applyTo(dbStructure.Tokens, m)
+	case "sessions":
+		return applyTo(dbStructure.Sessions, m)
+	case "refresh_tokens":
+		return applyTo(dbStructure.RefreshTokens, m)
+	case "follows":
+		return applyTo(dbStructure.Follows, m)
+	case "likes":
+		return applyTo(dbStructure.Likes, m)
+	case "rechirps":
+		return applyTo(dbStructure.Rechirps, m)
+	case "reports":
+		return applyTo(dbStructure.Reports, m)
+	case "audit_log":
+		return applyTo(dbStructure.AuditLog, m)
+	case "login_throttles":
+		return applyTo(dbStructure.LoginThrottles, m)
+	case "notifications":
+		return applyTo(dbStructure.Notifications, m)
+	case "totp":
+		return applyTo(dbStructure.TOTP, m)
+	case "used_tokens":
+		return applyTo(dbStructure.UsedTokens, m)
+	case "personal_tokens":
+		return applyTo(dbStructure.PersonalTokens, m)
+	default:
+		return fmt.Errorf("unknown table %q", m.Table)
+	}
+}
+
+func applyTo[K comparable, V any](table map[K]V, m mutation) error {
+	var key K
+	err := json.Unmarshal(m.Key, &key)
+	if err != nil {
+		return err
+	}
+
+	switch m.Op {
+	case opPut:
+		var value V
+		err = json.Unmarshal(m.Value, &value)
+		if err != nil {
+			return err
+		}
+		table[key] = value
+	case opDelete:
+		delete(table, key)
+	default:
+		return fmt.Errorf("unknown op %q", m.Op)
+	}
+
+	return nil
+}
+
+// wal is an append-only log of mutations, one JSON object per line
+type wal struct {
+	file *os.File
+	size int64
+}
+
+// openWAL opens the log at path, creating it if needed, and returns the
+// records of every complete update in it. A torn update at the end, left
+// by a crash during append, is cut off so new records start on a clean line.
+func openWAL(path string) (*wal, []mutation, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records []mutation
+	var good, offset int64
+	complete := 0
+	unterminated := false
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var m mutation
+			if json.Unmarshal(line, &m) != nil {
+				break
+			}
+			records = append(records, m)
+		}
+		offset += int64(len(line))
+		if len(records) > complete && records[len(records)-1].Last {
+			complete = len(records)
+			good = offset
+			unterminated = line[len(line)-1] != '\n'
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if info.Size() != good {
+		log.Printf("wal: discarding %d bytes of torn records from %s\n", info.Size()-good, path)
+	}
+
+	w := &wal{file: file}
+	err = w.truncate(good)
+	if err == nil && unterminated {
+		// the last record is whole but lost its newline
+		_, err = file.WriteAt([]byte{'\n'}, good)
+		w.size++
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return w, records[:complete], nil
+}
+
+// append writes the records and syncs them to disk
+func (w *wal) append(records []mutation) error {
+	var buf bytes.Buffer
+	for _, m := range records {
+		line, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	n, err := w.file.WriteAt(buf.Bytes(), w.size)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	return w.file.Sync()
+}
+
+// truncate cuts the log back to size bytes
+func (w *wal) truncate(size int64) error {
+	err := w.file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	w.size = size
+
+	return w.file.Sync()
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// writeFileAtomic replaces the file at path with data. The data is written
+// to a temporary file in the same directory, synced, and renamed over path,
+// so readers see either the old contents or the new ones, never a mix.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+
+	return nil
+}
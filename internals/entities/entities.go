@@ -0,0 +1,121 @@
+// Package entities finds hashtags and mentions in chirp bodies
+package entities
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Entity types
+const (
+	Hashtag = "hashtag"
+	Mention = "mention"
+)
+
+// Entity is a hashtag or mention in a chirp body. Start and End are byte
+// offsets into the body, End exclusive, covering the leading # or @.
+type Entity struct {
+	Type string `json:"type"`
+	// Text is the lowercased tag without its #, or the mentioned email
+	// without its @
+	Text string `json:"text"`
+	// UserId is the mentioned user, set once the mention is resolved
+	UserId int `json:"user_id,omitempty"`
+	Start  int `json:"start"`
+	End    int `json:"end"`
+}
+
+// Parse returns the hashtags and mentions in body, in order. A hashtag is
+// # followed by letters, digits and underscores, at least one a letter. A
+// mention is @ followed by an email address. Either must start the body
+// or follow a character that can't be part of a word, so "a#b" and the
+// domain of an email aren't matched.
+func Parse(body string) []Entity {
+	var found []Entity
+	for i := 0; i < len(body); {
+		r, size := utf8.DecodeRuneInString(body[i:])
+		if (r != '#' && r != '@') || !boundaryBefore(body, i) {
+			i += size
+			continue
+		}
+
+		var end int
+		var entity Entity
+		if r == '#' {
+			end = i + size + scanTag(body[i+size:])
+			tag := body[i+size : end]
+			if strings.IndexFunc(tag, unicode.IsLetter) < 0 {
+				i += size
+				continue
+			}
+			entity = Entity{Type: Hashtag, Text: strings.ToLower(tag)}
+		} else {
+			end = i + size + scanEmail(body[i+size:])
+			if end == i+size {
+				i += size
+				continue
+			}
+			entity = Entity{Type: Mention, Text: strings.ToLower(body[i+size : end])}
+		}
+		entity.Start = i
+		entity.End = end
+		found = append(found, entity)
+		i = end
+	}
+
+	return found
+}
+
+func boundaryBefore(body string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(body[:i])
+	return !isTagRune(r) && !strings.ContainsRune(".+-%@#", r)
+}
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+// scanTag returns the length of the tag at the start of s
+func scanTag(s string) int {
+	n := 0
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if !isTagRune(r) {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+// scanEmail returns the length of the email address at the start of s, or
+// 0 if there isn't one. Dots ending a sentence are left out.
+func scanEmail(s string) int {
+	isLocal := func(c byte) bool {
+		return c < utf8.RuneSelf && (isTagRune(rune(c)) || strings.IndexByte(".%+-", c) >= 0)
+	}
+	isDomain := func(c byte) bool {
+		return c < utf8.RuneSelf && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) || c == '.' || c == '-')
+	}
+
+	at := 0
+	for at < len(s) && isLocal(s[at]) {
+		at++
+	}
+	if at == 0 || at >= len(s) || s[at] != '@' {
+		return 0
+	}
+	end := at + 1
+	for end < len(s) && isDomain(s[end]) {
+		end++
+	}
+	end = at + 1 + len(strings.TrimRight(s[at+1:end], ".-"))
+	if !strings.Contains(s[at+1:end], ".") {
+		return 0
+	}
+	return end
+}
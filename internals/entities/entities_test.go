@@ -0,0 +1,35 @@
+package entities
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		body string
+		want []Entity
+	}{
+		{"no entities here", nil},
+		{"#Go and #go_lang!", []Entity{
+			{Type: Hashtag, Text: "go", Start: 0, End: 3},
+			{Type: Hashtag, Text: "go_lang", Start: 8, End: 16},
+		}},
+		{"issue#42 #42 #über", []Entity{
+			{Type: Hashtag, Text: "über", Start: 13, End: 19},
+		}},
+		{"hi @Walt@Example.com.", []Entity{
+			{Type: Mention, Text: "walt@example.com", Start: 3, End: 20},
+		}},
+		{"mail walt@example.com or @nobody", nil},
+		{"(@a@b.io) #x", []Entity{
+			{Type: Mention, Text: "a@b.io", Start: 1, End: 8},
+			{Type: Hashtag, Text: "x", Start: 10, End: 12},
+		}},
+	}
+	for _, tt := range tests {
+		if got := Parse(tt.body); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.body, got, tt.want)
+		}
+	}
+}
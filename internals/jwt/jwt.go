@@ -1,32 +1,127 @@
 package jwt
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+var keyring *Keyring
+
+// Claims are the claims of a Chirpy token. Access tokens also carry the
+// user's role and the space-separated scopes they grant; tokens issued
+// before roles existed have neither. Access and refresh tokens carry the
+// session they were issued to in sid, the OpenID Connect session claim,
+// rather than in jti: the ID stays random so every token of a session is
+// distinct, which refresh rotation relies on. Tokens mailed to a user
+// carry the address they were sent to, and reset tokens a stamp of the
+// password they replace.
+type Claims struct {
+	jwt.RegisteredClaims
+	Role          string `json:"role,omitempty"`
+	Scope         string `json:"scope,omitempty"`
+	SessionId     int    `json:"sid,omitempty"`
+	Email         string `json:"email,omitempty"`
+	PasswordStamp string `json:"pst,omitempty"`
+}
+
+// Scopes returns the scopes granted by the token
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// UseKeyring makes CreateToken sign with k's primary key and ValidateToken
+// accept any of k's unretired keys. Without a keyring, JWT_SECRET is used.
+func UseKeyring(k *Keyring) {
+	keyring = k
+}
+
+// CreateToken signs a token for userId. issuer is the token type, such as
+// "chirpy-mfa".
 func CreateToken(expires_in_seconds int, userId int, issuer string) (string, error) {
+	return createToken(expires_in_seconds, userId, issuer, Claims{})
+}
+
+// CreateAccessToken signs a "chirpy-access" token for userId's session
+// sessionId carrying role and scopes
+func CreateAccessToken(expires_in_seconds int, userId int, sessionId int, role string, scopes []string) (string, error) {
+	return createToken(expires_in_seconds, userId, "chirpy-access", Claims{
+		Role:      role,
+		Scope:     strings.Join(scopes, " "),
+		SessionId: sessionId,
+	})
+}
+
+// CreateRefreshToken signs a "chirpy-refresh" token for userId's session
+// sessionId
+func CreateRefreshToken(expires_in_seconds int, userId int, sessionId int) (string, error) {
+	return createToken(expires_in_seconds, userId, "chirpy-refresh", Claims{SessionId: sessionId})
+}
+
+// CreateEmailToken signs a token for userId to be mailed to email, such as
+// a "chirpy-verify" link. It is only good for that address.
+func CreateEmailToken(expires_in_seconds int, userId int, issuer string, email string) (string, error) {
+	return createToken(expires_in_seconds, userId, issuer, Claims{Email: email})
+}
+
+// CreateResetToken signs a "chirpy-reset" token for userId to be mailed to
+// email. It is only good for that address and while the password still
+// has passwordStamp.
+func CreateResetToken(expires_in_seconds int, userId int, email string, passwordStamp string) (string, error) {
+	return createToken(expires_in_seconds, userId, "chirpy-reset", Claims{Email: email, PasswordStamp: passwordStamp})
+}
+
+// createToken signs claims, with the registered claims filled in, as a
+// token of type issuer for userId
+func createToken(expires_in_seconds int, userId int, issuer string, claims Claims) (string, error) {
 	if expires_in_seconds == 0 {
 		expires_in_seconds = 3600
 	}
 	currentTime := time.Now()
 	convertedExpiration := time.Second * time.Duration(expires_in_seconds)
 
-	unsignedToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+	// a random ID keeps tokens minted in the same second distinct
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	method := jwt.SigningMethod(jwt.SigningMethodHS256)
+	var signingKey interface{} = []byte(os.Getenv("JWT_SECRET"))
+	var kid string
+	if keyring != nil {
+		key, err := keyring.primary()
+		if err != nil {
+			return "", err
+		}
+		method = key.signingMethod()
+		signingKey = key.signingKey()
+		kid = key.Id
+	}
+
+	claims.RegisteredClaims = jwt.RegisteredClaims{
 		Issuer:    issuer,
 		Subject:   strconv.Itoa(userId),
 		Audience:  nil,
 		ExpiresAt: jwt.NewNumericDate(currentTime.Add(convertedExpiration)),
 		NotBefore: nil,
 		IssuedAt:  jwt.NewNumericDate(currentTime),
-		ID:        "",
-	})
+		ID:        hex.EncodeToString(id),
+	}
+	unsignedToken := jwt.NewWithClaims(method, claims)
+
+	if kid != "" {
+		unsignedToken.Header["kid"] = kid
+	}
 
-	signedToken, err := unsignedToken.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	signedToken, err := unsignedToken.SignedString(signingKey)
 	if err != nil {
 		return "", err
 	}
@@ -36,10 +131,25 @@ func CreateToken(expires_in_seconds int, userId int, issuer string) (string, err
 
 // ValidateToken validates a token string. If it is a refresh token, it will return an error
 func ValidateToken(tokenString string, wantedType string) (*jwt.Token, error) {
-	claims := jwt.RegisteredClaims{}
+	claims := Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
+		if keyring == nil {
+			if token.Method.Alg() != HS256 {
+				return nil, errors.New("token algorithm does not match its key")
+			}
+			return []byte(os.Getenv("JWT_SECRET")), nil
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, err := keyring.lookup(kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, errors.New("token algorithm does not match its key")
+		}
+		return key.verificationKey(), nil
+	}, jwt.WithValidMethods([]string{HS256, EdDSA, RS256}))
 	if err != nil {
 		return nil, err
 	}
@@ -56,6 +166,15 @@ func ValidateToken(tokenString string, wantedType string) (*jwt.Token, error) {
 	return token, nil
 }
 
+// GetClaims returns the claims of a token from ValidateToken
+func GetClaims(token *jwt.Token) (*Claims, error) {
+	claims, ok := token.Claims.(*Claims)
+	if !ok {
+		return nil, errors.New("unexpected token claims")
+	}
+	return claims, nil
+}
+
 // GetUserIdFromToken gets the user ID from a token
 func GetUserIdFromToken(tokenString *jwt.Token) (int, error) {
 	idString, err := tokenString.Claims.GetSubject()
@@ -0,0 +1,444 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key states. Exactly one key is primary and signs new tokens. Verify keys
+// still validate tokens: new keys start there so every server knows them
+// before they sign anything, and a demoted primary stays there until the
+// tokens it signed have expired. Retired keys validate nothing.
+const (
+	StatusPrimary = "primary"
+	StatusVerify  = "verify"
+	StatusRetired = "retired"
+)
+
+// legacyKeyId names the key imported from JWT_SECRET. Tokens signed before
+// keyrings existed carry no kid and are checked against it.
+const legacyKeyId = "legacy"
+
+// reloadInterval is how often the keyring file is checked for changes made
+// by `chirpy keys`
+const reloadInterval = 5 * time.Second
+
+// Supported signing algorithms. HS256 keys are shared secrets; EdDSA
+// (Ed25519) and RS256 keys are key pairs whose public half is published
+// in the JWKS so other services can verify tokens.
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+	RS256 = "RS256"
+)
+
+// Key is one signing key of a Keyring. Secret holds the HS256 secret, or
+// the PKCS #8 DER private key for EdDSA and RS256.
+type Key struct {
+	Id        string    `json:"kid"`
+	Algorithm string    `json:"alg"`
+	Secret    []byte    `json:"secret,omitempty"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+
+	private crypto.Signer
+}
+
+// Keyring holds the signing keys, persisted as JSON at path
+type Keyring struct {
+	mux        *sync.RWMutex
+	path       string
+	keys       []Key
+	modTime    time.Time
+	lastReload time.Time
+}
+
+// LoadKeyring reads the keyring at path. If the file doesn't exist it is
+// created holding a single primary key: JWT_SECRET when it is set, so
+// tokens issued before keyrings stay valid, or else a fresh one.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{
+		mux:  &sync.RWMutex{},
+		path: path,
+	}
+
+	err := k.load()
+	if !errors.Is(err, os.ErrNotExist) {
+		return k, err
+	}
+
+	var key Key
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		key = Key{
+			Id:        legacyKeyId,
+			Algorithm: HS256,
+			Secret:    []byte(secret),
+			CreatedAt: time.Now().UTC(),
+		}
+	} else {
+		key, err = newKey(HS256)
+		if err != nil {
+			return nil, err
+		}
+	}
+	key.Status = StatusPrimary
+	k.keys = []Key{key}
+
+	return k, k.save()
+}
+
+// Keys returns the keys, oldest first, without their secrets
+func (k *Keyring) Keys() []Key {
+	k.maybeReload()
+
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	keys := make([]Key, len(k.keys))
+	for i, key := range k.keys {
+		key.Secret = nil
+		key.private = nil
+		keys[i] = key
+	}
+	return keys
+}
+
+// Generate adds a new verify-only key for alg and returns its id
+func (k *Keyring) Generate(alg string) (string, error) {
+	key, err := newKey(alg)
+	if err != nil {
+		return "", err
+	}
+	key.Status = StatusVerify
+
+	return key.Id, k.modify(func(keys []Key) ([]Key, error) {
+		return append(keys, key), nil
+	})
+}
+
+// Promote makes kid the primary key. The previous primary keeps verifying.
+func (k *Keyring) Promote(kid string) error {
+	return k.modify(func(keys []Key) ([]Key, error) {
+		i := findKey(keys, kid)
+		if i < 0 {
+			return nil, fmt.Errorf("no key %q", kid)
+		}
+		if keys[i].Status == StatusRetired {
+			return nil, fmt.Errorf("key %q is retired", kid)
+		}
+		for j := range keys {
+			if keys[j].Status == StatusPrimary {
+				keys[j].Status = StatusVerify
+			}
+		}
+		keys[i].Status = StatusPrimary
+		return keys, nil
+	})
+}
+
+// Retire stops kid from validating tokens. The primary key can't be retired.
+func (k *Keyring) Retire(kid string) error {
+	return k.modify(func(keys []Key) ([]Key, error) {
+		i := findKey(keys, kid)
+		if i < 0 {
+			return nil, fmt.Errorf("no key %q", kid)
+		}
+		if keys[i].Status == StatusPrimary {
+			return nil, fmt.Errorf("key %q is primary; promote another key first", kid)
+		}
+		keys[i].Status = StatusRetired
+		return keys, nil
+	})
+}
+
+// primary returns the signing key
+func (k *Keyring) primary() (Key, error) {
+	k.maybeReload()
+
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	for _, key := range k.keys {
+		if key.Status == StatusPrimary {
+			return key, nil
+		}
+	}
+	return Key{}, errors.New("keyring has no primary key")
+}
+
+// lookup returns the key that may validate a token with the given kid.
+// An unknown kid triggers a reload, in case the key was added since.
+func (k *Keyring) lookup(kid string) (Key, error) {
+	if kid == "" {
+		kid = legacyKeyId
+	}
+	k.maybeReload()
+
+	key, ok := k.find(kid)
+	if !ok {
+		k.reload()
+		key, ok = k.find(kid)
+	}
+	if !ok {
+		return Key{}, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if key.Status == StatusRetired {
+		return Key{}, fmt.Errorf("signing key %q is retired", kid)
+	}
+	return key, nil
+}
+
+func (k *Keyring) find(kid string) (Key, bool) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	i := findKey(k.keys, kid)
+	if i < 0 {
+		return Key{}, false
+	}
+	return k.keys[i], true
+}
+
+// modify applies fn to a fresh copy of the file's keys and saves the result
+func (k *Keyring) modify(fn func(keys []Key) ([]Key, error)) error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	err := k.loadLocked()
+	if err != nil {
+		return err
+	}
+
+	keys := append([]Key(nil), k.keys...)
+	keys, err = fn(keys)
+	if err != nil {
+		return err
+	}
+	k.keys = keys
+
+	return k.saveLocked()
+}
+
+// maybeReload rereads the file if it changed, at most every reloadInterval
+func (k *Keyring) maybeReload() {
+	k.mux.RLock()
+	due := time.Since(k.lastReload) >= reloadInterval
+	k.mux.RUnlock()
+
+	if due {
+		k.reload()
+	}
+}
+
+func (k *Keyring) reload() {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	k.lastReload = time.Now()
+	info, err := os.Stat(k.path)
+	if err != nil || info.ModTime().Equal(k.modTime) {
+		return
+	}
+	err = k.loadLocked()
+	if err != nil {
+		// keep serving with the keys already loaded
+		fmt.Fprintf(os.Stderr, "Error reloading keyring %s: %s\n", k.path, err)
+	}
+}
+
+func (k *Keyring) load() error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	return k.loadLocked()
+}
+
+func (k *Keyring) loadLocked() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+
+	var keys []Key
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return fmt.Errorf("reading keyring %s: %w", k.path, err)
+	}
+	for i := range keys {
+		err = keys[i].parse()
+		if err != nil {
+			return fmt.Errorf("reading keyring %s: key %s: %w", k.path, keys[i].Id, err)
+		}
+	}
+	k.keys = keys
+	k.modTime = info.ModTime()
+	k.lastReload = time.Now()
+
+	return nil
+}
+
+func (k *Keyring) save() error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	return k.saveLocked()
+}
+
+// saveLocked writes the keyring through a temporary file so a crash never
+// leaves it half written. The file holds secrets and is private to the owner.
+func (k *Keyring) saveLocked() error {
+	sort.SliceStable(k.keys, func(i, j int) bool { return k.keys[i].CreatedAt.Before(k.keys[j].CreatedAt) })
+	data, err := json.MarshalIndent(k.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), filepath.Base(k.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), k.path)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	k.modTime = info.ModTime()
+	return nil
+}
+
+func findKey(keys []Key, kid string) int {
+	for i, key := range keys {
+		if key.Id == kid {
+			return i
+		}
+	}
+	return -1
+}
+
+// newKey returns a random key for alg
+func newKey(alg string) (Key, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return Key{}, err
+	}
+	key := Key{
+		Id:        hex.EncodeToString(id),
+		Algorithm: alg,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var private any
+	switch alg {
+	case HS256:
+		key.Secret = make([]byte, 32)
+		_, err = rand.Read(key.Secret)
+		return key, err
+	case EdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case RS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return Key{}, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	key.Secret, err = x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return Key{}, err
+	}
+	return key, key.parse()
+}
+
+// parse decodes the private key of an asymmetric key
+func (key *Key) parse() error {
+	switch key.Algorithm {
+	case HS256:
+		return nil
+	case EdDSA, RS256:
+	default:
+		return fmt.Errorf("unsupported algorithm %q", key.Algorithm)
+	}
+
+	private, err := x509.ParsePKCS8PrivateKey(key.Secret)
+	if err != nil {
+		return err
+	}
+	switch private := private.(type) {
+	case ed25519.PrivateKey:
+		if key.Algorithm == EdDSA {
+			key.private = private
+			return nil
+		}
+	case *rsa.PrivateKey:
+		if key.Algorithm == RS256 {
+			key.private = private
+			return nil
+		}
+	}
+	return fmt.Errorf("private key does not match algorithm %s", key.Algorithm)
+}
+
+// signingMethod returns the jwt method for the key's algorithm
+func (key Key) signingMethod() jwt.SigningMethod {
+	switch key.Algorithm {
+	case EdDSA:
+		return jwt.SigningMethodEdDSA
+	case RS256:
+		return jwt.SigningMethodRS256
+	default:
+		return jwt.SigningMethodHS256
+	}
+}
+
+// signingKey returns what jwt needs to sign with the key
+func (key Key) signingKey() any {
+	if key.private != nil {
+		return key.private
+	}
+	return key.Secret
+}
+
+// verificationKey returns what jwt needs to verify with the key
+func (key Key) verificationKey() any {
+	if key.private != nil {
+		return key.private.Public()
+	}
+	return key.Secret
+}
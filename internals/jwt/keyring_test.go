@@ -0,0 +1,176 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestKeyRotation(t *testing.T) {
+	t.Setenv("JWT_SECRET", "old secret")
+	k, err := LoadKeyring(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseKeyring(k)
+	defer UseKeyring(nil)
+
+	oldToken, err := CreateToken(60, 1, "chirpy-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kid, err := k.Generate(HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.Promote(kid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := CreateToken(60, 1, "chirpy-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ValidateToken(newToken, "chirpy-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != kid {
+		t.Fatalf("new token signed with %v, want %s", parsed.Header["kid"], kid)
+	}
+	_, err = ValidateToken(oldToken, "chirpy-access")
+	if err != nil {
+		t.Fatalf("token from the demoted key should still validate: %v", err)
+	}
+
+	err = k.Retire(legacyKeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateToken(oldToken, "chirpy-access")
+	if err == nil {
+		t.Fatal("token from a retired key validated")
+	}
+	if k.Retire(kid) == nil {
+		t.Fatal("retired the primary key")
+	}
+}
+
+func TestAsymmetricKeysVerifyWithJWKS(t *testing.T) {
+	t.Setenv("JWT_SECRET", "old secret")
+	k, err := LoadKeyring(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseKeyring(k)
+	defer UseKeyring(nil)
+
+	for _, alg := range []string{EdDSA, RS256} {
+		kid, err := k.Generate(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = k.Promote(kid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := CreateToken(60, 7, "chirpy-access")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// verify the way another service would: with only the published keys
+		var jwk *JWK
+		for _, candidate := range k.JWKS().Keys {
+			if candidate.Kid == kid {
+				c := candidate
+				jwk = &c
+			}
+		}
+		if jwk == nil {
+			t.Fatalf("%s key %s missing from the JWKS", alg, kid)
+		}
+		parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+			return publicKey(t, *jwk), nil
+		}, jwt.WithValidMethods([]string{alg}))
+		if err != nil {
+			t.Fatalf("%s token did not verify with the JWKS: %v", alg, err)
+		}
+		if sub, _ := parsed.Claims.GetSubject(); sub != "7" {
+			t.Fatalf("subject = %q, want 7", sub)
+		}
+
+		_, err = ValidateToken(token, "chirpy-access")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, jwk := range k.JWKS().Keys {
+		if jwk.Kid == legacyKeyId {
+			t.Fatal("the HS256 secret was published")
+		}
+	}
+}
+
+func TestTokenAlgorithmMustMatchKey(t *testing.T) {
+	k, err := LoadKeyring(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseKeyring(k)
+	defer UseKeyring(nil)
+
+	kid, err := k.Generate(EdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := k.JWKS().Keys[0]
+
+	// an HS256 token "signed" with the public key must not pass as EdDSA
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:  "chirpy-access",
+		Subject: "1",
+	})
+	forged.Header["kid"] = kid
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	signed, err := forged.SignedString(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateToken(signed, "chirpy-access")
+	if err == nil {
+		t.Fatal("accepted an HS256 token signed with a public key")
+	}
+}
+
+func publicKey(t *testing.T, jwk JWK) interface{} {
+	t.Helper()
+	switch jwk.Kty {
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ed25519.PublicKey(x)
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	t.Fatalf("unexpected key type %q", jwk.Kty)
+	return nil
+}
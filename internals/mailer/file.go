@@ -0,0 +1,37 @@
+package mailer
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// File appends every message to a file instead of sending it, for
+// development
+type File struct {
+	Path string
+	From string
+
+	mux sync.Mutex
+}
+
+// Send appends msg to the file, followed by a blank line
+func (f *File) Send(msg Message) error {
+	err := msg.validate()
+	if err != nil {
+		return err
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(format(f.From, msg, time.Now()), "\r\n"...))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	_ Mailer = SMTP{}
+	_ Mailer = (*File)(nil)
+	_ Mailer = (*Memory)(nil)
+)
+
+func TestFormat(t *testing.T) {
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	got := string(format("chirpy@example.com", Message{
+		To:      "user@example.com",
+		Subject: "Vérify",
+		Body:    "line one\nline two",
+	}, date))
+
+	for _, want := range []string{
+		"From: chirpy@example.com\r\n",
+		"To: user@example.com\r\n",
+		"Subject: =?utf-8?q?V=C3=A9rify?=\r\n",
+		"Date: Tue, 02 Jan 2024 03:04:05 +0000\r\n",
+		"\r\n\r\nline one\r\nline two\r\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("message is missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestHeaderInjectionRejected(t *testing.T) {
+	m := &Memory{}
+	err := m.Send(Message{To: "user@example.com\r\nBcc: victim@example.com", Subject: "hi"})
+	if err == nil {
+		t.Fatal("recipient with a line break was accepted")
+	}
+	err = m.Send(Message{To: "user@example.com", Subject: "hi\nBcc: victim@example.com"})
+	if err == nil {
+		t.Fatal("subject with a line break was accepted")
+	}
+	if len(m.Sent()) != 0 {
+		t.Fatalf("sent %+v", m.Sent())
+	}
+}
+
+func TestFileAndMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.txt")
+	f := &File{Path: path, From: "chirpy@example.com"}
+	m := &Memory{}
+	for _, to := range []string{"a@example.com", "b@example.com", "a@example.com"} {
+		msg := Message{To: to, Subject: "hello", Body: "body for " + to}
+		if err := f.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "Subject: hello"); n != 3 {
+		t.Fatalf("file holds %d messages, want 3", n)
+	}
+
+	if len(m.Sent()) != 3 {
+		t.Fatalf("memory holds %d messages, want 3", len(m.Sent()))
+	}
+	if msg, ok := m.Last("b@example.com"); !ok || msg.Body != "body for b@example.com" {
+		t.Fatalf("last message to b is %+v", msg)
+	}
+	if _, ok := m.Last("c@example.com"); ok {
+		t.Fatal("found a message to c")
+	}
+}
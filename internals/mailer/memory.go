@@ -0,0 +1,41 @@
+package mailer
+
+import "sync"
+
+// Memory keeps the messages it is sent, for tests
+type Memory struct {
+	mux  sync.Mutex
+	sent []Message
+}
+
+// Send records msg
+func (m *Memory) Send(msg Message) error {
+	err := msg.validate()
+	if err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns the messages sent so far, oldest first
+func (m *Memory) Sent() []Message {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]Message{}, m.sent...)
+}
+
+// Last returns the most recent message to to
+func (m *Memory) Last(to string) (Message, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == to {
+			return m.sent[i], true
+		}
+	}
+	return Message{}, false
+}
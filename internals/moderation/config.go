@@ -0,0 +1,134 @@
+package moderation
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Filter types in a Config
+const (
+	TypeWords = "words"
+	TypeRegex = "regex"
+	TypeLinks = "links"
+)
+
+// Config describes a pipeline, usually read from a JSON file
+type Config struct {
+	Filters []FilterConfig `json:"filters"`
+}
+
+// FilterConfig describes one filter. Which fields apply depends on Type.
+type FilterConfig struct {
+	// Name identifies the filter in findings. It defaults to Type.
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Action Action `json:"action"`
+
+	// Words and WordsFile are for word filters. WordsFile holds one word
+	// or phrase per line; blank lines and lines starting with # are
+	// skipped. A relative path is relative to the config file.
+	Words     []string `json:"words,omitempty"`
+	WordsFile string   `json:"words_file,omitempty"`
+
+	// Pattern is for regex filters
+	Pattern string `json:"pattern,omitempty"`
+
+	// Domains is for link filters
+	Domains []string `json:"domains,omitempty"`
+}
+
+// DefaultConfig masks the words chirpy has always masked
+func DefaultConfig() Config {
+	return Config{Filters: []FilterConfig{{
+		Name:   "profanity",
+		Type:   TypeWords,
+		Action: Mask,
+		Words:  []string{"kerfuffle", "sharbert", "fornax"},
+	}}}
+}
+
+// LoadConfig reads the config at path and the word files it names
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	for i, f := range config.Filters {
+		if f.WordsFile == "" {
+			continue
+		}
+		file := f.WordsFile
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		list, err := readWords(file)
+		if err != nil {
+			return config, err
+		}
+		config.Filters[i].Words = append(config.Filters[i].Words, list...)
+	}
+
+	return config, nil
+}
+
+func readWords(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var list []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list = append(list, line)
+	}
+	return list, scanner.Err()
+}
+
+// Pipeline builds the pipeline the config describes
+func (c Config) Pipeline() (*Pipeline, error) {
+	var filters []Filter
+	for i, f := range c.Filters {
+		name := f.Name
+		if name == "" {
+			name = f.Type
+		}
+		switch f.Action {
+		case Mask, Flag, Reject:
+		default:
+			return nil, fmt.Errorf("filter %d (%s): unknown action %q", i, name, f.Action)
+		}
+
+		switch f.Type {
+		case TypeWords:
+			filters = append(filters, NewWordFilter(name, f.Action, f.Words))
+		case TypeRegex:
+			filter, err := NewRegexFilter(name, f.Action, f.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("filter %d (%s): %w", i, name, err)
+			}
+			filters = append(filters, filter)
+		case TypeLinks:
+			filters = append(filters, NewLinkFilter(name, f.Action, f.Domains))
+		default:
+			return nil, fmt.Errorf("filter %d (%s): unknown type %q", i, name, f.Type)
+		}
+	}
+
+	return New(filters...), nil
+}
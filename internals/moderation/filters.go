@@ -0,0 +1,141 @@
+package moderation
+
+import (
+	"regexp"
+	"strings"
+)
+
+// rule holds what every filter has
+type rule struct {
+	name   string
+	action Action
+}
+
+func (r rule) Name() string {
+	return r.name
+}
+
+func (r rule) Action() Action {
+	return r.action
+}
+
+// WordFilter finds listed words and phrases. Matching is on normalized
+// words, so case, accents, lookalike letters, invisible characters and
+// surrounding punctuation don't hide a word: "Kerfuffle!" and "kërfuffle"
+// both match "kerfuffle". Only whole words match.
+type WordFilter struct {
+	rule
+	// phrases maps the first word of each phrase to the phrases
+	phrases map[string][][]string
+}
+
+// NewWordFilter returns a filter for words. An entry of several words
+// matches them in sequence, whatever lies between them.
+func NewWordFilter(name string, action Action, list []string) *WordFilter {
+	f := &WordFilter{rule: rule{name: name, action: action}, phrases: map[string][][]string{}}
+	for _, entry := range list {
+		var phrase []string
+		for _, w := range words(entry) {
+			phrase = append(phrase, w.text)
+		}
+		if len(phrase) > 0 {
+			f.phrases[phrase[0]] = append(f.phrases[phrase[0]], phrase)
+		}
+	}
+	return f
+}
+
+func (f *WordFilter) Find(text string) []Match {
+	var matches []Match
+	found := words(text)
+	for i, w := range found {
+	phrases:
+		for _, phrase := range f.phrases[w.text] {
+			if i+len(phrase) > len(found) {
+				continue
+			}
+			for j, p := range phrase {
+				if found[i+j].text != p {
+					continue phrases
+				}
+			}
+			matches = append(matches, Match{Start: w.start, End: found[i+len(phrase)-1].end})
+		}
+	}
+	return matches
+}
+
+// RegexFilter finds matches of a regular expression in the original text
+type RegexFilter struct {
+	rule
+	pattern *regexp.Regexp
+}
+
+// NewRegexFilter returns a filter for pattern, in the syntax of the regexp
+// package
+func NewRegexFilter(name string, action Action, pattern string) (*RegexFilter, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &RegexFilter{rule: rule{name: name, action: action}, pattern: re}, nil
+}
+
+func (f *RegexFilter) Find(text string) []Match {
+	var matches []Match
+	for _, loc := range f.pattern.FindAllStringIndex(text, -1) {
+		if loc[1] > loc[0] {
+			matches = append(matches, Match{Start: loc[0], End: loc[1]})
+		}
+	}
+	return matches
+}
+
+// linkPattern finds links, with or without a scheme. The first group is
+// the host.
+var linkPattern = regexp.MustCompile(`(?i)(?:\bhttps?://)?\b((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,})\b(?:[/?#:][^\s]*)?`)
+
+// LinkFilter finds links to blocked domains or their subdomains
+type LinkFilter struct {
+	rule
+	domains map[string]bool
+}
+
+// NewLinkFilter returns a filter for links to domains
+func NewLinkFilter(name string, action Action, domains []string) *LinkFilter {
+	f := &LinkFilter{rule: rule{name: name, action: action}, domains: map[string]bool{}}
+	for _, d := range domains {
+		d = strings.Trim(strings.ToLower(strings.TrimSpace(d)), ".")
+		if d != "" {
+			f.domains[d] = true
+		}
+	}
+	return f
+}
+
+func (f *LinkFilter) Find(text string) []Match {
+	var matches []Match
+	for _, loc := range linkPattern.FindAllStringSubmatchIndex(text, -1) {
+		if !f.blocked(strings.ToLower(text[loc[2]:loc[3]])) {
+			continue
+		}
+		// punctuation ending a sentence isn't part of the link
+		end := loc[0] + len(strings.TrimRight(text[loc[0]:loc[1]], ".,;:!?)'\""))
+		matches = append(matches, Match{Start: loc[0], End: end})
+	}
+	return matches
+}
+
+// blocked reports whether host or a domain above it is blocked
+func (f *LinkFilter) blocked(host string) bool {
+	for {
+		if f.domains[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
@@ -0,0 +1,151 @@
+// Package moderation runs chirp bodies through a chain of filters. Each
+// filter can mask the text it finds, reject the chirp or flag it for
+// review.
+package moderation
+
+import "sort"
+
+// Action is what happens to text a filter finds
+type Action string
+
+const (
+	// Mask replaces the text with asterisks
+	Mask Action = "mask"
+	// Flag keeps the text but marks the chirp for review
+	Flag Action = "flag"
+	// Reject refuses the chirp
+	Reject Action = "reject"
+)
+
+// mask is what masked text is replaced with
+const mask = "****"
+
+// Match is a span of text a filter objects to, as byte offsets with End
+// exclusive
+type Match struct {
+	Start int
+	End   int
+}
+
+// Filter finds objectionable text. Filters are run by a Pipeline, which
+// takes the filter's Action on everything it finds.
+type Filter interface {
+	Name() string
+	Action() Action
+	Find(text string) []Match
+}
+
+// Finding records a filter's match in a moderated body. Start and End are
+// byte offsets into Result.Body, so a masked match covers the asterisks.
+type Finding struct {
+	Filter string `json:"filter"`
+	Action Action `json:"action"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+}
+
+// Result is the outcome of moderating a body
+type Result struct {
+	// Body is the text with masked spans replaced
+	Body     string
+	Rejected bool
+	Findings []Finding
+}
+
+// Flagged reports whether any filter flagged the body for review
+func (r Result) Flagged() bool {
+	for _, f := range r.Findings {
+		if f.Action == Flag {
+			return true
+		}
+	}
+	return false
+}
+
+// Pipeline is a chain of filters
+type Pipeline struct {
+	filters []Filter
+}
+
+// New returns a pipeline running filters in order
+func New(filters ...Filter) *Pipeline {
+	return &Pipeline{filters: filters}
+}
+
+// Moderate runs text through every filter. Each filter sees the original
+// text, so one filter's mask can't hide a match from another.
+func (p *Pipeline) Moderate(text string) Result {
+	var result Result
+	var masks []Match
+	for _, f := range p.filters {
+		action := f.Action()
+		for _, m := range f.Find(text) {
+			result.Findings = append(result.Findings, Finding{Filter: f.Name(), Action: action, Start: m.Start, End: m.End})
+			switch action {
+			case Mask:
+				masks = append(masks, m)
+			case Reject:
+				result.Rejected = true
+			}
+		}
+	}
+
+	spans := merge(masks)
+	result.Body = applyMasks(text, spans)
+	for i := range result.Findings {
+		result.Findings[i].Start = shift(spans, result.Findings[i].Start, false)
+		result.Findings[i].End = shift(spans, result.Findings[i].End, true)
+	}
+	sort.SliceStable(result.Findings, func(i, j int) bool {
+		return result.Findings[i].Start < result.Findings[j].Start
+	})
+
+	return result
+}
+
+// merge sorts spans and joins the overlapping ones
+func merge(spans []Match) []Match {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+	var merged []Match
+	for _, s := range spans {
+		if n := len(merged); n > 0 && s.Start < merged[n-1].End {
+			if s.End > merged[n-1].End {
+				merged[n-1].End = s.End
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+func applyMasks(text string, spans []Match) string {
+	body := make([]byte, 0, len(text))
+	last := 0
+	for _, s := range spans {
+		body = append(body, text[last:s.Start]...)
+		body = append(body, mask...)
+		last = s.End
+	}
+	return string(append(body, text[last:]...))
+}
+
+// shift maps an offset in the original text to the masked body. An offset
+// inside a masked span moves to the start of its mask, or to the end for
+// the end of a match.
+func shift(spans []Match, offset int, end bool) int {
+	delta := 0
+	for _, s := range spans {
+		if offset <= s.Start {
+			break
+		}
+		if offset < s.End {
+			if end {
+				return s.Start + delta + len(mask)
+			}
+			return s.Start + delta
+		}
+		delta += len(mask) - (s.End - s.Start)
+	}
+	return offset + delta
+}
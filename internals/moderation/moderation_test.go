@@ -0,0 +1,102 @@
+package moderation
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultWordsMasked(t *testing.T) {
+	pipeline, err := DefaultConfig().Pipeline()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"what a kerfuffle", "what a ****"},
+		{"Kerfuffle! said the fornax.", "****! said the ****."},
+		{"KËRFUFFLE and ｓｈａｒｂｅｒｔ", "**** and ****"},
+		{"ker\u200bfuffle k3rfuffl3", "**** ****"},
+		{"kerfuffles are fine", "kerfuffles are fine"},
+	}
+	for _, tt := range tests {
+		result := pipeline.Moderate(tt.body)
+		if result.Body != tt.want || result.Rejected || result.Flagged() {
+			t.Errorf("Moderate(%q) = %+v, want body %q", tt.body, result, tt.want)
+		}
+	}
+}
+
+func TestFindingsPointIntoBody(t *testing.T) {
+	regex, err := NewRegexFilter("shouting", Flag, `[A-Z]{5,}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := New(
+		NewWordFilter("profanity", Mask, []string{"kerfuffle", "big deal"}),
+		regex,
+		NewLinkFilter("spam", Reject, []string{"spam.example"}),
+	)
+
+	result := pipeline.Moderate("KERFUFFLE, no BIG... deal: see https://www.Spam.example/x.")
+	if result.Body != "****, no ****: see https://www.Spam.example/x." {
+		t.Fatalf("body is %q", result.Body)
+	}
+	want := []Finding{
+		{Filter: "profanity", Action: Mask, Start: 0, End: 4},
+		{Filter: "shouting", Action: Flag, Start: 0, End: 4},
+		{Filter: "profanity", Action: Mask, Start: 9, End: 13},
+		{Filter: "spam", Action: Reject, Start: 19, End: 45},
+	}
+	if !reflect.DeepEqual(result.Findings, want) {
+		t.Fatalf("findings are %+v, want %+v", result.Findings, want)
+	}
+	if !result.Rejected || !result.Flagged() {
+		t.Fatalf("result is %+v, want it rejected and flagged", result)
+	}
+
+	result = pipeline.Moderate("unspam.example and spam.example.org are fine")
+	if len(result.Findings) != 0 {
+		t.Fatalf("findings are %+v, want none", result.Findings)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "words.txt"), []byte("# banned\nsharbert\n\nfornax\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "moderation.json")
+	err = os.WriteFile(path, []byte(`{"filters": [
+		{"type": "words", "action": "reject", "words": ["kerfuffle"], "words_file": "words.txt"},
+		{"name": "links", "type": "links", "action": "flag", "domains": ["evil.example"]}
+	]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"kerfuffle", "sharbert", "fornax"}; !reflect.DeepEqual(config.Filters[0].Words, want) {
+		t.Fatalf("words are %q, want %q", config.Filters[0].Words, want)
+	}
+	pipeline, err := config.Pipeline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := pipeline.Moderate("Fornax?"); !result.Rejected || result.Findings[0].Filter != "words" {
+		t.Fatalf("result is %+v, want a rejection by the words filter", result)
+	}
+
+	config.Filters[1].Action = "delete"
+	if _, err := config.Pipeline(); err == nil {
+		t.Fatal("pipeline built with an unknown action")
+	}
+}
@@ -0,0 +1,127 @@
+package moderation
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// lookalikes lists, for each plain letter, the accented letters and
+// letters of other scripts that are read as it
+var lookalikes = map[rune]string{
+	'a': "àáâãäåāăąǎȁȃạảấầẩẫậắằẳẵặαаɑ",
+	'b': "ƀɓвь",
+	'c': "çćĉċčсϲ",
+	'd': "ďđɗԁ",
+	'e': "èéêëēĕėęěȅȇẹẻẽếềểễệеєε",
+	'f': "ƒ",
+	'g': "ĝğġģǧɡ",
+	'h': "ĥħһ",
+	'i': "ìíîïĩīĭįıǐȉȋỉịіїιɩ",
+	'j': "ĵјϳ",
+	'k': "ķĸκк",
+	'l': "ĺļľŀłӏ",
+	'n': "ñńņňŉηп",
+	'o': "òóôõöøōŏőǒȍȏọỏốồổỗộớờởỡợοоσ",
+	'p': "ρр",
+	'r': "ŕŗřȑȓг",
+	's': "śŝşšșѕ",
+	't': "ţťŧțτт",
+	'u': "ùúûüũūŭůűųǔȕȗụủứừửữựυ",
+	'v': "ν",
+	'w': "ŵẁẃẅω",
+	'x': "хχ",
+	'y': "ýÿŷȳỳỵỷỹу",
+	'z': "źżžƶ",
+}
+
+// leet maps digits used in place of letters
+var leet = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+}
+
+var folds = map[rune]rune{}
+
+func init() {
+	for base, variants := range lookalikes {
+		for _, r := range variants {
+			folds[r] = base
+			folds[unicode.ToUpper(r)] = base
+		}
+	}
+	for r, base := range leet {
+		folds[r] = base
+	}
+}
+
+// Normalize returns the form of word that filters compare: lowercase, with
+// accents, lookalike letters, fullwidth forms and digits standing in for
+// letters mapped to plain ASCII, and invisible characters removed
+func Normalize(word string) string {
+	var b strings.Builder
+	for _, r := range word {
+		if ignorable(r) {
+			continue
+		}
+		// fullwidth ASCII
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0
+		}
+		r = unicode.ToLower(r)
+		if base, ok := folds[r]; ok {
+			r = base
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ignorable reports whether r is invisible within a word: a combining
+// mark or a format character such as a zero-width space or soft hyphen
+func ignorable(r rune) bool {
+	return unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Cf, r)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || ignorable(r)
+}
+
+// word is a run of word characters in a text, normalized
+type word struct {
+	text  string
+	start int
+	end   int
+}
+
+// words splits text into normalized words, dropping the punctuation and
+// spaces between them
+func words(text string) []word {
+	var found []word
+	start := -1
+	for i := 0; i <= len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if i < len(text) && isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+			i += size
+			continue
+		}
+		if start >= 0 {
+			if w := Normalize(text[start:i]); w != "" {
+				found = append(found, word{text: w, start: start, end: i})
+			}
+			start = -1
+		}
+		if i == len(text) {
+			break
+		}
+		i += size
+	}
+	return found
+}
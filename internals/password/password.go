@@ -0,0 +1,185 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// Params selects the algorithm new hashes are made with and its cost
+type Params struct {
+	Algorithm string
+
+	// argon2id
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+
+	// bcrypt
+	BcryptCost int
+}
+
+// DefaultParams follow the OWASP recommendation for argon2id
+var DefaultParams = Params{
+	Algorithm:   Argon2id,
+	Memory:      64 * 1024,
+	Iterations:  1,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+	BcryptCost:  12,
+}
+
+// Hasher hashes and verifies passwords
+type Hasher struct {
+	params Params
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+// NewHasher returns a Hasher that creates hashes with params
+func NewHasher(params Params) (*Hasher, error) {
+	switch params.Algorithm {
+	case Argon2id:
+		if params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 ||
+			params.SaltLength == 0 || params.KeyLength == 0 {
+			return nil, errors.New("argon2id parameters must be positive")
+		}
+	case Bcrypt:
+		if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", params.Algorithm)
+	}
+
+	return &Hasher{params: params}, nil
+}
+
+// Default returns a Hasher using DefaultParams
+func Default() *Hasher {
+	return &Hasher{params: DefaultParams}
+}
+
+// Hash returns an encoded hash of password
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.params.Algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.params.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	p := h.params
+	salt := make([]byte, p.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify reports whether password matches the stored hash. needsRehash is
+// set when the match succeeded but the hash should be replaced: it uses
+// another algorithm, weaker parameters than the Hasher's, or is a legacy
+// plaintext password. Comparisons run in constant time.
+func (h *Hasher) Verify(password, stored string) (ok bool, needsRehash bool, err error) {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		p, salt, key, err := decodeArgon2id(stored)
+		if err != nil {
+			return false, false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return false, false, nil
+		}
+		weaker := p.Memory < h.params.Memory || p.Iterations < h.params.Iterations ||
+			p.Parallelism < h.params.Parallelism || uint32(len(key)) < h.params.KeyLength
+		return true, h.params.Algorithm != Argon2id || weaker, nil
+
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(stored))
+		if err != nil {
+			return false, false, err
+		}
+		return true, h.params.Algorithm != Bcrypt || cost < h.params.BcryptCost, nil
+
+	default:
+		// stored before passwords were hashed
+		ok := subtle.ConstantTimeCompare([]byte(password), []byte(stored)) == 1
+		return ok, ok, nil
+	}
+}
+
+// VerifyMissing spends the same time as a failed Verify. Call it when the
+// account doesn't exist, so a missing user takes as long to reject as a
+// wrong password.
+func (h *Hasher) VerifyMissing(password string) {
+	h.dummyOnce.Do(func() {
+		h.dummy, _ = h.Hash("chirpy dummy password")
+	})
+	h.Verify(password, h.dummy)
+}
+
+func decodeArgon2id(encoded string) (Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return Params{}, nil, nil, errors.New("malformed argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return Params{}, nil, nil, err
+	}
+	if version != argon2.Version {
+		return Params{}, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	p := Params{Algorithm: Argon2id}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
+	if err != nil {
+		return Params{}, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Params{}, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Params{}, nil, nil, err
+	}
+
+	return p, salt, key, nil
+}
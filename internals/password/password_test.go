@@ -0,0 +1,82 @@
+package password
+
+import (
+	"strings"
+	"testing"
+)
+
+var fastArgon2 = Params{
+	Algorithm:   Argon2id,
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+	BcryptCost:  4,
+}
+
+func TestHashAndVerify(t *testing.T) {
+	h, err := NewHasher(fastArgon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := h.Hash("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		t.Fatalf("unexpected hash format %q", hash)
+	}
+
+	ok, needsRehash, err := h.Verify("hunter2", hash)
+	if err != nil || !ok || needsRehash {
+		t.Fatalf("Verify(correct) = %v, %v, %v", ok, needsRehash, err)
+	}
+	ok, _, err = h.Verify("hunter3", hash)
+	if err != nil || ok {
+		t.Fatalf("Verify(wrong) = %v, %v", ok, err)
+	}
+}
+
+func TestVerifyFlagsRehash(t *testing.T) {
+	weak, err := NewHasher(fastArgon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stronger := fastArgon2
+	stronger.Memory = 128
+	strong, err := NewHasher(stronger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptParams := fastArgon2
+	bcryptParams.Algorithm = Bcrypt
+	bc, err := NewHasher(bcryptParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weakHash, _ := weak.Hash("pw")
+	bcryptHash, _ := bc.Hash("pw")
+
+	tests := []struct {
+		name   string
+		stored string
+	}{
+		{"plaintext", "pw"},
+		{"weaker argon2id", weakHash},
+		{"bcrypt", bcryptHash},
+	}
+	for _, tt := range tests {
+		ok, needsRehash, err := strong.Verify("pw", tt.stored)
+		if err != nil || !ok || !needsRehash {
+			t.Errorf("%s: Verify = %v, %v, %v; want true, true, nil", tt.name, ok, needsRehash, err)
+		}
+	}
+
+	ok, needsRehash, err := strong.Verify("nope", "pw")
+	if err != nil || ok || needsRehash {
+		t.Errorf("plaintext mismatch: Verify = %v, %v, %v", ok, needsRehash, err)
+	}
+}
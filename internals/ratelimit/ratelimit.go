@@ -0,0 +1,126 @@
+// Package ratelimit keeps token buckets for rate limiting requests
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many calls to Allow pass between sweeps of idle
+// buckets
+const sweepEvery = 1024
+
+// Limit allows Requests per Period. Unused requests build up to a burst of
+// Requests.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// rate is how many tokens the bucket gains per second
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// Decision is the outcome of a call to Allow
+type Decision struct {
+	Allowed bool
+	Limit   Limit
+	// Remaining is how many more requests would be allowed right now
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, when this
+	// one wasn't
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// refill adds the tokens gained since the bucket was last updated
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Requests), b.tokens+now.Sub(b.updated).Seconds()*b.limit.rate())
+	b.updated = now
+}
+
+// Limiter holds a token bucket per key
+type Limiter struct {
+	mux     *sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+	// now is the clock, replaced in tests
+	now func() time.Time
+}
+
+// New returns a limiter with no buckets
+func New() *Limiter {
+	return &Limiter{
+		mux:     &sync.Mutex{},
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key, which is created full on
+// first use. If the bucket's limit differs from limit, e.g. because the
+// user upgraded, the bucket switches to limit keeping its fill level.
+func (l *Limiter) Allow(key string, limit Limit) Decision {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := l.now()
+	l.calls++
+	if l.calls%sweepEvery == 0 {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Requests), updated: now, limit: limit}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	if b.limit != limit {
+		b.tokens = math.Min(float64(limit.Requests), b.tokens*float64(limit.Requests)/float64(b.limit.Requests))
+		b.limit = limit
+	}
+
+	d := Decision{Limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = seconds((1 - b.tokens) / limit.rate())
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = seconds((float64(limit.Requests) - b.tokens) / limit.rate())
+
+	return d
+}
+
+// sweep drops the buckets that have filled up again, since a new bucket
+// starts full anyway
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Requests) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Len returns how many buckets the limiter holds
+func (l *Limiter) Len() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return len(l.buckets)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
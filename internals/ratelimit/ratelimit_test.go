@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRefills(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New()
+	l.now = func() time.Time { return now }
+	limit := Limit{Requests: 3, Period: time.Minute}
+
+	for i := 2; i >= 0; i-- {
+		d := l.Allow("a", limit)
+		if !d.Allowed || d.Remaining != i {
+			t.Fatalf("request %d: %+v", 3-i, d)
+		}
+	}
+	d := l.Allow("a", limit)
+	if d.Allowed || d.RetryAfter != 20*time.Second || d.Reset != time.Minute {
+		t.Fatalf("request over the limit: %+v", d)
+	}
+	if d := l.Allow("b", limit); !d.Allowed {
+		t.Fatalf("another key was limited: %+v", d)
+	}
+
+	now = now.Add(20 * time.Second)
+	if d := l.Allow("a", limit); !d.Allowed || d.Remaining != 0 {
+		t.Fatalf("request after a refill: %+v", d)
+	}
+
+	// a higher limit scales the tokens left
+	now = now.Add(20 * time.Second)
+	if d := l.Allow("a", Limit{Requests: 6, Period: time.Minute}); !d.Allowed || d.Remaining != 1 {
+		t.Fatalf("request with a higher limit: %+v", d)
+	}
+}
+
+func TestSweepDropsFullBuckets(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New()
+	l.now = func() time.Time { return now }
+	limit := Limit{Requests: 10, Period: time.Second}
+
+	l.Allow("busy", limit)
+	for i := 0; i < sweepEvery-2; i++ {
+		l.Allow("idle", limit)
+	}
+	now = now.Add(time.Hour)
+	l.Allow("busy", limit)
+	if n := l.Len(); n != 1 {
+		t.Fatalf("limiter holds %d buckets after a sweep, want 1", n)
+	}
+}
@@ -0,0 +1,270 @@
+// Package search keeps an in-memory inverted index of chirps
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Doc is a chirp as the index sees it
+type Doc struct {
+	Id       int
+	AuthorId int
+	Body     string
+}
+
+// Index maps terms to the chirps containing them and where. Ids grow over
+// time, so a higher id is a more recent chirp.
+type Index struct {
+	mux      *sync.RWMutex
+	postings map[string]map[int][]int // term -> doc id -> positions
+	terms    []string                 // sorted, for prefix queries
+	docs     map[int]indexedDoc
+}
+
+type indexedDoc struct {
+	authorId int
+	terms    []string
+}
+
+// NewIndex returns an empty index
+func NewIndex() *Index {
+	return &Index{
+		mux:      &sync.RWMutex{},
+		postings: map[string]map[int][]int{},
+		docs:     map[int]indexedDoc{},
+	}
+}
+
+// Rebuild replaces the contents of the index with docs
+func (idx *Index) Rebuild(docs []Doc) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.postings = map[string]map[int][]int{}
+	idx.terms = nil
+	idx.docs = map[int]indexedDoc{}
+	for _, doc := range docs {
+		idx.add(doc)
+	}
+}
+
+// Add indexes doc, replacing any earlier version of it
+func (idx *Index) Add(doc Doc) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.remove(doc.Id)
+	idx.add(doc)
+}
+
+// Remove drops chirp id from the index
+func (idx *Index) Remove(id int) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.remove(id)
+}
+
+// Len returns the number of indexed chirps
+func (idx *Index) Len() int {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	return len(idx.docs)
+}
+
+func (idx *Index) add(doc Doc) {
+	tokens := tokenize(doc.Body)
+	seen := map[string]bool{}
+	var terms []string
+	for pos, term := range tokens {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = map[int][]int{}
+			idx.postings[term] = docs
+			i := sort.SearchStrings(idx.terms, term)
+			idx.terms = append(idx.terms, "")
+			copy(idx.terms[i+1:], idx.terms[i:])
+			idx.terms[i] = term
+		}
+		docs[doc.Id] = append(docs[doc.Id], pos)
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	idx.docs[doc.Id] = indexedDoc{authorId: doc.AuthorId, terms: terms}
+}
+
+func (idx *Index) remove(id int) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		docs := idx.postings[term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+			i := sort.SearchStrings(idx.terms, term)
+			idx.terms = append(idx.terms[:i], idx.terms[i+1:]...)
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// Ranking orders search results
+type Ranking string
+
+const (
+	// Relevance ranks by TF-IDF score, newest first among equal scores
+	Relevance Ranking = "relevance"
+	// Recency ranks newest first
+	Recency Ranking = "recency"
+)
+
+// Options narrows and orders a search
+type Options struct {
+	// AuthorId keeps only chirps by this author; zero keeps all
+	AuthorId int
+	Ranking  Ranking
+	// Limit caps the number of results; zero returns all
+	Limit int
+}
+
+// Result is a matching chirp and its score
+type Result struct {
+	Id    int
+	Score float64
+}
+
+// Search returns the chirps matching every clause of query. Words match
+// whole terms, a trailing * matches any term with that prefix, and quoted
+// words must appear in that order next to each other.
+func (idx *Index) Search(query string, opts Options) []Result {
+	clauses := parseQuery(query)
+	if len(clauses) == 0 {
+		return []Result{}
+	}
+
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	var scores map[int]float64
+	for _, c := range clauses {
+		matches := idx.match(c)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id, score := range scores {
+			if extra, ok := matches[id]; ok {
+				scores[id] = score + extra
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	results := []Result{}
+	for id, score := range scores {
+		if opts.AuthorId != 0 && idx.docs[id].authorId != opts.AuthorId {
+			continue
+		}
+		results = append(results, Result{Id: id, Score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if opts.Ranking != Recency && results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Id > results[j].Id
+	})
+	if opts.Limit > 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+
+	return results
+}
+
+// match scores the docs matching one clause
+func (idx *Index) match(c clause) map[int]float64 {
+	scores := map[int]float64{}
+
+	if c.prefix {
+		i := sort.SearchStrings(idx.terms, c.terms[0])
+		for ; i < len(idx.terms) && strings.HasPrefix(idx.terms[i], c.terms[0]); i++ {
+			for id, score := range idx.termScores(idx.terms[i]) {
+				scores[id] += score
+			}
+		}
+		return scores
+	}
+
+	if len(c.terms) == 1 {
+		return idx.termScores(c.terms[0])
+	}
+
+	// a phrase: every term, each one position after the last
+	first := idx.postings[c.terms[0]]
+	for id, positions := range first {
+		count := 0
+		for _, start := range positions {
+			if idx.phraseAt(id, c.terms, start) {
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		var score float64
+		for _, term := range c.terms {
+			score += float64(count) * idx.idf(term)
+		}
+		scores[id] = score
+	}
+	return scores
+}
+
+func (idx *Index) phraseAt(id int, terms []string, start int) bool {
+	for offset, term := range terms[1:] {
+		if !containsInt(idx.postings[term][id], start+offset+1) {
+			return false
+		}
+	}
+	return true
+}
+
+// termScores returns the TF-IDF score of term for every doc containing it
+func (idx *Index) termScores(term string) map[int]float64 {
+	scores := map[int]float64{}
+	idf := idx.idf(term)
+	for id, positions := range idx.postings[term] {
+		scores[id] = float64(len(positions)) * idf
+	}
+	return scores
+}
+
+func (idx *Index) idf(term string) float64 {
+	return math.Log(1 + float64(len(idx.docs))/float64(1+len(idx.postings[term])))
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenize lowercases text and splits it into runs of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
@@ -0,0 +1,58 @@
+package search
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ids(results []Result) string {
+	return fmt.Sprint(func() []int {
+		out := make([]int, len(results))
+		for i, r := range results {
+			out[i] = r.Id
+		}
+		return out
+	}())
+}
+
+func TestSearch(t *testing.T) {
+	idx := NewIndex()
+	idx.Rebuild([]Doc{
+		{Id: 1, AuthorId: 1, Body: "I'm the one who knocks!"},
+		{Id: 2, AuthorId: 2, Body: "Who knocks? The one who knocks."},
+		{Id: 3, AuthorId: 1, Body: "Knock knock, who's there?"},
+		{Id: 4, AuthorId: 2, Body: "Say my name"},
+	})
+	idx.Add(Doc{Id: 5, AuthorId: 3, Body: "One more knocker"})
+
+	tests := []struct {
+		query string
+		opts  Options
+		want  string
+	}{
+		{"knocks", Options{}, "[2 1]"},
+		{"knocks", Options{Ranking: Recency}, "[2 1]"},
+		{"KNOCKS one", Options{}, "[2 1]"},
+		{`"the one who"`, Options{}, "[2 1]"},
+		{`"who the"`, Options{}, "[]"},
+		{"knock*", Options{Ranking: Recency}, "[5 3 2 1]"},
+		{"knock*", Options{AuthorId: 1, Ranking: Recency}, "[3 1]"},
+		{"knock*", Options{Ranking: Recency, Limit: 1}, "[5]"},
+		{"heisenberg", Options{}, "[]"},
+		{"", Options{}, "[]"},
+	}
+	for _, tt := range tests {
+		if got := ids(idx.Search(tt.query, tt.opts)); got != tt.want {
+			t.Errorf("Search(%q, %+v) = %s, want %s", tt.query, tt.opts, got, tt.want)
+		}
+	}
+
+	idx.Remove(2)
+	if got := ids(idx.Search("knocks", Options{})); got != "[1]" {
+		t.Errorf("after removing 2: got %s, want [1]", got)
+	}
+	idx.Remove(5)
+	if got := ids(idx.Search("knocker*", Options{})); got != "[]" {
+		t.Errorf("prefix matched a removed chirp: %s", got)
+	}
+}
@@ -0,0 +1,35 @@
+package search
+
+import "strings"
+
+// clause is one part of a query: a term, a prefix, or a phrase
+type clause struct {
+	terms  []string
+	prefix bool
+}
+
+// parseQuery splits a query into clauses. Text in double quotes is a
+// phrase; a word ending in * is a prefix. An unclosed quote runs to the
+// end of the query.
+func parseQuery(query string) []clause {
+	var clauses []clause
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			if terms := tokenize(part); len(terms) > 0 {
+				clauses = append(clauses, clause{terms: terms})
+			}
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			terms := tokenize(word)
+			for _, term := range terms {
+				clauses = append(clauses, clause{terms: []string{term}})
+			}
+			if strings.HasSuffix(word, "*") && len(terms) > 0 {
+				clauses[len(clauses)-1].prefix = true
+			}
+		}
+	}
+	return clauses
+}
@@ -0,0 +1,72 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRFC6238Vectors checks the SHA-1 test vectors of RFC 6238 appendix B
+func TestRFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got := hotp(key, Counter(time.Unix(tt.unix, 0)), 8)
+		if got != tt.want {
+			t.Errorf("code at %d is %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateAllowsSkew(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	code, err := Code(secret, now.Add(-Step))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter, err := Validate(secret, code, now)
+	if err != nil {
+		t.Fatalf("code from the previous step was refused: %v", err)
+	}
+	if counter != Counter(now)-1 {
+		t.Fatalf("counter is %d, want %d", counter, Counter(now)-1)
+	}
+
+	code, err = Code(secret, now.Add(-2*Step))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Validate(secret, code, now); err != ErrInvalidCode {
+		t.Fatalf("code from two steps back got %v", err)
+	}
+	if _, err = Validate(secret, "12345", now); err != ErrInvalidCode {
+		t.Fatalf("short code got %v", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Chirpy", "a b@example.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/Chirpy:a%20b@example.com?") {
+		t.Fatalf("uri is %s", uri)
+	}
+	for _, part := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=Chirpy", "digits=6", "period=30"} {
+		if !strings.Contains(uri, part) {
+			t.Errorf("uri %s is missing %s", uri, part)
+		}
+	}
+}
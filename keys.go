@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jming514/chirpy/internals/jwt"
+)
+
+const keysUsage = `Usage: chirpy keys <command>
+
+Commands:
+  list            show all signing keys
+  generate [alg]  add a new key that verifies tokens but doesn't sign yet;
+                  alg is EdDSA (default), RS256 or HS256
+  promote <kid>   sign new tokens with kid; the old primary keeps verifying
+  retire <kid>    stop accepting tokens signed with kid
+
+Rotate by generating a key, promoting it once every server has picked it
+up, and retiring the old key after the tokens it signed have expired.
+EdDSA and RS256 public keys are served at /.well-known/jwks.json so other
+services can verify tokens without the signing secret.`
+
+// runKeys implements `chirpy keys`
+func runKeys(keyring *jwt.Keyring, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, keysUsage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KID\tALG\tSTATUS\tCREATED")
+		for _, key := range keyring.Keys() {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.Id, key.Algorithm, key.Status, key.CreatedAt.Format(time.RFC3339))
+		}
+		err = w.Flush()
+	case args[0] == "generate" && len(args) <= 2:
+		alg := jwt.EdDSA
+		if len(args) == 2 {
+			alg = args[1]
+		}
+		var kid string
+		kid, err = keyring.Generate(alg)
+		if err == nil {
+			fmt.Printf("generated key %s\n", kid)
+		}
+	case args[0] == "promote" && len(args) == 2:
+		err = keyring.Promote(args[1])
+		if err == nil {
+			fmt.Printf("key %s is now primary\n", args[1])
+		}
+	case args[0] == "retire" && len(args) == 2:
+		err = keyring.Retire(args[1])
+		if err == nil {
+			fmt.Printf("retired key %s\n", args[1])
+		}
+	default:
+		fmt.Fprintln(os.Stderr, keysUsage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// jwks serves the public signing keys so other services can verify
+// access tokens without sharing a secret
+func (cfg *apiConfig) jwks(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, cfg.Keys.JWKS())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// engagementHandler responds to a like or rechirp route with the chirp
+// after action, which is one of the Store's LikeChirp, UnlikeChirp,
+// Rechirp and Unrechirp
+func (cfg *apiConfig) engagementHandler(action func(userId int, chirpId int) (database.Chirp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, _ := principalFrom(r.Context())
+		chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+		if err != nil {
+			respondWithError(w, 400, "Invalid chirp ID")
+			return
+		}
+
+		chirp, err := action(p.UserId, chirpId)
+		if errors.Is(err, database.ErrChirpNotFound) {
+			respondWithError(w, 404, "Chirp doesn't exist")
+			return
+		}
+		if err != nil {
+			log.Printf("Error updating chirp engagement: %s\n", err)
+			respondWithError(w, 500, "Cannot update chirp")
+			return
+		}
+		respondWithJSON(w, 200, chirp)
+	}
+}
+
+func (cfg *apiConfig) likeChirp(w http.ResponseWriter, r *http.Request) {
+	cfg.engagementHandler(cfg.DB.LikeChirp)(w, r)
+}
+
+func (cfg *apiConfig) unlikeChirp(w http.ResponseWriter, r *http.Request) {
+	cfg.engagementHandler(cfg.DB.UnlikeChirp)(w, r)
+}
+
+func (cfg *apiConfig) rechirp(w http.ResponseWriter, r *http.Request) {
+	cfg.engagementHandler(cfg.DB.Rechirp)(w, r)
+}
+
+func (cfg *apiConfig) unrechirp(w http.ResponseWriter, r *http.Request) {
+	cfg.engagementHandler(cfg.DB.Unrechirp)(w, r)
+}
+
+// likers returns the users who liked {chirpID}
+func (cfg *apiConfig) likers(w http.ResponseWriter, r *http.Request) {
+	chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirp ID")
+		return
+	}
+	page, err := pageFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	users, err := cfg.DB.GetLikers(chirpId, page)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, "Chirp doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting likes: %s\n", err)
+		respondWithError(w, 500, "Cannot get likes")
+		return
+	}
+	respondWithPage(w, r, publicUsers(users), idOfUser, page)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jming514/chirpy/internals/database"
+)
+
+var (
+	// accountLockout throttles failed logins to one email, whether or not
+	// an account has it
+	accountLockout = database.LockoutPolicy{
+		FreeAttempts: 3,
+		Backoff:      time.Second,
+		MaxBackoff:   time.Minute,
+		LockAfter:    10,
+		LockFor:      15 * time.Minute,
+		MaxLockFor:   24 * time.Hour,
+		Window:       24 * time.Hour,
+	}
+	// ipLockout throttles failed logins from one client address to any
+	// account. It is looser, since many users can share an address.
+	ipLockout = database.LockoutPolicy{
+		FreeAttempts: 20,
+		Backoff:      time.Second,
+		MaxBackoff:   time.Minute,
+		LockAfter:    100,
+		LockFor:      15 * time.Minute,
+		MaxLockFor:   24 * time.Hour,
+		Window:       24 * time.Hour,
+	}
+)
+
+// loginThrottle is the pair of keys a login attempt counts against
+type loginThrottle struct {
+	account string
+	ip      string
+}
+
+func newLoginThrottle(email string, r *http.Request) loginThrottle {
+	return loginThrottle{
+		account: database.AccountThrottleKey(email),
+		ip:      database.IPThrottleKey(clientIP(r)),
+	}
+}
+
+// retryAfter is how long the attempt must wait, or zero if it may go ahead.
+// It depends only on the email and address tried, never on whether the
+// account exists.
+func (cfg *apiConfig) retryAfter(lt loginThrottle) (time.Duration, error) {
+	now := time.Now()
+	account, err := cfg.DB.GetLoginThrottle(lt.account)
+	if err != nil {
+		return 0, err
+	}
+	ip, err := cfg.DB.GetLoginThrottle(lt.ip)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := account.RetryAfter(accountLockout, now)
+	if w := ip.RetryAfter(ipLockout, now); w > wait {
+		wait = w
+	}
+	return wait, nil
+}
+
+// throttled reports whether the attempt must wait. If it must, the error
+// response has been written.
+func (cfg *apiConfig) throttled(w http.ResponseWriter, lt loginThrottle) bool {
+	wait, err := cfg.retryAfter(lt)
+	if err != nil {
+		log.Printf("Error checking failed logins: %s\n", err)
+		respondWithError(w, 500, "Error logging in...")
+		return true
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+		respondWithError(w, 429, "too many failed login attempts")
+		return true
+	}
+	return false
+}
+
+// loginFailed counts a failed attempt against both keys and, when it locks
+// out an existing account, records a notification on it
+func (cfg *apiConfig) loginFailed(lt loginThrottle, email string, r *http.Request) {
+	_, _, err := cfg.DB.RecordLoginFailure(lt.ip, ipLockout)
+	if err != nil {
+		log.Printf("Error recording failed login: %s\n", err)
+	}
+	throttle, locked, err := cfg.DB.RecordLoginFailure(lt.account, accountLockout)
+	if err != nil {
+		log.Printf("Error recording failed login: %s\n", err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	user, err := cfg.DB.GetUserByEmail(email)
+	if err != nil {
+		return
+	}
+	message := fmt.Sprintf(
+		"Your account was locked until %s after %d failed login attempts, the last from %s.",
+		throttle.LockedUntil.Format(time.RFC3339), accountLockout.LockAfter, clientIP(r),
+	)
+	_, err = cfg.DB.AddNotification(user.Id, database.NotifyLoginLockout, message)
+	if err != nil {
+		log.Printf("Error recording lockout notification: %s\n", err)
+	}
+}
+
+// loginSucceeded forgets the failed attempts on the account. Those from
+// the address stand, so one good password can't reset a guessing run.
+func (cfg *apiConfig) loginSucceeded(lt loginThrottle) {
+	err := cfg.DB.ClearLoginThrottle(lt.account)
+	if err != nil {
+		log.Printf("Error clearing failed logins: %s\n", err)
+	}
+}
+
+// unlockUser lifts a login lockout and forgets the account's failed attempts
+func (cfg *apiConfig) unlockUser(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	userId, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid user ID")
+		return
+	}
+
+	err = cfg.DB.UnlockUser(userId, p.UserId)
+	if err != nil {
+		log.Printf("Error unlocking user: %s\n", err)
+		respondWithError(w, 404, "user not found")
+		return
+	}
+	respondWithJSON(w, 200, "ok")
+}
+
+// notifications lists the notifications on the caller's account
+func (cfg *apiConfig) notifications(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	page, err := pageFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	notifications, err := cfg.DB.GetNotifications(p.UserId, page)
+	if err != nil {
+		log.Printf("Error getting notifications: %s\n", err)
+		respondWithError(w, 500, "Cannot get notifications")
+		return
+	}
+	respondWithPage(w, r, notifications, idOfNotification, page)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/jming514/chirpy/internals/database"
+)
+
+func TestLoginLockout(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+	admin := s.signUpAs(t, "admin@example.com", database.RoleAdmin)
+
+	wrong := userParams{Email: user.Email, Password: "wrong"}
+	for i := 0; i <= accountLockout.FreeAttempts; i++ {
+		expect(t, s.do(t, "POST", "/api/login", "", wrong), 401, nil)
+	}
+	// the account now has to wait, even with the right password
+	resp := s.do(t, "POST", "/api/login", "", userParams{Email: user.Email, Password: "password"})
+	var body errorBody
+	expect(t, resp, 429, &body)
+	if body.Error != "too many failed login attempts" {
+		t.Fatalf("locked out login got %q", body.Error)
+	}
+	if wait, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || wait < 1 {
+		t.Fatalf("locked out login has Retry-After %q", resp.Header.Get("Retry-After"))
+	}
+	// whether or not an account has the address
+	for i := 0; i <= accountLockout.FreeAttempts; i++ {
+		expect(t, s.do(t, "POST", "/api/login", "", userParams{Email: "nobody@example.com", Password: "wrong"}), 401, nil)
+	}
+	expect(t, s.do(t, "POST", "/api/login", "", userParams{Email: "nobody@example.com", Password: "wrong"}), 429, nil)
+
+	path := "/admin/users/" + strconv.Itoa(user.Id) + "/lockout"
+	expect(t, s.do(t, "DELETE", path, user.Token, nil), 403, nil)
+	expect(t, s.do(t, "DELETE", path, admin.Token, nil), 200, nil)
+	s.login(t, user.Email, "password")
+
+	// an address counts the same in any case, and a successful login
+	// forgets its failures
+	other := s.signUp(t, "user2@example.com")
+	expect(t, s.do(t, "POST", "/api/login", "", userParams{Email: "User2@Example.com", Password: "wrong"}), 401, nil)
+	throttle, err := s.cfg.DB.GetLoginThrottle(database.AccountThrottleKey(other.Email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttle.Failures != 1 {
+		t.Fatalf("failed login left throttle %+v", throttle)
+	}
+	s.login(t, "USER2@example.com", "password")
+	throttle, err = s.cfg.DB.GetLoginThrottle(database.AccountThrottleKey(other.Email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttle.Failures != 0 {
+		t.Fatalf("successful login left throttle %+v", throttle)
+	}
+}
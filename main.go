@@ -1,20 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jming514/chirpy/internals/jwt"
+	"github.com/jming514/chirpy/internals/mailer"
+	"github.com/jming514/chirpy/internals/moderation"
+	"github.com/jming514/chirpy/internals/password"
+	"github.com/jming514/chirpy/internals/ratelimit"
+	"github.com/jming514/chirpy/internals/search"
 	"github.com/joho/godotenv"
 
 	"github.com/jming514/chirpy/internals/database"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 type userParams struct {
@@ -23,8 +34,17 @@ type userParams struct {
 }
 
 type apiConfig struct {
-	DB             *database.DB
+	DB             database.Store
+	Keys           *jwt.Keyring
+	Search         *search.Index
+	Moderation     *moderation.Pipeline
+	Limiter        *ratelimit.Limiter
+	Mailer         mailer.Mailer
 	fileserverHits int
+
+	// RequireVerified keeps users who haven't verified their email
+	// address from chirping
+	RequireVerified bool
 }
 
 func main() {
@@ -34,39 +54,175 @@ func main() {
 		return
 	}
 	const port = "8080"
-	const filepathRoot = "."
 
-	db, err := database.NewDB("./database.json")
+	storeConfig, err := storeConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(storeConfig, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "role" {
+		runRole(storeConfig, os.Args[2:])
+		return
+	}
+
+	keysFile := os.Getenv("JWT_KEYS_FILE")
+	if keysFile == "" {
+		keysFile = "./jwt_keys.json"
+	}
+	keyring, err := jwt.LoadKeyring(keysFile)
+	if err != nil {
+		log.Fatal("Error loading signing keys: ", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		runKeys(keyring, os.Args[2:])
+		return
+	}
+	jwt.UseKeyring(keyring)
+
+	db, err := database.NewStore(storeConfig)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
+	index, err := buildSearchIndex(db)
+	if err != nil {
+		log.Fatal("Error building search index: ", err)
+	}
+	log.Printf("Indexed %d chirps for search\n", index.Len())
+
+	pipeline, err := moderationFromEnv()
+	if err != nil {
+		log.Fatal("Error loading moderation config: ", err)
+	}
+
+	mail, err := mailerFromEnv()
+	if err != nil {
+		log.Fatal("Error configuring mailer: ", err)
+	}
+
 	cfg := apiConfig{
 		fileserverHits: 0,
-		DB:             db,
+		DB:             indexedStore{Store: db, index: index},
+		Keys:           keyring,
+		Search:         index,
+		Moderation:     pipeline,
+		Limiter:        ratelimit.New(),
+		Mailer:         mail,
+
+		RequireVerified: os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true",
 	}
+	httpServer := &http.Server{
+		Addr:    ":" + port,
+		Handler: cfg.routes(),
+	}
+
+	// shut down cleanly on Ctrl-C / SIGTERM so the database is flushed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("Server started at %s", httpServer.Addr)
+		err := httpServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Error shutting down server: %s\n", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		log.Printf("Error closing database: %s\n", err)
+	}
+}
+
+// routes builds the handler serving the app, the API and the admin API
+func (cfg *apiConfig) routes() http.Handler {
+	const filepathRoot = "."
+
 	r := chi.NewRouter()
+	if os.Getenv("TRUST_PROXY") == "true" {
+		r.Use(middleware.RealIP)
+	}
 	fsHandler := cfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot))))
 	r.Handle("/app", fsHandler)
 	r.Handle("/app/*", fsHandler)
+	r.Get("/.well-known/jwks.json", cfg.jwks)
 
 	apiR := chi.NewRouter()
+	apiR.Use(cfg.rateLimit(apiPolicy))
 	apiR.Get("/healthz", healthz)
 	apiR.Post("/reset", cfg.reset)
 
 	apiR.Get("/chirps", cfg.chirps)
+	apiR.With(cfg.rateLimit(searchPolicy)).Get("/chirps/search", cfg.searchChirps)
 	apiR.Get("/chirps/{chirpID}", cfg.chirp)
-	apiR.Post("/chirps", cfg.createChirp)
-	apiR.Delete("/chirps/{chirpID}", cfg.deleteChirp)
+	apiR.Get("/chirps/{chirpID}/thread", cfg.thread)
+	apiR.Get("/chirps/{chirpID}/likes", cfg.likers)
 
 	apiR.Get("/users", cfg.users)
 	apiR.Get("/users/{userID}", cfg.user)
-	apiR.Post("/users", cfg.createUser)
-	apiR.Put("/users", cfg.updateUser)
+	apiR.With(cfg.rateLimit(signupPolicy)).Post("/users", cfg.createUser)
+	apiR.Post("/users/verify", cfg.verifyEmail)
+	apiR.With(cfg.rateLimit(resetPolicy)).Post("/password-reset", cfg.requestPasswordReset)
+	apiR.Post("/password-reset/confirm", cfg.resetPassword)
+	apiR.Get("/users/{userID}/followers", cfg.followers)
+	apiR.Get("/users/{userID}/following", cfg.following)
+	apiR.Get("/users/{userID}/mentions", cfg.mentions)
+
+	apiR.Get("/tags/{tag}", cfg.tagFeed)
+	apiR.Get("/trending/tags", cfg.trendingTags)
+
+	apiR.Group(func(r chi.Router) {
+		r.Use(cfg.authenticate)
+		writes := cfg.rateLimit(writePolicy)
+		r.With(requireScope(scopeChirpsWrite), cfg.rateLimit(chirpPolicy)).Post("/chirps", cfg.createChirp)
+		r.With(requireScope(scopeChirpsWrite), writes).Delete("/chirps/{chirpID}", cfg.deleteChirp)
+		r.With(requireScope(scopeChirpsWrite), writes).Post("/chirps/{chirpID}/like", cfg.likeChirp)
+		r.With(requireScope(scopeChirpsWrite), writes).Delete("/chirps/{chirpID}/like", cfg.unlikeChirp)
+		r.With(requireScope(scopeChirpsWrite), writes).Post("/chirps/{chirpID}/rechirp", cfg.rechirp)
+		r.With(requireScope(scopeChirpsWrite), writes).Delete("/chirps/{chirpID}/rechirp", cfg.unrechirp)
+		r.With(requireScope(scopeChirpsWrite), writes).Post("/chirps/{chirpID}/report", cfg.reportChirp)
+		r.With(requireScope(scopeUsersWrite), writes).Put("/users", cfg.updateUser)
+		r.With(requireScope(scopeFollowsWrite), writes).Post("/users/{userID}/follow", cfg.follow)
+		r.With(requireScope(scopeFollowsWrite), writes).Delete("/users/{userID}/follow", cfg.unfollow)
+		r.Get("/timeline", cfg.timeline)
+		r.Get("/notifications", cfg.notifications)
+		r.With(cfg.rateLimit(resetPolicy)).Post("/users/verify/send", cfg.resendVerification)
+	})
+	// credentials can only be managed from a login, not a personal access
+	// token
+	apiR.Group(func(r chi.Router) {
+		r.Use(cfg.authenticate, requireSession)
+		writes := cfg.rateLimit(writePolicy)
+		r.Get("/sessions", cfg.sessions)
+		r.With(writes).Delete("/sessions", cfg.revokeSessions)
+		r.With(writes).Delete("/sessions/{sessionID}", cfg.revokeSession)
+		r.Get("/tokens", cfg.personalTokens)
+		r.With(writes).Post("/tokens", cfg.createPersonalToken)
+		r.With(writes).Delete("/tokens/{tokenID}", cfg.revokePersonalToken)
+		r.With(requireScope(scopeUsersWrite), writes).Post("/users/mfa/totp", cfg.enrollTOTP)
+		r.With(requireScope(scopeUsersWrite), writes).Post("/users/mfa/totp/confirm", cfg.confirmTOTP)
+		r.With(requireScope(scopeUsersWrite), writes).Delete("/users/mfa/totp", cfg.disableTOTP)
+	})
 
-	apiR.Post("/login", cfg.login)
-	apiR.Post("/refresh", cfg.refresh)
+	apiR.With(cfg.rateLimit(loginPolicy)).Post("/login", cfg.login)
+	apiR.With(cfg.rateLimit(loginPolicy)).Post("/login/mfa", cfg.loginMFA)
+	apiR.With(cfg.rateLimit(refreshPolicy)).Post("/refresh", cfg.refresh)
 	apiR.Post("/revoke", cfg.revokeToken)
 
 	apiR.Post("/polka/webhooks", cfg.webhooks)
@@ -74,16 +230,96 @@ func main() {
 
 	adminR := chi.NewRouter()
 	adminR.Get("/metrics", cfg.adminFsHandler)
+	adminR.Group(func(r chi.Router) {
+		r.Use(cfg.authenticate, requireRole(database.RoleAdmin), requireScope(scopeAdmin))
+		r.Put("/users/{userID}/role", cfg.setUserRole)
+		r.Put("/users/{userID}/suspension", cfg.suspendUser)
+		r.Delete("/users/{userID}/suspension", cfg.reinstateUser)
+		r.Delete("/users/{userID}/lockout", cfg.unlockUser)
+	})
+	adminR.Group(func(r chi.Router) {
+		r.Use(cfg.authenticate, requireRole(database.RoleModerator), requireScope(scopeChirpsModerate))
+		r.Get("/reports", cfg.reports)
+		r.Post("/reports/{reportID}/claim", cfg.claimReport)
+		r.Post("/reports/{reportID}/resolve", cfg.resolveReport)
+		r.Get("/audit", cfg.auditLog)
+	})
 	r.Mount("/admin", adminR)
 
-	corsMux := middlewareCors(r)
-	httpServer := &http.Server{
-		Addr:    ":" + port,
-		Handler: corsMux,
+	return middlewareCors(r)
+}
+
+// storeConfigFromEnv reads the DB_* settings
+func storeConfigFromEnv() (database.StoreConfig, error) {
+	config := database.StoreConfig{
+		Driver:        os.Getenv("DB_DRIVER"),
+		Path:          os.Getenv("DB_PATH"),
+		FlushInterval: 5 * time.Second,
+	}
+
+	if v := os.Getenv("DB_FLUSH_INTERVAL"); v != "" {
+		flushInterval, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid DB_FLUSH_INTERVAL: %w", err)
+		}
+		config.FlushInterval = flushInterval
+	}
+
+	hasher, err := hasherFromEnv()
+	if err != nil {
+		return config, err
+	}
+	config.Hasher = hasher
+
+	return config, nil
+}
+
+// moderationFromEnv builds the content filters from the file named by
+// MODERATION_CONFIG, or the default word list when it is unset
+func moderationFromEnv() (*moderation.Pipeline, error) {
+	config := moderation.DefaultConfig()
+	if path := os.Getenv("MODERATION_CONFIG"); path != "" {
+		var err error
+		config, err = moderation.LoadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return config.Pipeline()
+}
+
+// hasherFromEnv reads the PASSWORD_HASH, ARGON2_* and BCRYPT_COST settings.
+// Unset values keep password.DefaultParams.
+func hasherFromEnv() (*password.Hasher, error) {
+	params := password.DefaultParams
+	if v := os.Getenv("PASSWORD_HASH"); v != "" {
+		params.Algorithm = v
+	}
+
+	settings := []struct {
+		name string
+		set  func(n uint64)
+		bits int
+	}{
+		{"ARGON2_MEMORY", func(n uint64) { params.Memory = uint32(n) }, 32},
+		{"ARGON2_ITERATIONS", func(n uint64) { params.Iterations = uint32(n) }, 32},
+		{"ARGON2_PARALLELISM", func(n uint64) { params.Parallelism = uint8(n) }, 8},
+		{"BCRYPT_COST", func(n uint64) { params.BcryptCost = int(n) }, 8},
+	}
+	for _, setting := range settings {
+		v := os.Getenv(setting.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, setting.bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", setting.name, err)
+		}
+		setting.set(n)
 	}
 
-	log.Printf("Server started at %s", httpServer.Addr)
-	log.Fatal(httpServer.ListenAndServe())
+	return password.NewHasher(params)
 }
 
 func (cfg *apiConfig) webhooks(w http.ResponseWriter, r *http.Request) {
@@ -121,39 +357,76 @@ func (cfg *apiConfig) webhooks(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, 200, user)
 }
 
-func checkToken(r *http.Request, tokenType string) (string, error) {
+const (
+	accessTokenSeconds  = 60 * 60
+	refreshTokenSeconds = 60 * 60 * 24 * 60
+	// mfaTokenSeconds is how long a user has to enter their code after
+	// their password
+	mfaTokenSeconds = 5 * 60
+)
+
+// defaultThreadDepth is how many levels of replies a thread shows unless
+// the request asks for more
+const defaultThreadDepth = 10
+
+// checkToken validates the Bearer token of r and returns it with its user ID
+func checkToken(r *http.Request, tokenType string) (string, int, *jwt.Claims, error) {
 	token := r.Header.Get("Authorization")
 	strippedToken := strings.TrimPrefix(token, "Bearer ")
 
-	_, err := jwt.ValidateToken(strippedToken, tokenType)
+	validToken, err := jwt.ValidateToken(strippedToken, tokenType)
 	if err != nil {
-		log.Printf("Error validating token: %s\n", err)
-		return "", err
+		return "", 0, nil, err
 	}
 
-	return strippedToken, nil
+	userId, err := jwt.GetUserIdFromToken(validToken)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	claims, err := jwt.GetClaims(validToken)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	return strippedToken, userId, claims, nil
 }
 
 func (cfg *apiConfig) revokeToken(w http.ResponseWriter, r *http.Request) {
-	strippedToken, err := checkToken(r, "chirpy-refresh")
+	strippedToken, userId, claims, err := checkToken(r, "chirpy-refresh")
 	if err != nil {
 		log.Printf("Error validating token: %s\n", err)
-		respondWithError(w, 500, "invalid token")
+		respondWithError(w, 401, "invalid token")
+		return
 	}
 
 	err = cfg.DB.RevokeToken(strippedToken)
 	if err != nil {
 		log.Printf("Error revoking token: %s\n", err)
 		respondWithError(w, 500, "invalid token")
+		return
 	}
+	// revoking the refresh token ends its session too
+	if claims.SessionId != 0 {
+		err = cfg.DB.RevokeSession(userId, claims.SessionId)
+		if err != nil && !errors.Is(err, database.ErrSessionNotFound) {
+			log.Printf("Error revoking session: %s\n", err)
+			respondWithError(w, 500, "invalid token")
+			return
+		}
+	}
+
+	respondWithJSON(w, 200, "ok")
 }
 
-// refresh if the current token is a refresh token and valid, return a new access token
+// refresh if the current token is a refresh token and valid, return a new
+// access token and a new refresh token. The presented refresh token is
+// rotated out; presenting it again revokes its session.
 func (cfg *apiConfig) refresh(w http.ResponseWriter, r *http.Request) {
-	strippedToken, err := checkToken(r, "chirpy-refresh")
+	strippedToken, userId, claims, err := checkToken(r, "chirpy-refresh")
 	if err != nil {
 		log.Printf("Error validating token: %s\n", err)
-		respondWithError(w, 500, "invalid token")
+		respondWithError(w, 401, "invalid token")
+		return
 	}
 
 	// check db if this token is revoked
@@ -164,17 +437,74 @@ func (cfg *apiConfig) refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if revoked == true {
-		respondWithJSON(w, 401, "token is revoked")
+		respondWithError(w, 401, "token is revoked")
 		return
 	}
 
-	respondWithJSON(w, 200, "ok")
+	// the role is read again so a promotion's scopes are granted at the
+	// next refresh
+	user, err := cfg.DB.GetUser(strconv.Itoa(userId))
+	if err != nil {
+		log.Printf("Error getting user: %s\n", err)
+		respondWithError(w, 401, "invalid token")
+		return
+	}
+	if user.Suspension.Active(time.Now()) {
+		respondWithError(w, 403, "account suspended")
+		return
+	}
+
+	// a token from before sessions names none; the store finds the one it
+	// was recorded in, or starts one for it
+	expiresAt := time.Now().Add(refreshTokenSeconds * time.Second)
+	sessionId, refreshToken, err := cfg.DB.RotateRefreshToken(database.Rotation{
+		OldToken:   strippedToken,
+		UserId:     userId,
+		SessionId:  claims.SessionId,
+		NewSession: newSession(r, userId, ""),
+		ExpiresAt:  expiresAt,
+		Mint: func(sessionId int) (string, error) {
+			return jwt.CreateRefreshToken(refreshTokenSeconds, userId, sessionId)
+		},
+	})
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		log.Printf("Refresh token reused for user %d, revoked session %d\n", userId, sessionId)
+		respondWithError(w, 401, "token is revoked")
+		return
+	}
+	if errors.Is(err, database.ErrRefreshTokenRevoked) {
+		respondWithError(w, 401, "token is revoked")
+		return
+	}
+	if err != nil {
+		log.Printf("Error rotating refresh token: %s\n", err)
+		respondWithError(w, 500, "error creating token...")
+		return
+	}
+
+	accessToken, err := jwt.CreateAccessToken(accessTokenSeconds, userId, sessionId, user.Role, scopesForRole(user.Role))
+	if err != nil {
+		log.Printf("Error creating token: %s\n", err)
+		respondWithError(w, 500, "error creating token...")
+		return
+	}
+
+	type response struct {
+		Token         string `json:"token"`
+		Refresh_Token string `json:"refresh_token"`
+	}
+	respondWithJSON(w, 200, response{
+		Token:         accessToken,
+		Refresh_Token: refreshToken,
+	})
 }
 
 func (cfg *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// Device names the session in the user's list of sessions
+		Device string `json:"device"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
@@ -184,26 +514,73 @@ func (cfg *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	throttle := newLoginThrottle(params.Email, r)
+	if cfg.throttled(w, throttle) {
+		return
+	}
+
 	user, err := cfg.DB.Login(params.Email, params.Password)
+	if errors.Is(err, database.ErrUserSuspended) {
+		respondWithError(w, 403, "account suspended")
+		return
+	}
 	if err != nil {
 		log.Printf("Error logging in: %s\n", err)
+		cfg.loginFailed(throttle, params.Email, r)
 		respondWithError(w, 401, "Error logging in...")
 		return
 	}
 
-	accessToken, err := jwt.CreateToken(60*60, user.Id, "chirpy-access")
+	enrollment, err := cfg.DB.GetTOTP(user.Id)
+	if err != nil && !errors.Is(err, database.ErrTOTPNotEnrolled) {
+		log.Printf("Error getting authenticator: %s\n", err)
+		respondWithError(w, 500, "Error logging in...")
+		return
+	}
+	if err == nil && enrollment.Enabled() {
+		// failed attempts stand until the second factor is passed too
+		cfg.requireMFA(w, user)
+		return
+	}
+	cfg.loginSucceeded(throttle)
+
+	cfg.issueTokens(w, r, user, params.Device)
+}
+
+// issueTokens starts a session for user on the requesting device and
+// responds with user and the session's first access and refresh tokens
+func (cfg *apiConfig) issueTokens(w http.ResponseWriter, r *http.Request, user database.UserReturn, device string) {
+	session, err := cfg.createSession(r, user.Id, device)
+	if err != nil {
+		log.Printf("Error creating session: %s\n", err)
+		respondWithError(w, 500, "error creating token...")
+		return
+	}
+
+	accessToken, err := jwt.CreateAccessToken(accessTokenSeconds, user.Id, session.Id, user.Role, scopesForRole(user.Role))
 	if err != nil {
 		log.Printf("Error creating token: %s\n", err)
 		respondWithError(w, 500, "error creating token...")
+		return
 	}
-	refreshToken, err := jwt.CreateToken(60*60*24*60, user.Id, "chirpy-refresh")
+	refreshToken, err := jwt.CreateRefreshToken(refreshTokenSeconds, user.Id, session.Id)
 	if err != nil {
 		log.Printf("Error creating token: %s\n", err)
 		respondWithError(w, 500, "error creating token...")
+		return
+	}
+
+	expiresAt := time.Now().Add(refreshTokenSeconds * time.Second)
+	err = cfg.DB.CreateRefreshToken(session.Id, refreshToken, expiresAt)
+	if err != nil {
+		log.Printf("Error storing refresh token: %s\n", err)
+		respondWithError(w, 500, "error creating token...")
+		return
 	}
 
 	user.Token = accessToken
 	user.Refresh_Token = refreshToken
+	user.Session_Id = session.Id
 
 	respondWithJSON(w, 200, user)
 }
@@ -213,49 +590,47 @@ func (cfg *apiConfig) user(w http.ResponseWriter, r *http.Request) {
 	theUser, err := cfg.DB.GetUser(id)
 	if err != nil {
 		respondWithError(w, 405, "User doesn't exist")
+		return
 	}
 
-	respondWithJSON(w, 200, theUser)
+	respondWithJSON(w, 200, newPublicUser(theUser))
 }
 
 func (cfg *apiConfig) users(w http.ResponseWriter, r *http.Request) {
-	allUsers, err := cfg.DB.GetUsers()
+	page, err := pageFromRequest(r)
 	if err != nil {
-		respondWithError(w, 500, "Cannot get users")
-	}
-
-	respondWithJSON(w, 200, allUsers)
-}
-
-// reject if token is a refresh token
-func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Authorization")
-
-	strippedToken := strings.TrimPrefix(token, "Bearer ")
-
-	validToken, err := jwt.ValidateToken(strippedToken, "chirpy-access")
-	if err != nil {
-		log.Printf("Error validating token: %s\n", err)
-		respondWithError(w, 401, "invalid token")
+		respondWithError(w, 400, err.Error())
 		return
 	}
 
-	userId, err := jwt.GetUserIdFromToken(validToken)
+	allUsers, err := cfg.DB.GetUsers(page)
 	if err != nil {
-		log.Printf("Error getting user ID: %s\n", err)
-		respondWithError(w, 401, "cannot read user ID")
+		respondWithError(w, 500, "Cannot get users")
 		return
 	}
 
+	respondWithPage(w, r, publicUsers(allUsers), idOfUser, page)
+}
+
+// updateUser changes the caller's email and password
+func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	userId := p.UserId
+
 	decoder := json.NewDecoder(r.Body)
 	params := userParams{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		log.Printf("Error decoding parameters: %s\n", err)
 		respondWithError(w, 500, "Error decoding parameters...")
 		return
 	}
 
+	if !validEmail(params.Email) {
+		respondWithError(w, 400, "invalid email address")
+		return
+	}
+
 	update := database.User{
 		Id:       userId,
 		Email:    params.Email,
@@ -266,11 +641,50 @@ func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("Error updating user: %s\n", err)
 		respondWithError(w, 500, "error updating user")
+		return
+	}
+	if !respVals.EmailVerified && respVals.Email != p.Email {
+		cfg.sendVerification(respVals.Id, respVals.Email)
 	}
 
 	respondWithJSON(w, 200, respVals)
 }
 
+// setUserRole changes a user's role. A demotion applies to the user's
+// tokens at once; the scopes of a promotion come with their next refresh.
+func (cfg *apiConfig) setUserRole(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+	userId, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid user ID")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Error decoding parameters...")
+		return
+	}
+	if !database.ValidRole(params.Role) {
+		respondWithError(w, 400, "unknown role")
+		return
+	}
+
+	p, _ := principalFrom(r.Context())
+	user, err := cfg.DB.SetUserRole(userId, params.Role, p.UserId)
+	if err != nil {
+		log.Printf("Error setting role: %s\n", err)
+		respondWithError(w, 404, "user not found")
+		return
+	}
+	respondWithJSON(w, 200, user)
+}
+
 func (cfg *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	params := userParams{}
@@ -281,13 +695,18 @@ func (cfg *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// email := params.Email
+	if !validEmail(params.Email) {
+		respondWithError(w, 400, "invalid email address")
+		return
+	}
+
 	respVals, err := cfg.DB.CreateUser(params.Email, params.Password)
 	if err != nil {
 		log.Println(err)
 		respondWithError(w, 500, "error creating user")
 		return
 	}
+	cfg.sendVerification(respVals.Id, respVals.Email)
 
 	respondWithJSON(w, 201, respVals)
 }
@@ -297,13 +716,19 @@ func (cfg *apiConfig) chirp(w http.ResponseWriter, r *http.Request) {
 	theChirp, err := cfg.DB.GetChirp(id)
 	if err != nil {
 		respondWithError(w, 404, "Chirp doesn't exist")
+		return
 	}
 
 	respondWithJSON(w, 200, theChirp)
 }
 
 func (cfg *apiConfig) chirps(w http.ResponseWriter, r *http.Request) {
-	options := database.Options{}
+	page, err := pageFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	options := database.Options{Page: page}
 
 	authorId := r.URL.Query().Get("author_id")
 	sorting := r.URL.Query().Get("sort")
@@ -326,93 +751,93 @@ func (cfg *apiConfig) chirps(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 500, "Cannot get chirps")
 		return
 	}
-	respondWithJSON(w, 200, allChirps)
+	respondWithPage(w, r, allChirps, idOfChirp, page)
 }
 
 func (cfg *apiConfig) createChirp(w http.ResponseWriter, r *http.Request) {
-	// Get user id from the token
-	token := r.Header.Get("Authorization")
-
-	strippedToken := strings.TrimPrefix(token, "Bearer ")
-
-	validToken, err := jwt.ValidateToken(strippedToken, "chirpy-access")
-	if err != nil {
-		log.Printf("Error validating token: %s\n", err)
-		respondWithError(w, 401, "invalid token")
-		return
-	}
-	userId, err := jwt.GetUserIdFromToken(validToken)
-	if err != nil {
-		log.Printf("Error getting user ID: %s\n", err)
-		respondWithError(w, 401, "cannot read user ID")
+	p, _ := principalFrom(r.Context())
+	userId := p.UserId
+	if cfg.RequireVerified && !p.EmailVerified {
+		respondWithError(w, 403, "verify your email address to chirp")
 		return
 	}
 
 	type parameters struct {
-		Body   string `json:"body"`
-		UserId int    `json:"userId"`
+		Body     string `json:"body"`
+		ParentId int    `json:"parent_id"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
-	params := parameters{
-		UserId: userId,
-	}
+	params := parameters{}
 
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		log.Printf("Error decoding parameters: %s\n", err)
 		respondWithError(w, 500, "Error decoding parameters...")
 		return
 	}
 
-	var cleanedBody string
-
 	if len(params.Body) > 140 {
 		respondWithError(w, 400, "Chirp is too long")
 		return
-	} else {
-		profanity := []string{"kerfuffle", "sharbert", "fornax"}
-
-		res := strings.Split(params.Body, " ")
-		for i, v := range res {
-			for _, c := range profanity {
-				if strings.ToLower(v) == c {
-					res[i] = "****"
-				}
-			}
-		}
-		cleanedBody = strings.Join(res, " ")
 	}
 
-	respVals, err := cfg.DB.CreateChirp(cleanedBody, params.UserId)
+	moderated := cfg.Moderation.Moderate(params.Body)
+	if moderated.Rejected {
+		respondWithError(w, 400, "Chirp was rejected by the content filter")
+		return
+	}
+
+	respVals, err := cfg.DB.CreateChirp(database.Chirp{
+		Author_Id:  userId,
+		Body:       moderated.Body,
+		Parent_Id:  params.ParentId,
+		Entities:   cfg.parseEntities(moderated.Body),
+		Moderation: moderated.Findings,
+	})
+	if errors.Is(err, database.ErrParentChirpNotFound) {
+		respondWithError(w, 400, "Parent chirp doesn't exist")
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		respondWithError(w, 500, "error creating chirp")
+		return
 	}
 
 	respondWithJSON(w, 201, respVals)
 }
 
-func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
-	// get token
-	token := r.Header.Get("Authorization")
-
-	strippedToken := strings.TrimPrefix(token, "Bearer ")
-
-	validToken, err := jwt.ValidateToken(strippedToken, "chirpy-access")
+// thread returns a chirp and its replies. depth limits how many levels of
+// replies are included.
+func (cfg *apiConfig) thread(w http.ResponseWriter, r *http.Request) {
+	chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
 	if err != nil {
-		log.Printf("Error validating token: %s\n", err)
-		respondWithError(w, 401, "invalid token")
+		respondWithError(w, 400, "Invalid chirp ID")
 		return
 	}
 
-	// get user id from token
-	userId, err := jwt.GetUserIdFromToken(validToken)
+	depth := defaultThreadDepth
+	if v := r.URL.Query().Get("depth"); v != "" {
+		depth, err = strconv.Atoi(v)
+		if err != nil || depth < 0 || depth > database.MaxThreadDepth {
+			respondWithError(w, 400, fmt.Sprintf("depth must be between 0 and %d", database.MaxThreadDepth))
+			return
+		}
+	}
+
+	thread, err := cfg.DB.GetThread(chirpId, depth)
 	if err != nil {
-		log.Printf("Error getting user ID: %s\n", err)
-		respondWithError(w, 401, "cannot read user ID")
+		respondWithError(w, 404, "Chirp doesn't exist")
 		return
 	}
+	respondWithJSON(w, 200, thread)
+}
+
+// deleteChirp deletes one of the caller's chirps. Moderators may delete
+// anyone's. A chirp with replies leaves a tombstone in its thread.
+func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
 
 	chirpId := chi.URLParam(r, "chirpID")
 	chirpIdInt, err := strconv.Atoi(chirpId)
@@ -422,7 +847,12 @@ func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = cfg.DB.DeleteChirp(chirpIdInt, userId)
+	// moderators can delete anyone's chirp; the store audits it
+	if p.hasScope(scopeChirpsModerate) {
+		err = cfg.DB.DeleteChirpAsModerator(chirpIdInt, p.UserId)
+	} else {
+		err = cfg.DB.DeleteChirp(chirpIdInt, p.UserId)
+	}
 	if err != nil {
 		log.Printf("Error deleting chirp: %s\n", err)
 		respondWithError(w, 403, "Cannot delete chirp")
@@ -509,6 +939,8 @@ func middlewareCors(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
+		// page cursors travel in headers; see respondWithPage
+		w.Header().Set("Access-Control-Expose-Headers", "Link, Next-Cursor, Prev-Cursor")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
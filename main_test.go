@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jming514/chirpy/internals/database"
+	"github.com/jming514/chirpy/internals/jwt"
+	"github.com/jming514/chirpy/internals/mailer"
+	"github.com/jming514/chirpy/internals/password"
+	"github.com/jming514/chirpy/internals/ratelimit"
+)
+
+func TestMain(m *testing.M) {
+	// full-strength hashing makes signing up and logging in very slow
+	password.DefaultParams.Memory = 64
+	os.Exit(m.Run())
+}
+
+// testServer serves Chirpy from a fresh JSON store, keeping the mail it
+// sends
+type testServer struct {
+	*httptest.Server
+	cfg  *apiConfig
+	mail *mailer.Memory
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("JWT_SECRET", "")
+	keyring, err := jwt.LoadKeyring(filepath.Join(dir, "jwt_keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt.UseKeyring(keyring)
+	t.Cleanup(func() { jwt.UseKeyring(nil) })
+
+	db, err := database.NewStore(database.StoreConfig{Driver: "json", Path: filepath.Join(dir, "database")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	index, err := buildSearchIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := moderationFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{mail: &mailer.Memory{}}
+	s.cfg = &apiConfig{
+		DB:         indexedStore{Store: db, index: index},
+		Keys:       keyring,
+		Search:     index,
+		Moderation: pipeline,
+		Limiter:    ratelimit.New(),
+		Mailer:     s.mail,
+	}
+	s.Server = httptest.NewServer(s.cfg.routes())
+	t.Cleanup(s.Close)
+	return s
+}
+
+// do sends a request to path with body as JSON, if it isn't nil, and
+// token as a Bearer token, if it is set
+func (s *testServer) do(t *testing.T, method, path, token string, body any) *http.Response {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// expect fails the test unless resp has status code. It decodes the JSON
+// body into v, if v isn't nil.
+func expect(t *testing.T, resp *http.Response, code int, v any) {
+	t.Helper()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != code {
+		t.Fatalf("%s %s: got %d %s, want %d", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, body, code)
+	}
+	if v != nil {
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Fatalf("%s %s: decoding %s: %v", resp.Request.Method, resp.Request.URL.Path, body, err)
+		}
+	}
+}
+
+// errorBody is the body of an error response
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// signUp creates a user with password "password" and logs them in
+func (s *testServer) signUp(t *testing.T, email string) database.UserReturn {
+	t.Helper()
+
+	expect(t, s.do(t, "POST", "/api/users", "", userParams{Email: email, Password: "password"}), 201, nil)
+	return s.login(t, email, "password")
+}
+
+// signUpAs signs up a user, gives them role and logs them in again so
+// their tokens carry it
+func (s *testServer) signUpAs(t *testing.T, email, role string) database.UserReturn {
+	t.Helper()
+
+	user := s.signUp(t, email)
+	_, err := s.cfg.DB.SetUserRole(user.Id, role, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.login(t, email, "password")
+}
+
+// login logs in with email and password
+func (s *testServer) login(t *testing.T, email, password string) database.UserReturn {
+	t.Helper()
+
+	var user database.UserReturn
+	expect(t, s.do(t, "POST", "/api/login", "", userParams{Email: email, Password: password}), 200, &user)
+	if user.Token == "" || user.Refresh_Token == "" {
+		t.Fatalf("login of %s returned %+v", email, user)
+	}
+	return user
+}
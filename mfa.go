@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jming514/chirpy/internals/database"
+	"github.com/jming514/chirpy/internals/jwt"
+	"github.com/jming514/chirpy/internals/totp"
+)
+
+const (
+	totpIssuer = "Chirpy"
+	// recoveryCodeCount is how many recovery codes a user gets when they
+	// confirm an authenticator
+	recoveryCodeCount = 10
+)
+
+// requireMFA answers a login whose password was right but which still
+// needs a code, with a short-lived token to exchange at /api/login/mfa
+func (cfg *apiConfig) requireMFA(w http.ResponseWriter, user database.UserReturn) {
+	token, err := jwt.CreateToken(mfaTokenSeconds, user.Id, "chirpy-mfa")
+	if err != nil {
+		log.Printf("Error creating token: %s\n", err)
+		respondWithError(w, 500, "error creating token...")
+		return
+	}
+
+	type response struct {
+		MFA_Required bool   `json:"mfa_required"`
+		MFA_Token    string `json:"mfa_token"`
+		Expires_In   int    `json:"expires_in"`
+	}
+	respondWithJSON(w, 200, response{
+		MFA_Required: true,
+		MFA_Token:    token,
+		Expires_In:   mfaTokenSeconds,
+	})
+}
+
+// loginMFA exchanges an mfa token and a code from the user's authenticator,
+// or one of their recovery codes, for access and refresh tokens. The mfa
+// token is spent by the attempt, whether or not the code is right.
+func (cfg *apiConfig) loginMFA(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFA_Token     string `json:"mfa_token"`
+		Code          string `json:"code"`
+		Recovery_Code string `json:"recovery_code"`
+		Device        string `json:"device"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 500, "Error decoding parameters...")
+		return
+	}
+
+	validToken, err := jwt.ValidateToken(params.MFA_Token, "chirpy-mfa")
+	if err != nil {
+		log.Printf("Error validating token: %s\n", err)
+		respondWithError(w, 401, "invalid token")
+		return
+	}
+	userId, err := jwt.GetUserIdFromToken(validToken)
+	if err != nil {
+		log.Printf("Error getting user ID: %s\n", err)
+		respondWithError(w, 401, "cannot read user ID")
+		return
+	}
+	user, err := cfg.DB.GetUser(strconv.Itoa(userId))
+	if err != nil {
+		respondWithError(w, 401, "invalid token")
+		return
+	}
+	if user.Suspension.Active(time.Now()) {
+		respondWithError(w, 403, "account suspended")
+		return
+	}
+
+	// codes are guessed against the same throttle as passwords
+	throttle := newLoginThrottle(user.Email, r)
+	if cfg.throttled(w, throttle) {
+		return
+	}
+	// and a token is good for one attempt, so each guess costs a password
+	claims, err := jwt.GetClaims(validToken)
+	if err != nil || claims.ExpiresAt == nil {
+		respondWithError(w, 401, "invalid token")
+		return
+	}
+	err = cfg.DB.ConsumeToken(params.MFA_Token, claims.ExpiresAt.Time)
+	if errors.Is(err, database.ErrTokenUsed) {
+		respondWithError(w, 401, "token already used")
+		return
+	}
+	if err != nil {
+		log.Printf("Error spending token: %s\n", err)
+		respondWithError(w, 500, "Error logging in...")
+		return
+	}
+
+	err = cfg.verifySecondFactor(userId, params.Code, params.Recovery_Code)
+	if err != nil {
+		log.Printf("Error verifying second factor: %s\n", err)
+		cfg.loginFailed(throttle, user.Email, r)
+		respondWithError(w, 401, "invalid code")
+		return
+	}
+	cfg.loginSucceeded(throttle)
+
+	cfg.issueTokens(w, r, database.UserReturn{
+		Id:            user.Id,
+		Email:         user.Email,
+		Is_Chirpy_Red: user.Is_Chirpy_Red,
+		Role:          user.Role,
+		EmailVerified: user.EmailVerified,
+	}, params.Device)
+}
+
+// verifySecondFactor checks a code from userId's authenticator, or spends
+// one of their recovery codes if recoveryCode is set. Either works once.
+func (cfg *apiConfig) verifySecondFactor(userId int, code string, recoveryCode string) error {
+	if recoveryCode != "" {
+		return cfg.DB.UseRecoveryCode(userId, normalizeRecoveryCode(recoveryCode))
+	}
+
+	enrollment, err := cfg.DB.GetTOTP(userId)
+	if err != nil {
+		return err
+	}
+	counter, err := totp.Validate(enrollment.Secret, code, time.Now())
+	if err != nil {
+		return err
+	}
+	return cfg.DB.UseTOTPCode(userId, counter)
+}
+
+// enrollTOTP starts enrolling an authenticator for the caller. It guards
+// logins once confirmed with a code from it.
+func (cfg *apiConfig) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	user, err := cfg.DB.GetUser(strconv.Itoa(p.UserId))
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Printf("Error generating secret: %s\n", err)
+		respondWithError(w, 500, "Cannot enroll authenticator")
+		return
+	}
+	_, err = cfg.DB.EnrollTOTP(p.UserId, secret)
+	if errors.Is(err, database.ErrTOTPEnabled) {
+		respondWithError(w, 409, "an authenticator is already enabled")
+		return
+	}
+	if err != nil {
+		log.Printf("Error enrolling authenticator: %s\n", err)
+		respondWithError(w, 500, "Cannot enroll authenticator")
+		return
+	}
+
+	type response struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	respondWithJSON(w, 201, response{
+		Secret: secret,
+		URI:    totp.URI(totpIssuer, user.Email, secret),
+	})
+}
+
+// confirmTOTP enables the caller's pending authenticator and hands out
+// their recovery codes, which are shown this once
+func (cfg *apiConfig) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 500, "Error decoding parameters...")
+		return
+	}
+
+	enrollment, err := cfg.DB.GetTOTP(p.UserId)
+	if errors.Is(err, database.ErrTOTPNotEnrolled) {
+		respondWithError(w, 404, "no authenticator to confirm")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting authenticator: %s\n", err)
+		respondWithError(w, 500, "Cannot confirm authenticator")
+		return
+	}
+	if enrollment.Enabled() {
+		respondWithError(w, 409, "the authenticator is already enabled")
+		return
+	}
+	counter, err := totp.Validate(enrollment.Secret, params.Code, time.Now())
+	if err != nil {
+		respondWithError(w, 400, "invalid code")
+		return
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		log.Printf("Error generating recovery codes: %s\n", err)
+		respondWithError(w, 500, "Cannot confirm authenticator")
+		return
+	}
+	err = cfg.DB.ConfirmTOTP(p.UserId, counter, codes)
+	if errors.Is(err, database.ErrTOTPEnabled) {
+		respondWithError(w, 409, "the authenticator is already enabled")
+		return
+	}
+	if err != nil {
+		log.Printf("Error confirming authenticator: %s\n", err)
+		respondWithError(w, 500, "Cannot confirm authenticator")
+		return
+	}
+
+	type response struct {
+		Recovery_Codes []string `json:"recovery_codes"`
+	}
+	respondWithJSON(w, 200, response{Recovery_Codes: codes})
+}
+
+// disableTOTP removes the caller's authenticator. An enabled one must be
+// proven with a code or a recovery code first, which counts against the
+// login throttle like a code given at login.
+func (cfg *apiConfig) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	type parameters struct {
+		Code          string `json:"code"`
+		Recovery_Code string `json:"recovery_code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 500, "Error decoding parameters...")
+		return
+	}
+
+	enrollment, err := cfg.DB.GetTOTP(p.UserId)
+	if errors.Is(err, database.ErrTOTPNotEnrolled) {
+		respondWithError(w, 404, "no authenticator enrolled")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting authenticator: %s\n", err)
+		respondWithError(w, 500, "Cannot remove authenticator")
+		return
+	}
+	if enrollment.Enabled() {
+		throttle := newLoginThrottle(p.Email, r)
+		if cfg.throttled(w, throttle) {
+			return
+		}
+		err = cfg.verifySecondFactor(p.UserId, params.Code, params.Recovery_Code)
+		if err != nil {
+			cfg.loginFailed(throttle, p.Email, r)
+			respondWithError(w, 401, "invalid code")
+			return
+		}
+	}
+
+	err = cfg.DB.DisableTOTP(p.UserId)
+	if err != nil {
+		log.Printf("Error removing authenticator: %s\n", err)
+		respondWithError(w, 500, "Cannot remove authenticator")
+		return
+	}
+	respondWithJSON(w, 200, "ok")
+}
+
+// generateRecoveryCodes returns n random codes like "3f9a1-c07e2"
+func generateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		s := hex.EncodeToString(b)
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode forgives case, spaces and a missing dash
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	if len(code) != 10 {
+		return code
+	}
+	return code[:5] + "-" + code[5:]
+}
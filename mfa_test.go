@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jming514/chirpy/internals/database"
+	"github.com/jming514/chirpy/internals/totp"
+)
+
+func TestLoginMFA(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	expect(t, s.do(t, "POST", "/api/users/mfa/totp", user.Token, nil), 201, &enrollment)
+	now := time.Now()
+	code, err := totp.Code(enrollment.Secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var confirmed struct {
+		Recovery_Codes []string `json:"recovery_codes"`
+	}
+	expect(t, s.do(t, "POST", "/api/users/mfa/totp/confirm", user.Token, map[string]string{"code": code}), 200, &confirmed)
+	if len(confirmed.Recovery_Codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes", len(confirmed.Recovery_Codes))
+	}
+
+	// the password alone now only gets a token to trade for a code
+	mfaToken := func() string {
+		t.Helper()
+		var challenge struct {
+			MFA_Required bool   `json:"mfa_required"`
+			MFA_Token    string `json:"mfa_token"`
+			Token        string `json:"token"`
+		}
+		expect(t, s.do(t, "POST", "/api/login", "", userParams{Email: user.Email, Password: "password"}), 200, &challenge)
+		if !challenge.MFA_Required || challenge.MFA_Token == "" || challenge.Token != "" {
+			t.Fatalf("login with an authenticator got %+v", challenge)
+		}
+		return challenge.MFA_Token
+	}
+	loginMFA := func(params map[string]string, code int) database.UserReturn {
+		t.Helper()
+		var login database.UserReturn
+		expect(t, s.do(t, "POST", "/api/login/mfa", "", params), code, &login)
+		return login
+	}
+
+	token := mfaToken()
+	loginMFA(map[string]string{"mfa_token": user.Token, "code": code}, 401)
+	loginMFA(map[string]string{"mfa_token": token, "code": "000000"}, 401)
+	// a token is spent by any attempt
+	next, err := totp.Code(enrollment.Secret, now.Add(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body errorBody
+	expect(t, s.do(t, "POST", "/api/login/mfa", "", map[string]string{"mfa_token": token, "code": next}), 401, &body)
+	if body.Error != "token already used" {
+		t.Fatalf("reused mfa token got %q", body.Error)
+	}
+	// the confirming code is spent; the next one works once
+	loginMFA(map[string]string{"mfa_token": mfaToken(), "code": code}, 401)
+	login := loginMFA(map[string]string{"mfa_token": mfaToken(), "code": next}, 200)
+	if login.Token == "" || login.Refresh_Token == "" || login.Session_Id == 0 {
+		t.Fatalf("login with a code got %+v", login)
+	}
+	loginMFA(map[string]string{"mfa_token": mfaToken(), "code": next}, 401)
+
+	loginMFA(map[string]string{"mfa_token": mfaToken(), "recovery_code": confirmed.Recovery_Codes[0]}, 200)
+	loginMFA(map[string]string{"mfa_token": mfaToken(), "recovery_code": confirmed.Recovery_Codes[0]}, 401)
+
+	// removing the authenticator takes a code, guessed against the same
+	// throttle as at login
+	err = s.cfg.DB.ClearLoginThrottle(database.AccountThrottleKey(user.Email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= accountLockout.FreeAttempts; i++ {
+		expect(t, s.do(t, "DELETE", "/api/users/mfa/totp", login.Token, map[string]string{"code": "000000"}), 401, nil)
+	}
+	recovery := map[string]string{"recovery_code": confirmed.Recovery_Codes[1]}
+	expect(t, s.do(t, "DELETE", "/api/users/mfa/totp", login.Token, recovery), 429, nil)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// runMigrate implements `chirpy migrate [-dry-run] [-no-backup]`
+func runMigrate(storeConfig database.StoreConfig, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list pending migrations without applying them")
+	noBackup := flags.Bool("no-backup", false, "don't back up the database before migrating")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: chirpy migrate [-dry-run] [-no-backup]")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		os.Exit(2)
+	}
+
+	migrations, err := database.Migrate(storeConfig, database.MigrateOptions{
+		DryRun: *dryRun,
+		Backup: !*noBackup,
+	})
+	if err != nil {
+		log.Fatal("Error migrating database: ", err)
+	}
+
+	if len(migrations) == 0 {
+		fmt.Println("database is up to date")
+		return
+	}
+
+	verb := "applied"
+	if *dryRun {
+		verb = "pending"
+	}
+	for _, m := range migrations {
+		fmt.Printf("%s %d: %s\n", verb, m.Version, m.Description)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// maxPageLimit caps the limit parameter of list endpoints
+const maxPageLimit = 100
+
+// cursorPrefix versions the cursor format so it can change later
+const cursorPrefix = "v1:"
+
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(data), cursorPrefix) {
+		return 0, errors.New("invalid cursor")
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(string(data), cursorPrefix))
+	if err != nil || id <= 0 {
+		return 0, errors.New("invalid cursor")
+	}
+	return id, nil
+}
+
+// pageFromRequest reads the limit, after and before parameters of a list
+// endpoint. Without a limit the whole list is returned.
+func pageFromRequest(r *http.Request) (database.Page, error) {
+	var page database.Page
+	query := r.URL.Query()
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return page, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		page.Limit = limit
+	}
+
+	var err error
+	if v := query.Get("after"); v != "" {
+		page.After, err = decodeCursor(v)
+		if err != nil {
+			return page, err
+		}
+	}
+	if v := query.Get("before"); v != "" {
+		page.Before, err = decodeCursor(v)
+		if err != nil {
+			return page, err
+		}
+	}
+
+	return page, nil
+}
+
+// respondWithPage sends the page of items a store returned for page.
+// Stores return one item more than the limit when the list goes on; it is
+// dropped here.
+//
+// The body stays a plain JSON array, so the cursors are part of the API as
+// headers: Next-Cursor and Prev-Cursor hold the values to pass as after and
+// before for the neighbouring pages, and Link carries the same as complete
+// URLs with rel="next" and rel="prev". A header is left out at that end of
+// the list. Every list endpoint, search included, pages this way.
+func respondWithPage[T any](w http.ResponseWriter, r *http.Request, items []T, id func(T) int, page database.Page) {
+	hasPrev := page.After != 0
+	hasNext := page.Before != 0
+	if page.Limit > 0 && len(items) > page.Limit {
+		if page.Backwards() {
+			items = items[1:]
+			hasPrev = true
+		} else {
+			items = items[:page.Limit]
+			hasNext = true
+		}
+	}
+	if items == nil {
+		items = []T{}
+	}
+
+	if len(items) > 0 {
+		link := func(rel, param string, cursor string) {
+			query := r.URL.Query()
+			query.Del("after")
+			query.Del("before")
+			query.Set(param, cursor)
+			w.Header().Add("Link", fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, query.Encode(), rel))
+		}
+		if hasNext {
+			cursor := encodeCursor(id(items[len(items)-1]))
+			w.Header().Set("Next-Cursor", cursor)
+			link("next", "after", cursor)
+		}
+		if hasPrev {
+			cursor := encodeCursor(id(items[0]))
+			w.Header().Set("Prev-Cursor", cursor)
+			link("prev", "before", cursor)
+		}
+	}
+
+	respondWithJSON(w, 200, items)
+}
+
+func idOfChirp(c database.Chirp) int { return c.Id }
+
+func idOfUser(u publicUser) int { return u.Id }
+
+func idOfReport(r database.Report) int { return r.Id }
+
+func idOfAuditEntry(e database.AuditEntry) int { return e.Id }
+
+func idOfNotification(n database.Notification) int { return n.Id }
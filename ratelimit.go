@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jming514/chirpy/internals/ratelimit"
+)
+
+// ratePolicy limits one kind of request. Chirpy Red users get the red
+// limit when it is set.
+type ratePolicy struct {
+	name  string
+	limit ratelimit.Limit
+	red   ratelimit.Limit
+}
+
+var (
+	// apiPolicy limits every API request from a client IP, ahead of
+	// authentication, so reads and requests with bad tokens are limited too
+	apiPolicy = ratePolicy{
+		name:  "api",
+		limit: ratelimit.Limit{Requests: 300, Period: time.Minute},
+	}
+	loginPolicy = ratePolicy{
+		name:  "login",
+		limit: ratelimit.Limit{Requests: 10, Period: time.Minute},
+	}
+	signupPolicy = ratePolicy{
+		name:  "signup",
+		limit: ratelimit.Limit{Requests: 10, Period: time.Hour},
+	}
+	// resetPolicy limits the mail a client can have sent
+	resetPolicy = ratePolicy{
+		name:  "reset",
+		limit: ratelimit.Limit{Requests: 5, Period: time.Hour},
+	}
+	refreshPolicy = ratePolicy{
+		name:  "refresh",
+		limit: ratelimit.Limit{Requests: 30, Period: time.Minute},
+	}
+	chirpPolicy = ratePolicy{
+		name:  "chirp",
+		limit: ratelimit.Limit{Requests: 30, Period: time.Minute},
+		red:   ratelimit.Limit{Requests: 120, Period: time.Minute},
+	}
+	writePolicy = ratePolicy{
+		name:  "write",
+		limit: ratelimit.Limit{Requests: 60, Period: time.Minute},
+		red:   ratelimit.Limit{Requests: 240, Period: time.Minute},
+	}
+	searchPolicy = ratePolicy{
+		name:  "search",
+		limit: ratelimit.Limit{Requests: 30, Period: time.Minute},
+		red:   ratelimit.Limit{Requests: 120, Period: time.Minute},
+	}
+)
+
+// rateLimit limits requests to policy, per user when the request is
+// authenticated and per client IP otherwise. To limit per user it must run
+// after authenticate. Setting RATE_LIMIT=off disables it.
+func (cfg *apiConfig) rateLimit(policy ratePolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if os.Getenv("RATE_LIMIT") == "off" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := policy.limit
+			key := policy.name + ":ip:" + clientIP(r)
+			if p, ok := principalFrom(r.Context()); ok {
+				key = policy.name + ":user:" + strconv.Itoa(p.UserId)
+				if p.ChirpyRed && policy.red.Requests > 0 {
+					limit = policy.red
+				}
+			}
+
+			d := cfg.Limiter.Allow(key, limit)
+			header := w.Header()
+			header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, int(limit.Period.Seconds())))
+			header.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+			header.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+			header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+			if !d.Allowed {
+				header.Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+				respondWithError(w, 429, "too many requests")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP is the address the request came from. Behind a proxy, set
+// TRUST_PROXY=true so it is read from the forwarding headers instead.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jming514/chirpy/internals/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	cfg := &apiConfig{Limiter: ratelimit.New()}
+	policy := ratePolicy{
+		name:  "test",
+		limit: ratelimit.Limit{Requests: 2, Period: time.Minute},
+		red:   ratelimit.Limit{Requests: 3, Period: time.Minute},
+	}
+	handler := cfg.rateLimit(policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	send := func(remoteAddr string, p *principal) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = remoteAddr
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, *p))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 1; i <= 2; i++ {
+		w := send("10.0.0.1:1234", nil)
+		if w.Code != 204 {
+			t.Fatalf("request %d got %d", i, w.Code)
+		}
+		header := w.Header()
+		if header.Get("RateLimit-Policy") != "2;w=60" || header.Get("RateLimit-Limit") != "2" {
+			t.Fatalf("request %d has policy %q and limit %q", i, header.Get("RateLimit-Policy"), header.Get("RateLimit-Limit"))
+		}
+		if remaining := header.Get("RateLimit-Remaining"); remaining != strconv.Itoa(2-i) {
+			t.Fatalf("request %d has %s remaining, want %d", i, remaining, 2-i)
+		}
+	}
+
+	// the client's port doesn't matter, only its address
+	w := send("10.0.0.1:5678", nil)
+	if w.Code != 429 {
+		t.Fatalf("third request got %d, want 429", w.Code)
+	}
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 30 {
+		t.Fatalf("Retry-After is %q, want 1 to 30 seconds", w.Header().Get("Retry-After"))
+	}
+	if reset, _ := strconv.Atoi(w.Header().Get("RateLimit-Reset")); reset < 1 || reset > 60 {
+		t.Fatalf("RateLimit-Reset is %q", w.Header().Get("RateLimit-Reset"))
+	}
+	if w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("denied request has %s remaining", w.Header().Get("RateLimit-Remaining"))
+	}
+
+	if w = send("10.0.0.2:1234", nil); w.Code != 204 {
+		t.Fatalf("another address got %d", w.Code)
+	}
+	// an authenticated user is limited apart from the address they use,
+	// and a Chirpy Red user to the red limit
+	if w = send("10.0.0.1:1234", &principal{UserId: 1}); w.Code != 204 {
+		t.Fatalf("user on a limited address got %d", w.Code)
+	}
+	red := &principal{UserId: 2, ChirpyRed: true}
+	for i := 1; i <= 3; i++ {
+		if w = send("10.0.0.1:1234", red); w.Code != 204 || w.Header().Get("RateLimit-Limit") != "3" {
+			t.Fatalf("Chirpy Red request %d got %d with limit %q", i, w.Code, w.Header().Get("RateLimit-Limit"))
+		}
+	}
+	if w = send("10.0.0.1:1234", red); w.Code != 429 {
+		t.Fatalf("fourth Chirpy Red request got %d, want 429", w.Code)
+	}
+}
+
+func TestRateLimitOff(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	cfg := &apiConfig{Limiter: ratelimit.New()}
+	handler := cfg.rateLimit(loginPolicy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+
+	for i := 0; i <= loginPolicy.limit.Requests; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/login", nil))
+		if w.Code != 204 || w.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("request %d with rate limiting off got %d, limit %q", i, w.Code, w.Header().Get("RateLimit-Limit"))
+		}
+	}
+}
+
+func TestLoginIsRateLimited(t *testing.T) {
+	s := newTestServer(t)
+
+	// a different address each time, so no account is locked out first
+	var resp *http.Response
+	for i := 0; i <= loginPolicy.limit.Requests; i++ {
+		resp = s.do(t, "POST", "/api/login", "", userParams{Email: fmt.Sprintf("user%d@example.com", i), Password: "password"})
+	}
+	var body errorBody
+	expect(t, resp, 429, &body)
+	if body.Error != "too many requests" || resp.Header.Get("Retry-After") == "" || resp.Header.Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("rate limited login got %q with headers %v", body.Error, resp.Header)
+	}
+}
+
+func TestAPIIsRateLimitedPerIP(t *testing.T) {
+	s := newTestServer(t)
+
+	// reads are limited, though they need no login
+	for i := 0; i < apiPolicy.limit.Requests; i++ {
+		expect(t, s.do(t, "GET", "/api/chirps", "", nil), 200, nil)
+	}
+	var body errorBody
+	expect(t, s.do(t, "GET", "/api/chirps", "", nil), 429, &body)
+	if body.Error != "too many requests" {
+		t.Fatalf("rate limited read got %q", body.Error)
+	}
+
+	// and so are requests with bad tokens, before they are authenticated
+	s = newTestServer(t)
+	for i := 0; i < apiPolicy.limit.Requests; i++ {
+		expect(t, s.do(t, "GET", "/api/timeline", "garbage", nil), 401, nil)
+	}
+	expect(t, s.do(t, "GET", "/api/timeline", "garbage", nil), 429, nil)
+	expect(t, s.do(t, "GET", "/api/timeline", personalTokenPrefix+"unknown", nil), 429, nil)
+}
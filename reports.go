@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// maxReportReason caps the length of the reason given with a report
+const maxReportReason = 500
+
+// reportChirp files the caller's report about {chirpID}
+func (cfg *apiConfig) reportChirp(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Reason string `json:"reason"`
+	}
+	p, _ := principalFrom(r.Context())
+	chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirp ID")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters...")
+		return
+	}
+	if params.Reason == "" || len(params.Reason) > maxReportReason {
+		respondWithError(w, 400, fmt.Sprintf("reason must be 1 to %d characters", maxReportReason))
+		return
+	}
+
+	report, err := cfg.DB.CreateReport(chirpId, p.UserId, params.Reason)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, "Chirp doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating report: %s\n", err)
+		respondWithError(w, 500, "Cannot create report")
+		return
+	}
+	respondWithJSON(w, 201, report)
+}
+
+// reports lists the report queue, optionally filtered by status
+func (cfg *apiConfig) reports(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", database.ReportOpen, database.ReportClaimed, database.ReportResolved:
+	default:
+		respondWithError(w, 400, "status must be open, claimed or resolved")
+		return
+	}
+	page, err := pageFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	reports, err := cfg.DB.GetReports(status, page)
+	if err != nil {
+		log.Printf("Error getting reports: %s\n", err)
+		respondWithError(w, 500, "Cannot get reports")
+		return
+	}
+	respondWithPage(w, r, reports, idOfReport, page)
+}
+
+// respondWithReport responds with a claimed or resolved report, or with
+// why it couldn't be
+func respondWithReport(w http.ResponseWriter, report database.Report, err error) {
+	switch {
+	case errors.Is(err, database.ErrReportNotFound):
+		respondWithError(w, 404, "Report doesn't exist")
+	case errors.Is(err, database.ErrReportClaimed), errors.Is(err, database.ErrReportResolved):
+		respondWithError(w, 409, err.Error())
+	case errors.Is(err, database.ErrOutranked):
+		respondWithError(w, 403, err.Error())
+	case err != nil:
+		log.Printf("Error updating report: %s\n", err)
+		respondWithError(w, 500, "Cannot update report")
+	default:
+		respondWithJSON(w, 200, report)
+	}
+}
+
+func (cfg *apiConfig) claimReport(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	reportId, err := strconv.Atoi(chi.URLParam(r, "reportID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid report ID")
+		return
+	}
+
+	report, err := cfg.DB.ClaimReport(reportId, p.UserId)
+	respondWithReport(w, report, err)
+}
+
+// resolveReport closes a report by dismissing it, hiding the chirp or
+// suspending its author. suspend_for limits the suspension, e.g. "72h";
+// without it the suspension has no end.
+func (cfg *apiConfig) resolveReport(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Resolution string `json:"resolution"`
+		Note       string `json:"note"`
+		SuspendFor string `json:"suspend_for"`
+	}
+	p, _ := principalFrom(r.Context())
+	reportId, err := strconv.Atoi(chi.URLParam(r, "reportID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid report ID")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters...")
+		return
+	}
+	if !database.ValidResolution(params.Resolution) {
+		respondWithError(w, 400, "resolution must be dismiss, hide_chirp or suspend_author")
+		return
+	}
+
+	resolution := database.Resolution{Action: params.Resolution, Note: params.Note}
+	if params.SuspendFor != "" {
+		d, err := time.ParseDuration(params.SuspendFor)
+		if err != nil || d <= 0 {
+			respondWithError(w, 400, "suspend_for must be a positive duration")
+			return
+		}
+		until := time.Now().Add(d).UTC()
+		resolution.SuspendUntil = &until
+	}
+
+	report, err := cfg.DB.ResolveReport(reportId, p.UserId, resolution)
+	respondWithReport(w, report, err)
+}
+
+// auditLog lists the actions moderators took, newest first
+func (cfg *apiConfig) auditLog(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	entries, err := cfg.DB.GetAuditLog(page)
+	if err != nil {
+		log.Printf("Error getting audit log: %s\n", err)
+		respondWithError(w, 500, "Cannot get audit log")
+		return
+	}
+	respondWithPage(w, r, entries, idOfAuditEntry, page)
+}
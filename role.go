@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// runRole implements `chirpy role <user id> <role>`, which is how the first
+// admin is made; after that admins can use PUT /admin/users/{userID}/role.
+// The JSON store is held in memory by a running server, so stop the server
+// before using it there.
+func runRole(storeConfig database.StoreConfig, args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: chirpy role <user id> user|moderator|admin")
+		os.Exit(2)
+	}
+	userId, err := strconv.Atoi(args[0])
+	if err != nil {
+		log.Fatal("Invalid user id: ", err)
+	}
+
+	db, err := database.NewStore(storeConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	user, err := db.SetUserRole(userId, args[1], 0)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal("Error setting role: ", err)
+	}
+
+	fmt.Printf("user %d (%s) is now %s\n", user.Id, user.Email, user.Role)
+}
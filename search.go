@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jming514/chirpy/internals/database"
+	"github.com/jming514/chirpy/internals/search"
+)
+
+// defaultSearchLimit is how many results a search returns unless the
+// request asks for a different number
+const defaultSearchLimit = 20
+
+// indexedStore keeps the search index in step with the chirps in the store
+type indexedStore struct {
+	database.Store
+	index *search.Index
+}
+
+func (s indexedStore) CreateChirp(chirp database.Chirp) (database.Chirp, error) {
+	chirp, err := s.Store.CreateChirp(chirp)
+	if err == nil {
+		s.index.Add(searchDoc(chirp))
+	}
+	return chirp, err
+}
+
+func (s indexedStore) DeleteChirp(chirpId int, userId int) error {
+	err := s.Store.DeleteChirp(chirpId, userId)
+	if err == nil {
+		s.index.Remove(chirpId)
+	}
+	return err
+}
+
+func (s indexedStore) DeleteChirpAsModerator(chirpId int, moderatorId int) error {
+	err := s.Store.DeleteChirpAsModerator(chirpId, moderatorId)
+	if err == nil {
+		s.index.Remove(chirpId)
+	}
+	return err
+}
+
+// ResolveReport takes a chirp hidden by the resolution out of the index
+func (s indexedStore) ResolveReport(reportId int, moderatorId int, resolution database.Resolution) (database.Report, error) {
+	report, err := s.Store.ResolveReport(reportId, moderatorId, resolution)
+	if err == nil && resolution.Action != database.ResolutionDismiss {
+		s.index.Remove(report.ChirpId)
+	}
+	return report, err
+}
+
+func searchDoc(chirp database.Chirp) search.Doc {
+	return search.Doc{Id: chirp.Id, AuthorId: chirp.Author_Id, Body: chirp.Body}
+}
+
+// buildSearchIndex indexes every chirp in db
+func buildSearchIndex(db database.Store) (*search.Index, error) {
+	chirps, err := db.GetChirps(database.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]search.Doc, len(chirps))
+	for i, chirp := range chirps {
+		docs[i] = searchDoc(chirp)
+	}
+	index := search.NewIndex()
+	index.Rebuild(docs)
+
+	return index, nil
+}
+
+// searchChirps implements GET /api/chirps/search?q=. Optional parameters
+// are author_id, sort (relevance or recency) and the paging parameters
+// limit, after and before.
+func (cfg *apiConfig) searchChirps(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := query.Get("q")
+	if q == "" {
+		respondWithError(w, 400, "q is required")
+		return
+	}
+
+	page, err := pageFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if page.Limit == 0 {
+		page.Limit = defaultSearchLimit
+	}
+
+	opts := search.Options{Ranking: search.Relevance}
+	if v := query.Get("author_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			respondWithError(w, 400, "Invalid author ID")
+			return
+		}
+		opts.AuthorId = id
+	}
+	switch v := query.Get("sort"); v {
+	case "", string(search.Relevance):
+	case string(search.Recency):
+		opts.Ranking = search.Recency
+	default:
+		respondWithError(w, 400, "sort must be relevance or recency")
+		return
+	}
+
+	// chirps deleted or hidden since they were indexed are left out before
+	// the results are paged, so the probe for a next page only counts
+	// chirps that are shown
+	results := cfg.Search.Search(q, opts)
+	ids := make([]int, len(results))
+	for i, result := range results {
+		ids[i] = result.Id
+	}
+	found, err := cfg.DB.GetChirps(database.Options{Ids: ids})
+	if err != nil {
+		log.Printf("Error getting chirps from search: %s\n", err)
+		respondWithError(w, 500, "Cannot search chirps")
+		return
+	}
+	visible := make(map[int]database.Chirp, len(found))
+	for _, chirp := range found {
+		visible[chirp.Id] = chirp
+	}
+	kept := results[:0]
+	for _, result := range results {
+		if _, ok := visible[result.Id]; ok {
+			kept = append(kept, result)
+		}
+	}
+
+	kept, err = pageOfResults(kept, opts.Ranking, page)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	chirps := make([]database.Chirp, len(kept))
+	for i, result := range kept {
+		chirps[i] = visible[result.Id]
+	}
+	respondWithPage(w, r, chirps, idOfChirp, page)
+}
+
+// pageOfResults returns the window page selects from ranked search
+// results, with one result more than the limit when they go on, as a store
+// would. Cursors are chirp ids. By recency the results are in descending id
+// order, so any id places a cursor; by relevance the cursor's chirp must
+// still be among the results.
+func pageOfResults(results []search.Result, ranking search.Ranking, page database.Page) ([]search.Result, error) {
+	// position returns the index of the first result past cursor
+	position := func(cursor int) (int, error) {
+		for i, result := range results {
+			if result.Id == cursor {
+				return i + 1, nil
+			}
+			if ranking == search.Recency && result.Id < cursor {
+				return i, nil
+			}
+		}
+		if ranking == search.Recency {
+			return len(results), nil
+		}
+		return 0, errors.New("cursor is no longer in the results")
+	}
+
+	start, end := 0, len(results)
+	if page.After != 0 {
+		i, err := position(page.After)
+		if err != nil {
+			return nil, err
+		}
+		start = i
+	}
+	if page.Before != 0 {
+		i, err := position(page.Before)
+		if err != nil {
+			return nil, err
+		}
+		// stop short of the cursor itself
+		end = i
+		if end > 0 && results[end-1].Id == page.Before {
+			end--
+		}
+	}
+	if start > end {
+		start = end
+	}
+
+	window := results[start:end]
+	if len(window) <= page.Limit+1 {
+		return window, nil
+	}
+	if page.Backwards() {
+		return window[len(window)-page.Limit-1:], nil
+	}
+	return window[:page.Limit+1], nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jming514/chirpy/internals/database"
+)
+
+func TestSearchPagesOnlyShownChirps(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+
+	for i := 1; i <= 4; i++ {
+		expect(t, s.do(t, "POST", "/api/chirps", user.Token, map[string]string{"body": fmt.Sprintf("hello %d", i)}), 201, nil)
+	}
+	// delete the newest behind the index's back, as if it were stale
+	err := s.cfg.DB.(indexedStore).Store.DeleteChirp(4, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sort := range []string{"recency", "relevance"} {
+		var chirps []database.Chirp
+		resp := s.do(t, "GET", "/api/chirps/search?q=hello&limit=2&sort="+sort, "", nil)
+		expect(t, resp, 200, &chirps)
+		if len(chirps) != 2 || chirps[0].Id == 4 || chirps[1].Id == 4 {
+			t.Fatalf("by %s, first page is %+v", sort, chirps)
+		}
+		if resp.Header.Get("Next-Cursor") == "" {
+			t.Fatalf("by %s, the first page of three shown chirps has no next page", sort)
+		}
+	}
+}
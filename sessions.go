@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// sessionTouchInterval is how stale a session's last-used time may get
+// before a request with one of its access tokens updates it
+const sessionTouchInterval = 5 * time.Minute
+
+// maxDeviceLength caps the device label a client may give its session
+const maxDeviceLength = 64
+
+// createSession records a login of userId from the requesting client. An
+// empty device is guessed from the user agent.
+func (cfg *apiConfig) createSession(r *http.Request, userId int, device string) (database.Session, error) {
+	return cfg.DB.CreateSession(newSession(r, userId, device))
+}
+
+// newSession describes a session of userId on the requesting client,
+// without recording it
+func newSession(r *http.Request, userId int, device string) database.Session {
+	device = strings.TrimSpace(device)
+	if device == "" {
+		device = deviceLabel(r.UserAgent())
+	}
+	if len(device) > maxDeviceLength {
+		device = device[:maxDeviceLength]
+	}
+
+	return database.Session{
+		UserId:    userId,
+		Device:    device,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// deviceLabel makes a rough, human readable name for the client behind ua,
+// like "Firefox on Linux"
+func deviceLabel(ua string) string {
+	if ua == "" {
+		return "Unknown device"
+	}
+
+	browser := ""
+	for _, b := range []struct{ token, name string }{
+		// order matters: Edge and Chrome also claim to be Safari
+		{"Edg/", "Edge"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	platform := ""
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			platform = o.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	}
+	// fall back to the product token, "Go-http-client/1.1" -> "Go-http-client"
+	product, _, _ := strings.Cut(ua, " ")
+	product, _, _ = strings.Cut(product, "/")
+	if len(product) > maxDeviceLength {
+		product = product[:maxDeviceLength]
+	}
+	return product
+}
+
+// sessions lists the caller's active sessions, most recently used first
+func (cfg *apiConfig) sessions(w http.ResponseWriter, r *http.Request) {
+	type session struct {
+		database.Session
+		Current bool `json:"current"`
+	}
+	p, _ := principalFrom(r.Context())
+
+	sessions, err := cfg.DB.GetSessions(p.UserId)
+	if err != nil {
+		log.Printf("Error getting sessions: %s\n", err)
+		respondWithError(w, 500, "Cannot get sessions")
+		return
+	}
+
+	resp := make([]session, len(sessions))
+	for i, s := range sessions {
+		resp[i] = session{Session: s, Current: s.Id == p.SessionId}
+	}
+	respondWithJSON(w, 200, resp)
+}
+
+// revokeSession logs one of the caller's sessions out. Its access tokens
+// stop working at once and its refresh token can't be used again.
+func (cfg *apiConfig) revokeSession(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	sessionId, err := strconv.Atoi(chi.URLParam(r, "sessionID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid session ID")
+		return
+	}
+
+	err = cfg.DB.RevokeSession(p.UserId, sessionId)
+	if errors.Is(err, database.ErrSessionNotFound) {
+		respondWithError(w, 404, "session not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking session: %s\n", err)
+		respondWithError(w, 500, "Cannot revoke session")
+		return
+	}
+	respondWithJSON(w, 200, "ok")
+}
+
+// revokeSessions logs the caller out everywhere, including the session
+// making the request. Personal access tokens keep working, so scripts
+// don't break; revoke them at /api/tokens.
+func (cfg *apiConfig) revokeSessions(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Revoked int `json:"revoked"`
+	}
+	p, _ := principalFrom(r.Context())
+
+	revoked, err := cfg.DB.RevokeSessions(p.UserId)
+	if err != nil {
+		log.Printf("Error revoking sessions: %s\n", err)
+		respondWithError(w, 500, "Cannot revoke sessions")
+		return
+	}
+	respondWithJSON(w, 200, response{Revoked: revoked})
+}
+
+// checkSession reports whether sessionId is an active session of userId,
+// noting that it was used if it hasn't been for a while
+func (cfg *apiConfig) checkSession(userId, sessionId int) (bool, error) {
+	session, err := cfg.DB.GetSession(sessionId)
+	if errors.Is(err, database.ErrSessionNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if session.UserId != userId || !session.Active(now) {
+		return false, nil
+	}
+
+	if now.Sub(session.LastUsedAt) > sessionTouchInterval {
+		if err := cfg.DB.TouchSession(sessionId); err != nil {
+			log.Printf("Error touching session: %s\n", err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jming514/chirpy/internals/database"
+	"github.com/jming514/chirpy/internals/jwt"
+)
+
+type sessionResponse struct {
+	database.Session
+	Current bool `json:"current"`
+}
+
+type refreshResponse struct {
+	Token         string `json:"token"`
+	Refresh_Token string `json:"refresh_token"`
+}
+
+func TestSessions(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	laptop := s.signUp(t, "user1@example.com")
+	phone := s.login(t, "user1@example.com", "password")
+
+	var sessions []sessionResponse
+	expect(t, s.do(t, "GET", "/api/sessions", laptop.Token, nil), 200, &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("sessions are %+v", sessions)
+	}
+	for _, session := range sessions {
+		if session.Current != (session.Id == laptop.Session_Id) {
+			t.Fatalf("session %d is marked current %v", session.Id, session.Current)
+		}
+	}
+
+	var refreshed refreshResponse
+	expect(t, s.do(t, "POST", "/api/refresh", phone.Refresh_Token, nil), 200, &refreshed)
+	// presenting the rotated token again logs the whole session out
+	expect(t, s.do(t, "POST", "/api/refresh", phone.Refresh_Token, nil), 401, nil)
+	expect(t, s.do(t, "POST", "/api/refresh", refreshed.Refresh_Token, nil), 401, nil)
+	expect(t, s.do(t, "GET", "/api/sessions", refreshed.Token, nil), 401, nil)
+
+	tablet := s.login(t, "user1@example.com", "password")
+	expect(t, s.do(t, "DELETE", "/api/sessions/"+strconv.Itoa(tablet.Session_Id), laptop.Token, nil), 200, nil)
+	expect(t, s.do(t, "GET", "/api/sessions", tablet.Token, nil), 401, nil)
+	expect(t, s.do(t, "DELETE", "/api/sessions/"+strconv.Itoa(tablet.Session_Id+100), laptop.Token, nil), 404, nil)
+
+	other := s.signUp(t, "user2@example.com")
+	expect(t, s.do(t, "DELETE", "/api/sessions/"+strconv.Itoa(other.Session_Id), laptop.Token, nil), 404, nil)
+
+	var revoked struct {
+		Revoked int `json:"revoked"`
+	}
+	expect(t, s.do(t, "DELETE", "/api/sessions", laptop.Token, nil), 200, &revoked)
+	if revoked.Revoked != 1 {
+		t.Fatalf("logging out everywhere ended %d sessions, want 1", revoked.Revoked)
+	}
+	expect(t, s.do(t, "GET", "/api/sessions", laptop.Token, nil), 401, nil)
+	expect(t, s.do(t, "GET", "/api/sessions", other.Token, nil), 200, nil)
+}
+
+func TestRefreshTokensFromBeforeSessions(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+
+	// before sessions, refresh tokens named none; the store recorded most
+	// of them in a token family, which is now a session
+	legacyToken := func() string {
+		t.Helper()
+		token, err := jwt.CreateRefreshToken(refreshTokenSeconds, user.Id, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	sessionOf := func(refreshToken string) int {
+		t.Helper()
+		validToken, err := jwt.ValidateToken(refreshToken, "chirpy-refresh")
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := jwt.GetClaims(validToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return claims.SessionId
+	}
+	countSessions := func() int {
+		t.Helper()
+		sessions, err := s.cfg.DB.GetSessions(user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(sessions)
+	}
+
+	family, err := s.cfg.DB.CreateSession(database.Session{UserId: user.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := legacyToken()
+	err = s.cfg.DB.CreateRefreshToken(family.Id, known, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var refreshed refreshResponse
+	expect(t, s.do(t, "POST", "/api/refresh", known, nil), 200, &refreshed)
+	if id := sessionOf(refreshed.Refresh_Token); id != family.Id {
+		t.Fatalf("known token was refreshed into session %d, want its family %d", id, family.Id)
+	}
+	if n := countSessions(); n != 2 {
+		t.Fatalf("refreshing a known token left %d sessions, want 2", n)
+	}
+	expect(t, s.do(t, "GET", "/api/sessions", refreshed.Token, nil), 200, nil)
+	expect(t, s.do(t, "POST", "/api/refresh", refreshed.Refresh_Token, nil), 200, nil)
+
+	// a token the store never saw starts a session
+	expect(t, s.do(t, "POST", "/api/refresh", legacyToken(), nil), 200, &refreshed)
+	if id := sessionOf(refreshed.Refresh_Token); id == 0 || id == family.Id || id == user.Session_Id {
+		t.Fatalf("unknown token was refreshed into session %d", id)
+	}
+	if n := countSessions(); n != 3 {
+		t.Fatalf("refreshing an unknown token left %d sessions, want 3", n)
+	}
+
+	// a token of a revoked family is refused, without starting a session
+	err = s.cfg.DB.RevokeSession(user.Id, family.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, s.do(t, "POST", "/api/refresh", known, nil), 401, nil)
+	if n := countSessions(); n != 2 {
+		t.Fatalf("after a refused refresh there are %d sessions, want 2", n)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// publicUser is a user as anyone can see them. Whether they are suspended
+// is public, but why and by whom is only shown to admins.
+type publicUser struct {
+	database.User
+	Suspension *publicSuspension `json:"suspension,omitempty"`
+}
+
+type publicSuspension struct {
+	At    time.Time  `json:"at"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+func newPublicUser(user database.User) publicUser {
+	public := publicUser{User: user}
+	if user.Suspension.Active(time.Now()) {
+		public.Suspension = &publicSuspension{At: user.Suspension.At, Until: user.Suspension.Until}
+	}
+	return public
+}
+
+func publicUsers(users []database.User) []publicUser {
+	public := make([]publicUser, len(users))
+	for i, user := range users {
+		public[i] = newPublicUser(user)
+	}
+	return public
+}
+
+// suspendUser suspends a user for duration, e.g. "72h", or bans them when
+// duration is empty. Their tokens stop working at once. Only users of a
+// lower role than the caller's can be suspended.
+func (cfg *apiConfig) suspendUser(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"`
+	}
+	p, _ := principalFrom(r.Context())
+	userId, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid user ID")
+		return
+	}
+	if userId == p.UserId {
+		respondWithError(w, 400, "You can't suspend yourself")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters...")
+		return
+	}
+	if params.Reason == "" {
+		respondWithError(w, 400, "reason is required")
+		return
+	}
+	var until *time.Time
+	if params.Duration != "" {
+		d, err := time.ParseDuration(params.Duration)
+		if err != nil || d <= 0 {
+			respondWithError(w, 400, "duration must be a positive duration")
+			return
+		}
+		t := time.Now().Add(d).UTC()
+		until = &t
+	}
+
+	user, err := cfg.DB.SuspendUser(userId, p.UserId, params.Reason, until)
+	if errors.Is(err, database.ErrOutranked) {
+		respondWithError(w, 403, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error suspending user: %s\n", err)
+		respondWithError(w, 404, "user not found")
+		return
+	}
+	respondWithJSON(w, 200, user)
+}
+
+// reinstateUser lifts a user's suspension or ban
+func (cfg *apiConfig) reinstateUser(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	userId, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid user ID")
+		return
+	}
+
+	user, err := cfg.DB.ReinstateUser(userId, p.UserId)
+	if err != nil {
+		log.Printf("Error reinstating user: %s\n", err)
+		respondWithError(w, 404, "user not found")
+		return
+	}
+	respondWithJSON(w, 200, user)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/jming514/chirpy/internals/database"
+)
+
+func TestSuspensionDetailsArePrivate(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "off")
+	s := newTestServer(t)
+	user := s.signUp(t, "user1@example.com")
+	follower := s.signUp(t, "user2@example.com")
+	admin := s.signUpAs(t, "admin@example.com", database.RoleAdmin)
+	expect(t, s.do(t, "POST", "/api/users/"+strconv.Itoa(user.Id)+"/follow", follower.Token, nil), 200, nil)
+
+	var suspended database.User
+	path := "/admin/users/" + strconv.Itoa(user.Id) + "/suspension"
+	expect(t, s.do(t, "PUT", path, admin.Token, map[string]string{"reason": "spam", "duration": "1h"}), 200, &suspended)
+	if suspended.Suspension == nil || suspended.Suspension.Reason != "spam" || suspended.Suspension.By != admin.Id {
+		t.Fatalf("admin got suspension %+v", suspended.Suspension)
+	}
+
+	// anyone can see that the user is suspended, but not why or by whom
+	check := func(where string, user database.User) {
+		t.Helper()
+		if user.Suspension == nil || user.Suspension.Until == nil {
+			t.Fatalf("%s: suspension %+v isn't shown", where, user.Suspension)
+		}
+		if user.Suspension.Reason != "" || user.Suspension.By != 0 {
+			t.Fatalf("%s: suspension %+v shows its reason or moderator", where, user.Suspension)
+		}
+	}
+	var got database.User
+	expect(t, s.do(t, "GET", "/api/users/"+strconv.Itoa(user.Id), "", nil), 200, &got)
+	check("user", got)
+	var users []database.User
+	expect(t, s.do(t, "GET", "/api/users", "", nil), 200, &users)
+	check("users", users[0])
+	expect(t, s.do(t, "GET", "/api/users/"+strconv.Itoa(follower.Id)+"/following", "", nil), 200, &users)
+	check("following", users[0])
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jming514/chirpy/internals/database"
+	"github.com/jming514/chirpy/internals/entities"
+)
+
+const (
+	// defaultTrendingWindow is how far back trending tags are counted
+	// unless the request sets window
+	defaultTrendingWindow = 24 * time.Hour
+	maxTrendingWindow     = 30 * 24 * time.Hour
+	defaultTrendingLimit  = 10
+)
+
+// parseEntities finds the hashtags and mentions in body. Mentions of
+// emails that don't belong to a user are dropped.
+func (cfg *apiConfig) parseEntities(body string) []entities.Entity {
+	found := entities.Parse(body)
+	ents := make([]entities.Entity, 0, len(found))
+	for _, e := range found {
+		if e.Type == entities.Mention {
+			user, err := cfg.DB.GetUserByEmail(body[e.Start+1 : e.End])
+			if err != nil && body[e.Start+1:e.End] != e.Text {
+				user, err = cfg.DB.GetUserByEmail(e.Text)
+			}
+			if err != nil {
+				continue
+			}
+			e.UserId = user.Id
+		}
+		ents = append(ents, e)
+	}
+	return ents
+}
+
+// chirpFeed responds with a page of the chirps matching options, newest
+// first unless sort=asc
+func (cfg *apiConfig) chirpFeed(w http.ResponseWriter, r *http.Request, options database.Options) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	options.Page = page
+	options.Sorting = "desc"
+	if r.URL.Query().Get("sort") == "asc" {
+		options.Sorting = "asc"
+	}
+
+	chirps, err := cfg.DB.GetChirps(options)
+	if err != nil {
+		log.Printf("Error getting chirps: %s\n", err)
+		respondWithError(w, 500, "Cannot get chirps")
+		return
+	}
+	respondWithPage(w, r, chirps, idOfChirp, page)
+}
+
+// tagFeed returns the chirps tagged with {tag}
+func (cfg *apiConfig) tagFeed(w http.ResponseWriter, r *http.Request) {
+	tag := strings.ToLower(strings.TrimPrefix(chi.URLParam(r, "tag"), "#"))
+	if tag == "" {
+		respondWithError(w, 400, "Invalid tag")
+		return
+	}
+	cfg.chirpFeed(w, r, database.Options{Tag: tag})
+}
+
+// mentions returns the chirps mentioning {userID}
+func (cfg *apiConfig) mentions(w http.ResponseWriter, r *http.Request) {
+	userId, ok := cfg.followTarget(w, r)
+	if !ok {
+		return
+	}
+	cfg.chirpFeed(w, r, database.Options{MentionedUserId: userId})
+}
+
+// trendingTags returns the tags used by the most chirps within window,
+// 24h by default
+func (cfg *apiConfig) trendingTags(w http.ResponseWriter, r *http.Request) {
+	window := defaultTrendingWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxTrendingWindow {
+			respondWithError(w, 400, "window must be a duration up to "+maxTrendingWindow.String())
+			return
+		}
+		window = d
+	}
+	limit := defaultTrendingLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			respondWithError(w, 400, "limit must be between 1 and "+strconv.Itoa(maxPageLimit))
+			return
+		}
+		limit = n
+	}
+
+	tags, err := cfg.DB.TrendingTags(time.Now().Add(-window), limit)
+	if err != nil {
+		log.Printf("Error getting trending tags: %s\n", err)
+		respondWithError(w, 500, "Cannot get trending tags")
+		return
+	}
+	respondWithJSON(w, 200, tags)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jming514/chirpy/internals/database"
+)
+
+// personalTokenPrefix starts every personal access token, telling them
+// apart from JWTs and making leaked ones easy to spot
+const personalTokenPrefix = "chirpy_pat_"
+
+// maxTokenNameLength caps the name a user gives a personal access token
+const maxTokenNameLength = 64
+
+// personalTokenResponse is a personal access token as shown to its owner.
+// Token, the secret, is only set in the response that creates it.
+type personalTokenResponse struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Token      string     `json:"token,omitempty"`
+}
+
+func newPersonalTokenResponse(t database.PersonalToken) personalTokenResponse {
+	resp := personalTokenResponse{
+		Id:        t.Id,
+		Name:      t.Name,
+		Scopes:    t.Scopes,
+		CreatedAt: t.CreatedAt,
+	}
+	if !t.LastUsedAt.IsZero() {
+		resp.LastUsedAt = &t.LastUsedAt
+	}
+	if !t.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &t.ExpiresAt
+	}
+	return resp
+}
+
+func generatePersonalToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return personalTokenPrefix + hex.EncodeToString(b), nil
+}
+
+// personalTokenPrincipal looks up a personal access token. It acts with its
+// own scopes, narrowed to those of the owner's current role. If it is not
+// ok, the error response has been written.
+func (cfg *apiConfig) personalTokenPrincipal(w http.ResponseWriter, secret string) (principal, bool) {
+	token, err := cfg.DB.GetPersonalToken(secret)
+	if errors.Is(err, database.ErrPersonalTokenNotFound) {
+		respondWithError(w, 401, "invalid token")
+		return principal{}, false
+	}
+	if err != nil {
+		log.Printf("Error getting personal access token: %s\n", err)
+		respondWithError(w, 500, "Cannot check token")
+		return principal{}, false
+	}
+	now := time.Now()
+	if !token.Active(now) {
+		respondWithError(w, 401, "token is revoked or expired")
+		return principal{}, false
+	}
+
+	user, ok := cfg.activeUser(w, token.UserId)
+	if !ok {
+		return principal{}, false
+	}
+
+	if now.Sub(token.LastUsedAt) > sessionTouchInterval {
+		if err := cfg.DB.TouchPersonalToken(token.Id); err != nil {
+			log.Printf("Error touching personal access token: %s\n", err)
+		}
+	}
+
+	return principal{
+		UserId:        user.Id,
+		TokenId:       token.Id,
+		Email:         user.Email,
+		Role:          user.Role,
+		Scopes:        narrowScopes(token.Scopes, user.Role),
+		ChirpyRed:     user.Is_Chirpy_Red,
+		EmailVerified: user.EmailVerified,
+	}, true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// personalTokens lists the caller's active personal access tokens, newest
+// first
+func (cfg *apiConfig) personalTokens(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+
+	tokens, err := cfg.DB.GetPersonalTokens(p.UserId)
+	if err != nil {
+		log.Printf("Error getting personal access tokens: %s\n", err)
+		respondWithError(w, 500, "Cannot get tokens")
+		return
+	}
+
+	resp := make([]personalTokenResponse, len(tokens))
+	for i, t := range tokens {
+		resp[i] = newPersonalTokenResponse(t)
+	}
+	respondWithJSON(w, 200, resp)
+}
+
+// createPersonalToken mints a personal access token with some of the
+// caller's scopes. With no scopes it can only read. The secret is in this
+// response and can't be retrieved again.
+func (cfg *apiConfig) createPersonalToken(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		// Expires_In_Days is how long the token lasts; zero never expires
+		Expires_In_Days int `json:"expires_in_days"`
+	}
+	p, _ := principalFrom(r.Context())
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 500, "Error decoding parameters...")
+		return
+	}
+
+	name := strings.TrimSpace(params.Name)
+	if name == "" {
+		respondWithError(w, 400, "name is required")
+		return
+	}
+	if len(name) > maxTokenNameLength {
+		respondWithError(w, 400, "name is too long")
+		return
+	}
+	if params.Expires_In_Days < 0 {
+		respondWithError(w, 400, "expires_in_days can't be negative")
+		return
+	}
+	scopes := []string{}
+	for _, scope := range params.Scopes {
+		if !p.hasScope(scope) {
+			respondWithError(w, 400, "cannot grant scope "+strconv.Quote(scope))
+			return
+		}
+		if !containsString(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	secret, err := generatePersonalToken()
+	if err != nil {
+		log.Printf("Error generating personal access token: %s\n", err)
+		respondWithError(w, 500, "Cannot create token")
+		return
+	}
+	token := database.PersonalToken{UserId: p.UserId, Name: name, Scopes: scopes}
+	if params.Expires_In_Days > 0 {
+		token.ExpiresAt = time.Now().AddDate(0, 0, params.Expires_In_Days)
+	}
+	token, err = cfg.DB.CreatePersonalToken(token, secret)
+	if err != nil {
+		log.Printf("Error creating personal access token: %s\n", err)
+		respondWithError(w, 500, "Cannot create token")
+		return
+	}
+
+	resp := newPersonalTokenResponse(token)
+	resp.Token = secret
+	respondWithJSON(w, 201, resp)
+}
+
+// revokePersonalToken revokes one of the caller's personal access tokens
+func (cfg *apiConfig) revokePersonalToken(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	tokenId, err := strconv.Atoi(chi.URLParam(r, "tokenID"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid token ID")
+		return
+	}
+
+	err = cfg.DB.RevokePersonalToken(p.UserId, tokenId)
+	if errors.Is(err, database.ErrPersonalTokenNotFound) {
+		respondWithError(w, 404, "token not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking personal access token: %s\n", err)
+		respondWithError(w, 500, "Cannot revoke token")
+		return
+	}
+	respondWithJSON(w, 200, "ok")
+}